@@ -0,0 +1,332 @@
+package goprof
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/google/pprof/profile"
+)
+
+// requestedProfileDir returns the cleaned directory requested with 'path' param if it may be read the same way
+// as by the download handler: it's a written profile or within the download directories and the link is signed
+// if downloads are. Otherwise it responds with the error and returns false.
+// Should be called with ourProfilingStateGuard hold
+func requestedProfileDir(w http.ResponseWriter, r *http.Request) (string, bool) {
+	profilesDir := r.URL.Query().Get("path")
+	if profilesDir == "" {
+		fatalError(w, r, "No such profile (param 'path' is mandatory)")
+		return "", false
+	}
+	profilesDir = filepath.Clean(profilesDir)
+	if err := checkDownloadSignature(profilesDir, r.URL.Query()); err != nil {
+		flashError(w, r, http.StatusForbidden, fmt.Sprintf("Cannot read '%v': %v", profilesDir, err))
+		return "", false
+	}
+	if _, ok := checkReadableDir(w, r, profilesDir); !ok {
+		return "", false
+	}
+	return profilesDir, true
+}
+
+// requestedProfile parses pprof file of the directory returned by requestedProfileDir and requested with 'file'
+// param, which is a name of the file inside it. If 'file' is empty, the main profile of the directory is used.
+// 'label' keeps only samples with the pprof label, see filterByLabel.
+// Should be called with ourProfilingStateGuard hold
+func requestedProfile(r *http.Request, profilesDir string) (*profile.Profile, error) {
+	query := r.URL.Query()
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		return nil, stateError("we write the requested profile at the moment. Stop it first")
+	}
+	fileName := query.Get("file")
+	if fileName == "" {
+		var err error
+		if fileName, err = mainProfileFile(profilesDir); err != nil {
+			return nil, err
+		}
+	}
+	if fileName != filepath.Base(fileName) {
+		return nil, fmt.Errorf("bad value for 'file' param: '%v'", fileName)
+	}
+	p, err := parseProfileFile(filepath.Join(profilesDir, fileName))
+	if err != nil {
+		return nil, err
+	}
+	if label := query.Get("label"); label != "" {
+		return filterByLabel(p, label)
+	}
+	return p, nil
+}
+
+// filterByLabel keeps only samples of the profile which have the pprof label, given as "key:value", e.g. the ones
+// of a single tenant's requests labeled with pprof.Do. It fails if no sample has the label, so a typo isn't taken
+// for a tenant which costs nothing
+func filterByLabel(p *profile.Profile, label string) (*profile.Profile, error) {
+	colon := strings.Index(label, ":")
+	if colon <= 0 {
+		return nil, fmt.Errorf("bad value for 'label' param: '%v', use key:value", label)
+	}
+	key, value := label[:colon], label[colon+1:]
+	keyFound := false
+	samples := make([]*profile.Sample, 0)
+	for _, sample := range p.Sample {
+		values, ok := sample.Label[key]
+		keyFound = keyFound || ok
+		for _, v := range values {
+			if v == value {
+				samples = append(samples, sample)
+				break
+			}
+		}
+	}
+	if !keyFound {
+		return nil, fmt.Errorf("profile has no samples labeled with '%v'", key)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("profile has no samples labeled with %v=%v", key, value)
+	}
+	filtered := p.Copy()
+	filtered.Sample = samples
+	// drop locations and functions of the samples which were filtered out
+	return filtered.Compact(), nil
+}
+
+// handler responding with the pprof file requested the same way as by requestedProfile, so a profile filtered
+// by 'label' can be analyzed with go tool pprof. Only the directories served by the download handler are allowed,
+// see requestedProfileDir
+func downloadProfileFile(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	profilesDir, ok := requestedProfileDir(w, r)
+	if !ok {
+		return
+	}
+	p, err := requestedProfile(r, profilesDir)
+	if err != nil {
+		requestedProfileError(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to write profile: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName(profilesDir) + pprofFileExt}))
+	setNoStore(w)
+	w.Write(buf.Bytes())
+}
+
+// requestedProfileError responds to the error returned by requestedProfile with 409 if the profile is being written
+// at the moment and with 400 otherwise
+func requestedProfileError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	if _, ok := err.(stateError); ok {
+		status = http.StatusConflict
+	}
+	writeError(w, r, status, fmt.Sprintf("Failed to read profile: %v", err))
+}
+
+// mainProfileFile returns name of the pprof file which is the most interesting in the directory:
+// cpu profile if there is one, otherwise the first pprof file
+func mainProfileFile(profilesDir string) (string, error) {
+	children, err := ioutil.ReadDir(profilesDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to ls '%v': %v", profilesDir, err)
+	}
+	fileName := ""
+	for _, child := range children {
+		name, isPprof, _ := profileFileName(child.Name())
+		if !child.Mode().IsRegular() || !isPprof {
+			continue
+		}
+		if name == "cpu" {
+			return child.Name(), nil
+		}
+		if fileName == "" {
+			fileName = child.Name()
+		}
+	}
+	if fileName == "" {
+		return "", fmt.Errorf("there are no pprof files in '%v'", profilesDir)
+	}
+	return fileName, nil
+}
+
+// allSymbolized returns true if every pprof file in the directory contains function names for all its addresses,
+// so it can be analyzed without the binary. Trace and files which aren't profiles don't need the binary either.
+// Legacy profiles keep only addresses on disk, even if they are symbolized when this process parses them
+func allSymbolized(profilesDir string, children []os.FileInfo) bool {
+	for _, child := range children {
+		if _, isPprof, _ := profileFileName(child.Name()); !isPprof {
+			continue
+		}
+		p, legacy, err := readProfileFile(filepath.Join(profilesDir, child.Name()))
+		if err != nil || legacy {
+			return false
+		}
+		for _, location := range p.Location {
+			if len(location.Line) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseProfileFile parses pprof file, protobuf or legacy text one. Legacy profiles written by this process are
+// symbolized, see symbolizeLegacy. Should be called with ourProfilingStateGuard hold
+func parseProfileFile(filePath string) (*profile.Profile, error) {
+	p, legacy, err := readProfileFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		// addresses of a profile written by another run, e.g. a recovered one, don't match the running binary
+		if written := findWrittenProfile(filepath.Dir(filePath)); written != nil && written.Process.current() {
+			symbolizeLegacy(p)
+		} else {
+			logf("'%v' is in the legacy format and wasn't written by this process, it's left unsymbolized", filePath)
+		}
+	}
+	return p, nil
+}
+
+// readProfileFile parses pprof file as it's written on disk and tells whether it's in the legacy text format
+func readProfileFile(filePath string) (p *profile.Profile, legacy bool, err error) {
+	file, err := openDecompressed(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	// protobuf starts with a field tag, while the legacy text format starts with the profile name or "---".
+	// Peeked bytes are overwritten by the following reads, so look at them before parsing
+	first, _ := reader.Peek(1)
+	legacy = len(first) > 0 && (first[0] == '-' || unicode.IsLetter(rune(first[0])))
+	if p, err = profile.Parse(reader); err != nil {
+		return nil, false, fmt.Errorf("failed to parse '%v': %v", filePath, err)
+	}
+	return p, legacy, nil
+}
+
+// symbolizeLegacy fills the functions of the profile written in the legacy text format, which keeps only addresses
+// of the stack frames. They are looked up in the running binary, so it's only valid for profiles written by this
+// process, see SetLegacyProfileFormat
+func symbolizeLegacy(p *profile.Profile) {
+	functions := make(map[string]*profile.Function)
+	for _, location := range p.Location {
+		fn := runtime.FuncForPC(uintptr(location.Address))
+		if len(location.Line) > 0 || fn == nil {
+			continue
+		}
+		function, ok := functions[fn.Name()]
+		if !ok {
+			file, _ := fn.FileLine(fn.Entry())
+			function = &profile.Function{ID: uint64(len(p.Function) + 1), Name: fn.Name(), SystemName: fn.Name(), Filename: file}
+			p.Function = append(p.Function, function)
+			functions[fn.Name()] = function
+		}
+		_, line := fn.FileLine(uintptr(location.Address))
+		location.Line = []profile.Line{{Function: function, Line: int64(line)}}
+	}
+}
+
+// sampleIndex returns index of the sample value with the given type, e.g. "cpu" or "alloc_space".
+// Empty type means the default one of the profile
+func sampleIndex(p *profile.Profile, sampleType string) (int, error) {
+	if sampleType == "" {
+		sampleType = p.DefaultSampleType
+	}
+	if sampleType == "" {
+		return len(p.SampleType) - 1, nil
+	}
+	for i, st := range p.SampleType {
+		if st.Type == sampleType {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("profile has no '%v' samples", sampleType)
+}
+
+// sampleStack returns names of the functions in the sample stack, from the root to the leaf.
+// Inlined functions are listed as separate frames
+func sampleStack(sample *profile.Sample) []string {
+	stack := make([]string, 0, len(sample.Location))
+	for i := len(sample.Location) - 1; i >= 0; i-- {
+		location := sample.Location[i]
+		if len(location.Line) == 0 {
+			stack = append(stack, fmt.Sprintf("0x%x", location.Address))
+			continue
+		}
+		// the last line is the function into which the preceding ones were inlined
+		for j := len(location.Line) - 1; j >= 0; j-- {
+			name := "?"
+			if location.Line[j].Function != nil {
+				name = location.Line[j].Function.Name
+			}
+			stack = append(stack, name)
+		}
+	}
+	return stack
+}
+
+// VerifyResponse tells whether every pprof file in the profiles directory can be parsed, e.g. to make sure
+// a capture wasn't truncated by a full disk before relying on it
+type VerifyResponse struct {
+	OK    bool           `json:"ok"`
+	Dir   string         `json:"dir"`
+	Valid bool           `json:"valid"` // false if some file failed to parse
+	Files []VerifiedFile `json:"files"`
+}
+
+// VerifiedFile is the result of parsing a pprof file
+type VerifiedFile struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"` // logical name of the profile, e.g. "cpu" or "heap"
+	Valid   bool   `json:"valid"`
+	Samples int    `json:"samples"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handler parsing every pprof file in the directory requested with 'path' param, the same directories as
+// the download handler serves can be verified. Trace and other files which aren't pprof are skipped
+func verifyProfiles(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	profilesDir, ok := requestedProfileDir(w, r)
+	if !ok {
+		return
+	}
+	children, err := ioutil.ReadDir(profilesDir)
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to ls '%v': %v", profilesDir, err))
+		return
+	}
+	resp := VerifyResponse{OK: true, Dir: profilesDir, Valid: true, Files: []VerifiedFile{}}
+	for _, child := range children {
+		name, isPprof, _ := profileFileName(child.Name())
+		if !child.Mode().IsRegular() || !isPprof {
+			continue
+		}
+		verified := VerifiedFile{Name: child.Name(), Profile: name, Valid: true}
+		if p, err := parseProfileFile(filepath.Join(profilesDir, child.Name())); err != nil {
+			verified.Valid, verified.Error = false, err.Error()
+			resp.Valid = false
+		} else {
+			verified.Samples = len(p.Sample)
+		}
+		resp.Files = append(resp.Files, verified)
+	}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
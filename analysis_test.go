@@ -0,0 +1,276 @@
+package goprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// writeTestProfile dumps real heap profile to the new temp dir, registers it as a written profile and returns the dir
+func writeTestProfile(t *testing.T) string {
+	profilesDir, err := ioutil.TempDir("", "prof-heap")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	// allocate something, so the profile isn't empty. Allocations get into the profile after gc
+	garbage := make([][]byte, 0, 16)
+	for i := 0; i < cap(garbage); i++ {
+		garbage = append(garbage, make([]byte, 1<<20))
+	}
+	runtime.GC()
+	if err := dumpProfile(profileHeap, profilesDir); err != nil {
+		os.RemoveAll(profilesDir)
+		t.Fatalf("Failed to dump heap profile: %v", err)
+	}
+	// register it as a written profile, so it can be downloaded
+	ourProfilingStateGuard.Lock()
+	ourWrittenProfiles = append(ourWrittenProfiles, prof{Prof: profileHeap, Dir: profilesDir, Start: time.Now()})
+	ourProfilingStateGuard.Unlock()
+	t.Cleanup(func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(profilesDir)
+	})
+	return profilesDir
+}
+
+func TestFlameGraph(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/flamegraph?sample=alloc_space&path="+url.QueryEscape(profilesDir), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %v: %v", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "<svg") || !strings.Contains(body, "<rect") {
+		t.Fatalf("Expected svg with frames, got %v", body)
+	}
+	w = httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/flamegraph?file=../passwd&path="+url.QueryEscape(profilesDir), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for file outside of the profiles dir, got %v", w.Code)
+	}
+}
+
+func TestAnalysisOfForbiddenDir(t *testing.T) {
+	// a real profile, but not a written one and not within the download directories
+	profilesDir, err := ioutil.TempDir("", "prof-heap")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(profilesDir)
+	if err := dumpProfile(profileHeap, profilesDir); err != nil {
+		t.Fatalf("Failed to dump heap profile: %v", err)
+	}
+	for _, route := range []string{"/flamegraph", "/top"} {
+		w := httptest.NewRecorder()
+		NewHandler().ServeHTTP(w, httptest.NewRequest("GET", route+"?json=1&path="+url.QueryEscape(profilesDir+"/."), nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %v of directory outside the allowlist, got %v: %v", route, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestFlameGraphTree(t *testing.T) {
+	root := newFlameNode("root")
+	root.add([]string{"main", "a"}, 3)
+	root.add([]string{"main", "b"}, 1)
+	root.add([]string{"main", "a"}, 2)
+	if root.value != 6 || root.children["main"].children["a"].value != 5 || root.depth() != 3 {
+		t.Fatalf("Unexpected tree: %#v", root)
+	}
+}
+
+func TestTopFunctions(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	work := &profile.Function{ID: 2, Name: "work"}
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: work}}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{30}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{10}},
+		},
+	}
+	resp := topFunctions(p, 0, false)
+	if resp.Total != 40 || len(resp.Items) != 2 {
+		t.Fatalf("Unexpected top: %#v", resp)
+	}
+	if top := resp.Items[0]; top.Name != "work" || top.Flat != 30 || top.Cum != 30 || top.FlatPercent != 75 {
+		t.Fatalf("Expected work to be on top, got %#v", top)
+	}
+	if resp := topFunctions(p, 0, true); resp.Items[0].Name != "main" || resp.Items[0].Cum != 40 {
+		t.Fatalf("Expected main to be on top by cum, got %#v", resp.Items[0])
+	}
+}
+
+func TestVerifyProfiles(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	verify := func() (int, VerifyResponse) {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/verify?path="+url.QueryEscape(profilesDir), nil))
+		var resp VerifyResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	code, resp := verify()
+	if code != http.StatusOK || !resp.Valid || len(resp.Files) != 1 || resp.Files[0].Profile != "heap" || resp.Files[0].Samples == 0 {
+		t.Fatalf("Expected valid heap profile, got %v %#v", code, resp)
+	}
+	// truncated like by a full disk
+	if err := ioutil.WriteFile(filepath.Join(profilesDir, "goroutine.pprof"), []byte{0x1f, 0x8b, 0x08}, 0644); err != nil {
+		t.Fatalf("Failed to write truncated profile: %v", err)
+	}
+	code, resp = verify()
+	if code != http.StatusOK || resp.Valid || len(resp.Files) != 2 {
+		t.Fatalf("Expected truncated profile to be reported, got %v %#v", code, resp)
+	}
+	for _, f := range resp.Files {
+		if f.Valid != (f.Profile == "heap") || !f.Valid && f.Error == "" {
+			t.Errorf("Unexpected result for %v: %#v", f.Name, f)
+		}
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/verify?json=1&path=/etc", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected directories which can't be downloaded to be rejected, got %v", w.Code)
+	}
+}
+
+func TestLegacyProfileFormat(t *testing.T) {
+	SetLegacyProfileFormat(true)
+	defer SetLegacyProfileFormat(false)
+	ourProfilingStateGuard.Lock()
+	profilesDir, err := startProfilingFor(profileHeap, 0)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to write heap profile: %v", err)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(profilesDir)
+	}()
+	written, err := ioutil.ReadFile(filepath.Join(profilesDir, "heap.pprof"))
+	if err != nil || !bytes.HasPrefix(written, []byte("heap profile:")) {
+		t.Fatalf("Expected heap profile in the legacy text format, got %.20q %v", written, err)
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/verify?json=1&path="+url.QueryEscape(profilesDir), nil))
+	var verified VerifyResponse
+	if err := json.NewDecoder(w.Body).Decode(&verified); err != nil || !verified.Valid {
+		t.Fatalf("Expected legacy profile to be valid, got %#v %v", verified, err)
+	}
+	// the file keeps only addresses, so the binary is needed to analyze it
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	names := archiveFiles(t, archive)
+	releaseArchiveBuffer(archive)
+	executable, _ := os.Executable()
+	if !strings.Contains(" "+strings.Join(names, " ")+" ", " "+filepath.Base(executable)+" ") {
+		t.Fatalf("Expected the archive of the legacy profile to include the binary, got %v", names)
+	}
+	symbolized := func() bool {
+		ourProfilingStateGuard.RLock()
+		defer ourProfilingStateGuard.RUnlock()
+		p, err := parseProfileFile(filepath.Join(profilesDir, "heap.pprof"))
+		if err != nil {
+			t.Fatalf("Failed to parse legacy profile: %v", err)
+		}
+		for _, sample := range p.Sample {
+			for _, name := range sampleStack(sample) {
+				if strings.HasPrefix(name, "github.com/lazada/goprof.") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if !symbolized() {
+		t.Fatalf("Expected functions of the legacy profile to be symbolized with the running binary")
+	}
+	// the profile of the previous run, e.g. recovered after restart, may come from another build
+	ourProfilingStateGuard.Lock()
+	findWrittenProfile(profilesDir).Process = &processInfo{PID: os.Getpid(), Started: ourProcessStarted.Add(-time.Hour)}
+	ourProfilingStateGuard.Unlock()
+	if symbolized() {
+		t.Fatalf("Expected the legacy profile of another run not to be symbolized")
+	}
+
+	// profiles dumped along with profiling which isn't one-off stay protobuf
+	ourProfilingStateGuard.Lock()
+	err = dumpProfile(profileHeap, profilesDir)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to dump heap profile: %v", err)
+	}
+	if written, err := ioutil.ReadFile(filepath.Join(profilesDir, "heap.pprof")); err != nil || bytes.HasPrefix(written, []byte("heap profile:")) {
+		t.Fatalf("Expected heap profile dumped on stop to be protobuf, got %.20q %v", written, err)
+	}
+}
+
+func TestFilterByLabel(t *testing.T) {
+	started, wait := make(chan struct{}), make(chan struct{})
+	defer close(wait)
+	go pprof.Do(context.Background(), pprof.Labels("tenant", "acme"), func(context.Context) {
+		blockedGoroutine(started, wait)
+	})
+	<-started
+	profilesDir, err := ioutil.TempDir("", "prof-goroutine")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(profilesDir)
+	if err := dumpProfile(profileGoroutine, profilesDir); err != nil {
+		t.Fatalf("Failed to dump goroutine profile: %v", err)
+	}
+	ourProfilingStateGuard.Lock()
+	ourWrittenProfiles = append(ourWrittenProfiles, prof{Prof: profileGoroutine, Dir: profilesDir, Start: time.Now()})
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(profilesDir)
+	}()
+
+	path := "?path=" + url.QueryEscape(profilesDir)
+	for _, label := range []string{"tenant", "tenant:nobody", "region:eu"} {
+		w := httptest.NewRecorder()
+		NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/top"+path+"&label="+url.QueryEscape(label), nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected label %v to be rejected, got %v", label, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/profile-file"+path+"&label=tenant:acme", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to download filtered profile: %v %v", w.Code, w.Body.String())
+	}
+	p, err := profile.Parse(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to parse filtered profile: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Label["tenant"][0] != "acme" {
+		t.Fatalf("Expected only the labeled goroutine, got %v", p)
+	}
+	if stack := strings.Join(sampleStack(p.Sample[0]), " "); !strings.Contains(stack, "goprof.blockedGoroutine") {
+		t.Fatalf("Expected the labeled goroutine stack, got %v", stack)
+	}
+}
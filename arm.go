@@ -0,0 +1,163 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// ArmedProfile is block or mutex profile armed with the arm handler, it collects contention from Since until it's
+// captured with the capture handler
+type ArmedProfile struct {
+	Profile string    `json:"profile"`
+	Rate    int       `json:"rate"` // block profile rate or mutex profile fraction set while armed
+	Since   time.Time `json:"since"`
+}
+
+type armedProfile struct {
+	ArmedProfile
+	previousRate int              // restored once the profile is disarmed
+	base         *profile.Profile // contention accumulated by the runtime before the profile was armed
+}
+
+// ourArmedProfiles are profiles armed with the arm handler by name
+var ourArmedProfiles = map[profName]*armedProfile{}
+
+// ArmResponse is returned by the arm handler
+type ArmResponse struct {
+	OK    bool         `json:"ok"`
+	Armed ArmedProfile `json:"armed"`
+}
+
+// setContentionRate sets block profile rate or mutex profile fraction and returns the previous one.
+// Should be called with ourProfilingStateGuard hold
+func setContentionRate(name profName, rate int) int {
+	if name == profileMutex {
+		return runtime.SetMutexProfileFraction(rate)
+	}
+	previousRate := ourBlockProfileRate
+	runtime.SetBlockProfileRate(rate)
+	ourBlockProfileRate = rate
+	return previousRate
+}
+
+// armProfile sets the rate of block or mutex profile and remembers the contention accumulated so far, so it's
+// subtracted when the profile is captured. Arming armed profile starts its window again with the new rate
+func armProfile(name profName, rate int) (ArmedProfile, error) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if name == profileBlock && ourCapturingBlock {
+		return ArmedProfile{}, stateError("cannot arm block profile, since it's being captured")
+	}
+	previousRate := setContentionRate(name, rate)
+	if armed := ourArmedProfiles[name]; armed != nil {
+		previousRate = armed.previousRate
+	}
+	base, err := parseCaptured(name)
+	if err != nil {
+		setContentionRate(name, previousRate)
+		delete(ourArmedProfiles, name)
+		return ArmedProfile{}, err
+	}
+	armed := &armedProfile{
+		ArmedProfile: ArmedProfile{Profile: string(name), Rate: rate, Since: time.Now()},
+		previousRate: previousRate,
+		base:         base,
+	}
+	ourArmedProfiles[name] = armed
+	return armed.ArmedProfile, nil
+}
+
+// captureArmedProfile returns the contention recorded since the profile was armed in pprof format.
+// Disarming restores the rate the profile had before it was armed, otherwise it keeps collecting
+func captureArmedProfile(name profName, disarm bool) ([]byte, error) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	armed := ourArmedProfiles[name]
+	if armed == nil {
+		return nil, stateError(fmt.Sprintf("%v profile isn't armed, arm it first", name))
+	}
+	end, err := parseCaptured(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := subtractProfile(armed.base, end, time.Since(armed.Since))
+	if err != nil {
+		return nil, err
+	}
+	if disarm {
+		setContentionRate(name, armed.previousRate)
+		delete(ourArmedProfiles, name)
+	}
+	return data, nil
+}
+
+// armedProfiles lists the armed profiles by name. Should be called with ourProfilingStateGuard hold
+func armedProfiles() []ArmedProfile {
+	armed := []ArmedProfile{}
+	for _, profile := range ourArmedProfiles {
+		armed = append(armed, profile.ArmedProfile)
+	}
+	sort.Slice(armed, func(i, j int) bool { return armed[i].Profile < armed[j].Profile })
+	return armed
+}
+
+// armedProfileParam returns the profile the arm and capture handlers are called for, block or mutex.
+// It responds with an error and returns false if it's another one
+func armedProfileParam(w http.ResponseWriter, r *http.Request) (profName, bool) {
+	name := profName(r.URL.Query().Get("profile"))
+	if name != profileBlock && name != profileMutex {
+		fatalError(w, r, fmt.Sprintf("Bad value for 'profile' param: '%v'. Please, use 'block' or 'mutex'.", name))
+		return name, false
+	}
+	return name, true
+}
+
+// handler arming block or mutex profile: 'profile' is block or mutex, 'rate' is block profile rate or mutex
+// profile fraction, 1 by default. The contention accumulated before is left out of the capture. Responds with ArmResponse
+func armHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := armedProfileParam(w, r)
+	if !ok {
+		return
+	}
+	rate := 1
+	if param := r.URL.Query().Get("rate"); param != "" {
+		var err error
+		if rate, err = strconv.Atoi(param); err != nil || rate <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'rate' param: '%v'. Please, use positive number.", param))
+			return
+		}
+	}
+	armed, err := armProfile(name, rate)
+	if err != nil {
+		writeError(w, r, errorStatus(err), fmt.Sprintf("Failed to arm %v profile: %v", name, err))
+		return
+	}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(ArmResponse{OK: true, Armed: armed})
+}
+
+// handler responding with the profile of contention recorded since block or mutex profile was armed, in pprof
+// format. 'disarm=1' restores the rate the profile had before it was armed
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	name, ok := armedProfileParam(w, r)
+	if !ok {
+		return
+	}
+	data, err := captureArmedProfile(name, r.URL.Query().Get("disarm") == "1")
+	if err != nil {
+		writeError(w, r, errorStatus(err), fmt.Sprintf("Failed to capture %v profile: %v", name, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": string(name) + ".pprof"}))
+	setNoStore(w)
+	w.Write(data)
+}
@@ -0,0 +1,97 @@
+package goprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestArmAndCapture(t *testing.T) {
+	handler := NewHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/capture?profile=block", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected capturing unarmed profile to conflict, got %v", w.Code)
+	}
+	for _, url := range []string{"/arm?profile=heap", "/arm?profile=block&rate=0", "/capture?profile=cpu"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v to be rejected, got %v", url, w.Code)
+		}
+	}
+
+	// contention before arming isn't captured even though it's recorded
+	SetBlockProfileRate(1)
+	defer SetBlockProfileRate(0)
+	blockBeforeArming := func() { blockFor(10 * time.Millisecond) }
+	blockBeforeArming()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/arm?profile=block&rate=2", nil))
+	var armResp ArmResponse
+	if err := json.NewDecoder(w.Body).Decode(&armResp); err != nil || !armResp.OK {
+		t.Fatalf("Failed to arm block profile: %v %v", w.Code, err)
+	}
+	if armResp.Armed.Profile != "block" || armResp.Armed.Rate != 2 {
+		t.Fatalf("Unexpected armed profile %+v", armResp.Armed)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?json=1", nil))
+	var listResp ProfileListResponse
+	if err := json.NewDecoder(w.Body).Decode(&listResp); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if len(listResp.Armed) != 1 || listResp.Armed[0].Profile != "block" || listResp.Rates.BlockProfileRate != 2 {
+		t.Fatalf("Expected armed block profile in the status, got %+v %+v", listResp.Armed, listResp.Rates)
+	}
+	if _, err := CaptureBlock(context.Background(), time.Second, 1); err == nil {
+		t.Fatalf("Expected CaptureBlock to fail while block profile is armed")
+	}
+
+	blockFor(50 * time.Millisecond)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/capture?profile=block", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to capture block profile: %v %v", w.Code, w.Body.String())
+	}
+	p, err := profile.Parse(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+	armed := false
+	for _, sample := range p.Sample {
+		var stack []string
+		for _, location := range sample.Location {
+			for _, line := range location.Line {
+				stack = append(stack, line.Function.Name)
+			}
+		}
+		joined := strings.Join(stack, " ") + " "
+		if strings.Contains(joined, "TestArmAndCapture.func1 ") {
+			t.Fatalf("Expected contention before arming not to be captured")
+		}
+		armed = armed || strings.Contains(joined, "goprof.blockFor github.com/lazada/goprof.TestArmAndCapture ")
+	}
+	if !armed {
+		t.Fatalf("Expected contention since arming to be captured")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/capture?profile=block&disarm=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to capture block profile again: %v %v", w.Code, w.Body.String())
+	}
+	ourProfilingStateGuard.RLock()
+	rate, stillArmed := ourBlockProfileRate, len(armedProfiles())
+	ourProfilingStateGuard.RUnlock()
+	if rate != 1 || stillArmed != 0 {
+		t.Fatalf("Expected disarming to restore the rate, got rate %v and %v armed profiles", rate, stillArmed)
+	}
+}
@@ -0,0 +1,142 @@
+package goprof
+
+import (
+	"net/http"
+	"time"
+)
+
+// AuditAction is an action recorded to the audit sink
+type AuditAction string
+
+const (
+	AuditStart    AuditAction = "start"
+	AuditStop     AuditAction = "stop"
+	AuditDownload AuditAction = "download"
+	AuditClear    AuditAction = "clear"
+	AuditConfig   AuditAction = "config"
+	AuditLabel    AuditAction = "label"
+	AuditArm      AuditAction = "arm"
+	AuditRename   AuditAction = "rename"
+	AuditAbort    AuditAction = "abort"
+)
+
+// AuditEvent describes a single action done with the profiling tools
+type AuditEvent struct {
+	Time    time.Time   `json:"time"`
+	Action  AuditAction `json:"action"`
+	Actor   string      `json:"actor"`             // remote address of the client
+	Profile string      `json:"profile,omitempty"` // requested profile type for start
+	Dir     string      `json:"dir,omitempty"`     // requested profiles directory for download or label
+	Status  int         `json:"status"`            // http status of the response, below 400 means the action succeeded
+}
+
+// AuditSink receives audit events, e.g. to keep them in a write-once store. Record is called after the action
+// is done and the profiling state is unlocked, so it may be slow, but it delays the response
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+// SetAuditSink sets the sink receiving audit events of starting and stopping profiling, downloads, clearing
+// and changing profile rates. Nil disables auditing, which is the default
+func SetAuditSink(sink AuditSink) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourAuditSink = sink
+}
+
+var ourAuditSink AuditSink
+
+// statusRecorder remembers the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered response, so streaming handlers work when audited
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// audited records the action done by the handler registered for the route to the audit sink. The action is taken
+// from the route and the request, requests which don't change anything (e.g. validating toggle params) aren't recorded
+func audited(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ourProfilingStateGuard.RLock()
+		sink := ourAuditSink
+		ourProfilingStateGuard.RUnlock()
+		event, ok := auditEvent(route, r)
+		if sink == nil || !ok {
+			handler(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+		event.Status = recorder.status
+		if event.Status == 0 {
+			event.Status = http.StatusOK
+		}
+		sink.Record(event)
+	}
+}
+
+// auditEvent returns the event for the request to the route, false if the request shouldn't be recorded
+func auditEvent(route string, r *http.Request) (AuditEvent, bool) {
+	query := r.URL.Query()
+	event := AuditEvent{Time: time.Now(), Actor: r.RemoteAddr}
+	switch route {
+	case "/toggle":
+		if query.Get("validate") == "1" {
+			return event, false
+		}
+		event.Action = AuditStop
+		if query.Get("enable") == "1" {
+			event.Action = AuditStart
+			event.Profile = query.Get("profile")
+		}
+	case "/abort":
+		event.Action = AuditAbort
+	case "/clear":
+		event.Action = AuditClear
+	case "/config":
+		if r.Method != http.MethodPost {
+			return event, false
+		}
+		event.Action = AuditConfig
+	case "/download/", "/profile-file":
+		event.Action = AuditDownload
+		event.Dir = query.Get("path")
+	case "/label":
+		event.Action = AuditLabel
+		event.Dir = query.Get("path")
+	case "/rename":
+		event.Action = AuditRename
+		event.Dir = query.Get("path")
+	case "/arm":
+		event.Action = AuditArm
+		event.Profile = query.Get("profile")
+	case "/capture":
+		event.Action = AuditDownload
+		event.Profile = query.Get("profile")
+	case "/binary", "/live-trace":
+		event.Action = AuditDownload
+	default:
+		return event, false
+	}
+	return event, true
+}
@@ -0,0 +1,40 @@
+package goprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type mockAuditSink struct {
+	events []AuditEvent
+}
+
+func (s *mockAuditSink) Record(event AuditEvent) {
+	s.events = append(s.events, event)
+}
+
+func TestAuditEvents(t *testing.T) {
+	sink := &mockAuditSink{}
+	SetAuditSink(sink)
+	defer SetAuditSink(nil)
+	handler := NewHandler()
+	for _, url := range []string{
+		"/toggle?enable=1&profile=nosuchprofile&validate=1",
+		"/toggle?enable=1&profile=nosuchprofile",
+		"/download/x.tgz?path=/nonexistent",
+		"/",
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	if len(sink.events) != 2 {
+		t.Fatalf("Expected start and download to be recorded, got %#v", sink.events)
+	}
+	start, download := sink.events[0], sink.events[1]
+	if start.Action != AuditStart || start.Profile != "nosuchprofile" || start.Status != http.StatusNotFound {
+		t.Fatalf("Unexpected start event %#v", start)
+	}
+	if download.Action != AuditDownload || download.Dir != "/nonexistent" || download.Status != http.StatusForbidden {
+		t.Fatalf("Unexpected download event %#v", download)
+	}
+}
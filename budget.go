@@ -0,0 +1,64 @@
+package goprof
+
+import (
+	"fmt"
+	"time"
+)
+
+// CaptureBudget limits how many profiles can be started per time window, e.g. 6 per hour, so profiling can't become
+// a chronic source of overhead whoever starts it: operators, slow requests or scripts. Zero value means no limit
+type CaptureBudget struct {
+	Max    int           // how many profiles can be started within the window
+	Window time.Duration // sliding window, a start is forgotten this long after it happened
+}
+
+// SetCaptureBudget limits starts of profiling, manual and automatic ones alike. Once the budget is spent, starting
+// profiling fails with 429 until the oldest start within the window is forgotten. One-off profiles written into
+// the directory of running profiling and profiles written on panic don't spend it
+func SetCaptureBudget(budget CaptureBudget) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.captureBudget = budget
+}
+
+// enabled returns true if the budget limits starts of profiling. Starts aren't remembered otherwise
+func (b CaptureBudget) enabled() bool {
+	return b.Max > 0 && b.Window > 0
+}
+
+// ourCaptures keeps the times profiling was started within the window of the capture budget, the oldest first
+var ourCaptures []time.Time
+
+// budgetError is returned when profiling can't be started, since the capture budget is spent
+type budgetError string
+
+func (e budgetError) Error() string {
+	return string(e)
+}
+
+// checkCaptureBudget returns budgetError if the capture budget doesn't allow starting one more profile now.
+// Should be called with ourProfilingStateGuard hold
+func checkCaptureBudget(now time.Time) error {
+	budget := ourConfig.captureBudget
+	if !budget.enabled() {
+		return nil
+	}
+	forgotten := 0
+	for forgotten < len(ourCaptures) && now.Sub(ourCaptures[forgotten]) >= budget.Window {
+		forgotten++
+	}
+	ourCaptures = ourCaptures[forgotten:]
+	if len(ourCaptures) < budget.Max {
+		return nil
+	}
+	next := ourCaptures[len(ourCaptures)-budget.Max].Add(budget.Window).Sub(now)
+	return budgetError(fmt.Sprintf("capture budget of %d profiles per %v is spent, the next profile can be started in %v",
+		budget.Max, budget.Window, next.Round(time.Second)))
+}
+
+// spendCaptureBudget remembers that profiling was started. Should be called with ourProfilingStateGuard hold
+func spendCaptureBudget(now time.Time) {
+	if ourConfig.captureBudget.enabled() {
+		ourCaptures = append(ourCaptures, now)
+	}
+}
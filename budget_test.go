@@ -0,0 +1,81 @@
+package goprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureBudget(t *testing.T) {
+	SetCaptureBudget(CaptureBudget{Max: 2, Window: time.Hour})
+	defer SetCaptureBudget(CaptureBudget{})
+	ourProfilingStateGuard.Lock()
+	ourCaptures = nil
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		ourCaptures = nil
+	}()
+	start := func() (string, error) {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+		if err == nil {
+			t.Cleanup(func() {
+				ourProfilingStateGuard.Lock()
+				defer ourProfilingStateGuard.Unlock()
+				removeWrittenProfile(dir)
+			})
+		}
+		return dir, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := start(); err != nil {
+			t.Fatalf("Expected profile %d to fit the budget, got %v", i, err)
+		}
+	}
+	if _, err := start(); err == nil || !strings.Contains(err.Error(), "budget") {
+		t.Fatalf("Expected the spent budget to refuse the profile, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=heap&json=1", nil))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "can be started in") {
+		t.Fatalf("Expected 429 telling when the next profile can be started, got %v %v", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&validate=1&profile=heap&json=1", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected validation to fail with 429 as well, got %v %v", w.Code, w.Body.String())
+	}
+
+	// the first start leaves the window
+	ourProfilingStateGuard.Lock()
+	ourCaptures[0] = ourCaptures[0].Add(-time.Hour)
+	ourProfilingStateGuard.Unlock()
+	if _, err := start(); err != nil {
+		t.Fatalf("Expected the budget to allow the profile once the window rolls over, got %v", err)
+	}
+	if _, err := start(); err == nil {
+		t.Fatalf("Expected the budget to be spent again")
+	}
+}
+
+func TestUnlimitedBudgetDoesNotKeepStarts(t *testing.T) {
+	SetCaptureBudget(CaptureBudget{Max: 2})
+	defer SetCaptureBudget(CaptureBudget{})
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourCaptures = nil
+	for i := 0; i < 3; i++ {
+		if err := checkCaptureBudget(time.Now()); err != nil {
+			t.Fatalf("Expected the budget without window not to limit starts, got %v", err)
+		}
+		spendCaptureBudget(time.Now())
+	}
+	if len(ourCaptures) != 0 {
+		t.Fatalf("Expected starts not to be kept without the window, got %v", len(ourCaptures))
+	}
+}
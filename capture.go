@@ -0,0 +1,209 @@
+package goprof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// CaptureCPU writes cpu profile for the given duration and returns it, nothing is written to disk.
+// It's meant for tests and benchmarks asserting on the profile of some code path. It fails if cpu profile is
+// being written already, and profiling can't be started with the handler until capturing is done.
+// If ctx is done earlier, profiling is stopped and ctx error is returned
+func CaptureCPU(ctx context.Context, d time.Duration) ([]byte, error) {
+	var profile bytes.Buffer
+	if err := startCapturingCPU(&profile); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	ourProfilingStateGuard.Lock()
+	pprof.StopCPUProfile()
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return profile.Bytes(), nil
+}
+
+func startCapturingCPU(profile *bytes.Buffer) error {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if profilingInProgress() {
+		return fmt.Errorf("cannot capture cpu profile, since profiling is already started")
+	}
+	if err := pprof.StartCPUProfile(profile); err != nil {
+		return fmt.Errorf("failed to start cpu profile: %v", err)
+	}
+	return nil
+}
+
+// CaptureBlock returns block profile of the contention which happened during the given duration only, nothing is
+// written to disk. The runtime accumulates block profile since the rate was first set and can't reset it, so the
+// profile is taken at the start and at the end of the window and the first one is subtracted. Block profile rate is
+// set to the given one for the window, 1 if it isn't positive, and restored after it, so the overhead of block
+// profiling is paid only while capturing. It fails if another block profile is being captured or block profile
+// is armed with the arm handler. If ctx is done earlier, capturing is stopped and ctx error is returned
+func CaptureBlock(ctx context.Context, d time.Duration, rate int) ([]byte, error) {
+	if rate <= 0 {
+		rate = 1
+	}
+	previousRate, err := startCapturingBlock(rate)
+	if err != nil {
+		return nil, err
+	}
+	defer stopCapturingBlock(previousRate)
+	base, err := parseCaptured(profileBlock)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	end, err := parseCaptured(profileBlock)
+	if err != nil {
+		return nil, err
+	}
+	return subtractProfile(base, end, d)
+}
+
+// subtractProfile returns the profile of what was recorded between base and end profiles taken over duration d,
+// written in pprof format
+func subtractProfile(base, end *profile.Profile, d time.Duration) ([]byte, error) {
+	window, _, err := diffProfiles(base, end)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subtract profile: %v", err)
+	}
+	// what happened before the window only is zero now
+	samples := window.Sample[:0]
+	for _, sample := range window.Sample {
+		for _, value := range sample.Value {
+			if value != 0 {
+				samples = append(samples, sample)
+				break
+			}
+		}
+	}
+	window.Sample = samples
+	window.DurationNanos = d.Nanoseconds()
+	var buf bytes.Buffer
+	if err := window.Write(&buf); err != nil {
+		return nil, fmt.Errorf("failed to write profile: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ourCapturingBlock is true while CaptureBlock runs, it changes block profile rate
+var ourCapturingBlock bool
+
+// startCapturingBlock sets block profile rate and returns the previous one
+func startCapturingBlock(rate int) (int, error) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if ourCapturingBlock {
+		return 0, stateError("cannot capture block profile, since it's being captured already")
+	}
+	if ourArmedProfiles[profileBlock] != nil {
+		return 0, stateError("cannot capture block profile, since it's armed, capture it with the capture handler")
+	}
+	ourCapturingBlock = true
+	previousRate := ourBlockProfileRate
+	runtime.SetBlockProfileRate(rate)
+	ourBlockProfileRate = rate
+	return previousRate, nil
+}
+
+func stopCapturingBlock(previousRate int) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	runtime.SetBlockProfileRate(previousRate)
+	ourBlockProfileRate = previousRate
+	ourCapturingBlock = false
+}
+
+func parseCaptured(name profName) (*profile.Profile, error) {
+	data, err := captureOneOff(name)
+	if err != nil {
+		return nil, err
+	}
+	return profile.ParseData(data)
+}
+
+// CaptureHeap returns heap profile, nothing is written to disk
+func CaptureHeap() ([]byte, error) {
+	return captureOneOff(profileHeap)
+}
+
+// CaptureGoroutine returns stacks of all goroutines in pprof format, nothing is written to disk
+func CaptureGoroutine() ([]byte, error) {
+	return captureOneOff(profileGoroutine)
+}
+
+// LookupProfile returns the runtime profile behind the name, e.g. to read goroutine count with Count() or to write it
+// somewhere yourself. The name is one of the one-off profiles, e.g. "heap" or "goroutine", or the name of the profile
+// created with pprof.NewProfile. Cpu profile and trace aren't kept by the runtime, so they can't be looked up
+func LookupProfile(name string) (*pprof.Profile, error) {
+	profile := profName(name)
+	if profile == profileSnapshot || checkProfileName(profile) == nil && !profile.OneOff() {
+		return nil, fmt.Errorf("%v profile isn't kept by the runtime, only written while profiling", name)
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		return nil, unknownProfileError(profile)
+	}
+	return p, nil
+}
+
+func captureOneOff(profile profName) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup(string(profile)).WriteTo(&buf, 0); err != nil {
+		return nil, fmt.Errorf("failed to write %v profile: %v", profile, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ProfileFor writes the profile for the given duration and returns the directory with it once profiling is stopped
+// and the files are flushed. One-off profiles are written immediately. Profiling is visible on the profiling page
+// meanwhile and may be stopped there earlier. If ctx is done earlier, profiling is stopped and ctx error is returned
+// along with the directory
+func ProfileFor(ctx context.Context, profile string, d time.Duration) (profilesDirectory string, err error) {
+	return doProfileFor(ctx, profName(profile), d, time.After)
+}
+
+func doProfileFor(ctx context.Context, profile profName, d time.Duration,
+	after func(time.Duration) <-chan time.Time) (profilesDirectory string, err error) {
+	ourProfilingStateGuard.Lock()
+	profilesDirectory, err = startProfilingContext(ctx, profile, d)
+	ourProfilingStateGuard.Unlock()
+	if err != nil || profile.OneOff() {
+		return profilesDirectory, err
+	}
+	reason := stopAutostop
+	select {
+	case <-after(d):
+	case <-ctx.Done():
+		reason, err = stopCanceled, ctx.Err()
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	// autostop or somebody else may have stopped it already, don't touch profiling started after that
+	if profilingInProgress() && ourCurrentProfile.Dir == profilesDirectory {
+		ourStopProfiling(reason)
+	}
+	return profilesDirectory, err
+}
@@ -0,0 +1,241 @@
+package goprof
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/lazada/goprof/example/workload"
+)
+
+func TestCaptureCPU(t *testing.T) {
+	data, err := CaptureCPU(context.Background(), 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to capture cpu profile: %v", err)
+	}
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+	if len(p.SampleType) == 0 || p.SampleType[0].Type != "samples" {
+		t.Fatalf("Expected cpu profile, got sample types %v", p.SampleType)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := CaptureCPU(ctx, time.Minute); err != context.Canceled {
+		t.Fatalf("Expected capturing to be canceled, got %v", err)
+	}
+}
+
+func TestCaptureCPUWhileProfiling(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	dir, err := startMockProfiling()
+	// mock profiling stops automatically at once, which must not happen while the lock is released
+	cancelAutoStop()
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	}()
+	if _, err := CaptureCPU(context.Background(), time.Millisecond); err == nil {
+		t.Fatalf("Expected capturing to fail while profiles are written to %v", dir)
+	}
+}
+
+func TestCaptureHeap(t *testing.T) {
+	data, err := CaptureHeap()
+	if err != nil {
+		t.Fatalf("Failed to capture heap profile: %v", err)
+	}
+	if _, err := profile.Parse(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	elapsed := make(chan time.Time)
+	close(elapsed)
+	after := func(time.Duration) <-chan time.Time { return elapsed }
+	dir, err := doProfileFor(context.Background(), profileCPU, time.Hour, after)
+	if err != nil {
+		t.Fatalf("Failed to profile: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ourProfilingStateGuard.RLock()
+	written, inProgress := findWrittenProfile(dir), profilingInProgress()
+	ourProfilingStateGuard.RUnlock()
+	if inProgress || written == nil || written.StopReason != stopAutostop {
+		t.Fatalf("Expected profiling to be stopped after the duration, got %#v", written)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cpuProfileFileName)); err != nil {
+		t.Fatalf("Expected cpu profile to be written: %v", err)
+	}
+
+	never := func(time.Duration) <-chan time.Time { return nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir, err = doProfileFor(ctx, profileCPU, time.Hour, never)
+	if err != context.Canceled {
+		t.Fatalf("Expected profiling to be canceled, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ourProfilingStateGuard.RLock()
+	written = findWrittenProfile(dir)
+	ourProfilingStateGuard.RUnlock()
+	if written == nil || written.StopReason != stopCanceled {
+		t.Fatalf("Expected canceled profile to be written, got %#v", written)
+	}
+}
+
+func TestLookupProfile(t *testing.T) {
+	p, err := LookupProfile("goroutine")
+	if err != nil || p.Count() == 0 {
+		t.Fatalf("Expected goroutine profile with goroutines, got %v", err)
+	}
+	custom := pprof.Lookup("goprof.test/custom")
+	if custom == nil {
+		custom = pprof.NewProfile("goprof.test/custom")
+	}
+	custom.Add(t, 0)
+	defer custom.Remove(t)
+	if p, err := LookupProfile("goprof.test/custom"); err != nil || p.Count() != 1 {
+		t.Fatalf("Expected custom profile to be found, got %v", err)
+	}
+	for _, name := range []string{"cpu", "trace", "all", "snapshot", "nosuchprofile"} {
+		if _, err := LookupProfile(name); err == nil {
+			t.Fatalf("Expected %v profile not to be found", name)
+		}
+	}
+}
+
+func TestCaptureBlock(t *testing.T) {
+	// contention before the window isn't captured even though it's recorded
+	SetBlockProfileRate(1)
+	defer SetBlockProfileRate(0)
+	blockFor(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(20 * time.Millisecond)
+		blockFor(50 * time.Millisecond)
+	}()
+	data, err := CaptureBlock(context.Background(), 200*time.Millisecond, 1)
+	<-done
+	if err != nil {
+		t.Fatalf("Failed to capture block profile: %v", err)
+	}
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+	if len(p.Sample) == 0 {
+		t.Fatalf("Expected contention of the window to be captured")
+	}
+	for _, sample := range p.Sample {
+		var stack []string
+		for _, location := range sample.Location {
+			for _, line := range location.Line {
+				stack = append(stack, line.Function.Name)
+			}
+		}
+		if strings.Contains(strings.Join(stack, " ")+" ", "goprof.blockFor github.com/lazada/goprof.TestCaptureBlock ") {
+			t.Fatalf("Expected contention before the window not to be captured")
+		}
+	}
+	ourProfilingStateGuard.RLock()
+	rate := ourBlockProfileRate
+	ourProfilingStateGuard.RUnlock()
+	if rate != 1 {
+		t.Fatalf("Expected block profile rate to be restored, got %v", rate)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := CaptureBlock(ctx, time.Minute, 1); err != context.Canceled {
+		t.Fatalf("Expected capturing to be canceled, got %v", err)
+	}
+}
+
+// blockFor blocks on a channel for the duration
+func blockFor(d time.Duration) {
+	ch := make(chan struct{})
+	time.AfterFunc(d, func() { close(ch) })
+	<-ch
+}
+
+// profiledFunction returns true if some sample of the profile has the function in its stack
+func profiledFunction(p *profile.Profile, function string) bool {
+	for _, sample := range p.Sample {
+		for _, name := range sampleStack(sample) {
+			if name == function {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCaptureCPUOfWorkload(t *testing.T) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				workload.GenerateLoad(1000, nil)
+			}
+		}
+	}()
+	data, err := CaptureCPU(context.Background(), 300*time.Millisecond)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatalf("Failed to capture cpu profile: %v", err)
+	}
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+	if !profiledFunction(p, "github.com/lazada/goprof/example/workload.isPrime") {
+		t.Fatalf("Expected checking primes to be profiled, got %v samples", len(p.Sample))
+	}
+}
+
+func TestCaptureGoroutineOfWorkload(t *testing.T) {
+	// the checkers block on reporting until the goroutines are captured
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		workload.GenerateLoad(100, func(int, bool) { <-release })
+	}()
+	defer func() {
+		close(release)
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+	data, err := CaptureGoroutine()
+	if err != nil {
+		t.Fatalf("Failed to capture goroutine profile: %v", err)
+	}
+	p, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse captured profile: %v", err)
+	}
+	if !profiledFunction(p, "github.com/lazada/goprof/example/workload.GenerateLoad.func1") {
+		t.Fatalf("Expected blocked checkers in goroutine profile, got %v samples", len(p.Sample))
+	}
+}
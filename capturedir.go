@@ -0,0 +1,128 @@
+package goprof
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetCaptureDirs allows the toggle handler to write profiles into the directory passed with 'dir' param, e.g.
+// /mnt/debug/run1, if it's within one of the base directories. Scripts get the profile at a predictable path then,
+// the profiles directory is created unless it exists, an existing one must be empty and is kept when the profile
+// is removed. The base directories themselves can't be used. By default 'dir' is rejected.
+// Calling it without arguments restores the default
+func SetCaptureDirs(dirs ...string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.captureDirs = nil
+	for _, dir := range dirs {
+		ourConfig.captureDirs = append(ourConfig.captureDirs, filepath.Clean(dir))
+	}
+}
+
+// createCaptureDir creates the profiles directory requested by the client unless it exists, see checkCaptureDir.
+// It returns the resolved directory and whether it was created by goprof.
+// Should be called with ourProfilingStateGuard hold
+func createCaptureDir(profilesDir string) (dir string, created bool, err error) {
+	profilesDir, exists, err := checkCaptureDir(profilesDir)
+	if err != nil || exists {
+		return profilesDir, false, err
+	}
+	return profilesDir, true, os.MkdirAll(profilesDir, 0700)
+}
+
+// checkCaptureDir checks that the profiles directory requested by the client may be used: it's within the capture
+// dirs and, if it exists, it's empty and doesn't keep a written profile. Symlinks are resolved before checking that
+// the directory is within the capture dirs, the base directories themselves can't be used. It returns the resolved
+// directory and whether it exists. Should be called with ourProfilingStateGuard hold
+func checkCaptureDir(profilesDir string) (dir string, exists bool, err error) {
+	if !filepath.IsAbs(profilesDir) {
+		return "", false, forbiddenDirError(profilesDir)
+	}
+	profilesDir, err = resolveDir(filepath.Clean(profilesDir))
+	if err != nil {
+		return "", false, err
+	}
+	bases := make([]string, 0, len(ourConfig.captureDirs))
+	for _, base := range ourConfig.captureDirs {
+		if resolved, err := resolveDir(base); err == nil {
+			base = resolved
+		}
+		if base == profilesDir {
+			// the base would be removed with the profile
+			return "", false, forbiddenDirError(profilesDir)
+		}
+		bases = append(bases, base)
+	}
+	if !withinDirs(profilesDir, bases) {
+		return "", false, forbiddenDirError(profilesDir)
+	}
+	if findWrittenProfile(profilesDir) != nil || ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		return "", false, stateError(fmt.Sprintf("'%s' keeps another profile", profilesDir))
+	}
+	children, err := ioutil.ReadDir(profilesDir)
+	if os.IsNotExist(err) {
+		return profilesDir, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if len(children) > 0 {
+		return "", false, stateError(fmt.Sprintf("'%s' isn't empty", profilesDir))
+	}
+	return profilesDir, true, nil
+}
+
+// resolveDir resolves symlinks of the longest existing part of the absolute path, the rest of it is kept as is
+func resolveDir(dir string) (string, error) {
+	existing, rest := dir, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return dir, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, rest), nil
+}
+
+// removeProfilesDir removes the profiles directory of the profile. Directories requested by the client which
+// existed before are kept, only their files are removed, so goprof never removes what it didn't create
+func removeProfilesDir(profilesDir string, keepDir bool) error {
+	if !keepDir {
+		return os.RemoveAll(profilesDir)
+	}
+	children, err := ioutil.ReadDir(profilesDir)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := os.RemoveAll(filepath.Join(profilesDir, child.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withinDirs returns true if the directory is one of the base directories or within one of them
+func withinDirs(dir string, bases []string) bool {
+	for _, base := range bases {
+		rel, err := filepath.Rel(base, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
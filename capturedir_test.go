@@ -0,0 +1,107 @@
+package goprof
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureDir(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "goprof-capture")
+	if err != nil {
+		t.Fatalf("Failed to create base dir: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	handler := NewHandler()
+	toggle := func(dir string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=heap&json=1&dir="+url.QueryEscape(dir), nil))
+		return w.Code
+	}
+	dir := filepath.Join(baseDir, "debug", "run1")
+	if status := toggle(dir); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 until capture dirs are allowed, got %v", status)
+	}
+	SetCaptureDirs(filepath.Join(baseDir, "debug"))
+	defer SetCaptureDirs()
+	validate := func(dir string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&validate=1&profile=cpu&json=1&dir="+url.QueryEscape(dir), nil))
+		return w.Code
+	}
+	if status := validate(filepath.Join(baseDir, "other")); status != http.StatusForbidden {
+		t.Fatalf("Expected validation to fail with 403 for the dir outside capture dirs, got %v", status)
+	}
+	if status := validate(dir); status != http.StatusOK {
+		t.Fatalf("Expected validation to pass for %v, got %v", dir, status)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected validation not to create %v, got %v", dir, err)
+	}
+	if status := toggle(filepath.Join(baseDir, "other")); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for the dir outside capture dirs, got %v", status)
+	}
+	if status := toggle(filepath.Join(baseDir, "debug", "..", "other")); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for the dir escaping capture dirs, got %v", status)
+	}
+	if status := toggle(dir); status != http.StatusOK {
+		t.Fatalf("Expected the profile to be written into %v, got %v", dir, status)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(dir)
+	}()
+	ourProfilingStateGuard.RLock()
+	written := findWrittenProfile(dir)
+	ourProfilingStateGuard.RUnlock()
+	if written == nil {
+		t.Fatalf("Expected the profile in %v to be listed as written", dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "heap.pprof")); err != nil {
+		t.Fatalf("Expected heap profile in %v: %v", dir, err)
+	}
+	if status := toggle(dir); status != http.StatusConflict {
+		t.Fatalf("Expected 409 for the dir keeping another profile, got %v", status)
+	}
+	notEmpty := filepath.Join(baseDir, "debug", "run2")
+	if err := os.MkdirAll(notEmpty, 0700); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(notEmpty, "notes.txt"), nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if status := toggle(notEmpty); status != http.StatusConflict {
+		t.Fatalf("Expected 409 for the dir which isn't empty, got %v", status)
+	}
+	if status := toggle(filepath.Join(baseDir, "debug")); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for the capture dir itself, got %v", status)
+	}
+	if err := os.Symlink(baseDir, filepath.Join(baseDir, "debug", "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if status := toggle(filepath.Join(baseDir, "debug", "escape", "run3")); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for the dir escaping capture dirs with symlink, got %v", status)
+	}
+	// the existing directory isn't goprof's, so it's kept when the profile is removed
+	existing := filepath.Join(baseDir, "debug", "run4")
+	if err := os.MkdirAll(existing, 0700); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if status := toggle(existing); status != http.StatusOK {
+		t.Fatalf("Expected the profile to be written into the existing %v, got %v", existing, status)
+	}
+	ourProfilingStateGuard.Lock()
+	err = removeWrittenProfile(existing)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to remove the profile: %v", err)
+	}
+	if children, err := ioutil.ReadDir(existing); err != nil || len(children) != 0 {
+		t.Fatalf("Expected the existing dir to be kept empty, got %v %v", children, err)
+	}
+}
@@ -0,0 +1,144 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+// CompareResponse lists functions whose cost differs the most between the latest profiles of two variants.
+// Flat and Cum of the items are the differences: positive means the variant costs more than the base.
+// Percents are relative to the total of the base profile
+type CompareResponse struct {
+	OK         bool          `json:"ok"`
+	BaseDir    string        `json:"base_dir"`
+	VariantDir string        `json:"variant_dir"`
+	SampleType string        `json:"sample_type"`
+	Unit       string        `json:"unit"`
+	BaseTotal  int64         `json:"base_total"`
+	Total      int64         `json:"total"` // total of the variant minus total of the base
+	Items      []TopFunction `json:"items"`
+}
+
+// handler comparing the latest written profiles labeled with 'base' and 'variant' params, e.g. baseline and canary
+// deploys. 'profile' chooses profile type (cpu by default), 'sample' chooses sample type, 'n' limits number
+// of functions (20 by default) and 'sort' is either 'flat' or 'cum'. The largest regressions go first
+func compareVariants(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+
+	query := r.URL.Query()
+	baseVariant, variant := query.Get("base"), query.Get("variant")
+	if baseVariant == "" || variant == "" {
+		fatalError(w, r, "Params 'base' and 'variant' are mandatory")
+		return
+	}
+	profileType := profName(query.Get("profile"))
+	if profileType == "" {
+		profileType = profileCPU
+	}
+	limit := defaultTopFunctions
+	if n := query.Get("n"); n != "" {
+		var err error
+		if limit, err = strconv.Atoi(n); err != nil || limit <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'n' param: '%v'. Please, use positive number.", n))
+			return
+		}
+	}
+	sortBy := query.Get("sort")
+	if sortBy != "" && sortBy != "flat" && sortBy != "cum" {
+		fatalError(w, r, fmt.Sprintf("Bad value for 'sort' param: '%v'. Please, use flat or cum.", sortBy))
+		return
+	}
+	var written [2]*prof
+	var parsed [2]*profile.Profile
+	for i, label := range []string{baseVariant, variant} {
+		if written[i] = latestVariant(profileType, label); written[i] == nil {
+			writeError(w, r, http.StatusNotFound, fmt.Sprintf("No written %v profile of '%v' variant", profileType, label))
+			return
+		}
+		var err error
+		if parsed[i], err = parseMainProfile(written[i].Dir); err != nil {
+			fatalError(w, r, fmt.Sprintf("Failed to read profile: %v", err))
+			return
+		}
+	}
+	baseWritten, variantWritten := written[0], written[1]
+	base, target := parsed[0], parsed[1]
+	index, err := sampleIndex(base, query.Get("sample"))
+	if err != nil {
+		fatalError(w, r, err.Error())
+		return
+	}
+	diff, baseTotal, err := diffProfiles(base, target)
+	if err != nil {
+		fatalError(w, r, fmt.Sprintf("Failed to compare profiles: %v", err))
+		return
+	}
+	top := topFunctions(diff, index, sortBy == "cum")
+	resp := CompareResponse{
+		OK:         true,
+		BaseDir:    baseWritten.Dir,
+		VariantDir: variantWritten.Dir,
+		SampleType: top.SampleType,
+		Unit:       top.Unit,
+		BaseTotal:  baseTotal[index],
+		Total:      top.Total,
+		Items:      []TopFunction{},
+	}
+	for _, f := range top.Items {
+		if f.Flat == 0 && f.Cum == 0 {
+			continue
+		}
+		if resp.BaseTotal != 0 {
+			f.FlatPercent = 100 * float64(f.Flat) / float64(resp.BaseTotal)
+			f.CumPercent = 100 * float64(f.Cum) / float64(resp.BaseTotal)
+		}
+		resp.Items = append(resp.Items, f)
+		if len(resp.Items) == limit {
+			break
+		}
+	}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// latestVariant returns the latest written profile of the type labeled with the variant, nil if there is none
+// Should be called with ourProfilingStateGuard hold
+func latestVariant(profileType profName, variant string) *prof {
+	for i := len(ourWrittenProfiles) - 1; i >= 0; i-- {
+		if ourWrittenProfiles[i].Prof == profileType && ourWrittenProfiles[i].Variant == variant {
+			return &ourWrittenProfiles[i]
+		}
+	}
+	return nil
+}
+
+func parseMainProfile(profilesDir string) (*profile.Profile, error) {
+	fileName, err := mainProfileFile(profilesDir)
+	if err != nil {
+		return nil, err
+	}
+	return parseProfileFile(filepath.Join(profilesDir, fileName))
+}
+
+// diffProfiles returns the profile with target samples minus base samples, like pprof -diff_base does,
+// and the totals of the base profile per sample type. The base profile is changed
+func diffProfiles(base, target *profile.Profile) (*profile.Profile, []int64, error) {
+	baseTotal := make([]int64, len(base.SampleType))
+	for _, sample := range base.Sample {
+		for i, value := range sample.Value {
+			baseTotal[i] += value
+		}
+	}
+	base.Scale(-1)
+	diff, err := profile.Merge([]*profile.Profile{base, target})
+	if err != nil {
+		return nil, nil, err
+	}
+	return diff, baseTotal, nil
+}
@@ -0,0 +1,45 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCompareVariants(t *testing.T) {
+	baseDir := writeTestProfile(t)
+	defer os.RemoveAll(baseDir)
+	variantDir := writeTestProfile(t)
+	defer os.RemoveAll(variantDir)
+	ourProfilingStateGuard.Lock()
+	setVariant(baseDir, "baseline")
+	setVariant(variantDir, "canary")
+	ourProfilingStateGuard.Unlock()
+
+	handler := NewHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/compare?base=baseline&variant=canary&profile=heap&sample=alloc_space&n=5", nil))
+	var resp CompareResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusOK || resp.BaseDir != baseDir || resp.VariantDir != variantDir || resp.SampleType != "alloc_space" {
+		t.Fatalf("Unexpected comparison %v %#v", w.Code, resp)
+	}
+	if resp.BaseTotal <= 0 || len(resp.Items) > 5 {
+		t.Fatalf("Expected base total and at most 5 functions, got %#v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/compare?base=baseline&variant=nosuchvariant&profile=heap", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown variant, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/compare?base=baseline", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without variant, got %v", w.Code)
+	}
+}
@@ -0,0 +1,606 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// config keeps settings of the package. It should be changed with ourProfilingStateGuard hold,
+// so use Set* functions for changing it
+type config struct {
+	uiTitle      string             // name of the service shown on the profiling page
+	pageTemplate *template.Template // custom template for the profiling page, nil means the built-in one
+	// command run by show-web script in downloaded archives, empty means defaultShowWebCommand
+	showWebCommand string
+	// URL which show-remote script in downloaded archives uploads the profile to, empty means no such script
+	pprofServer string
+	// don't put the binary into downloaded archives when profiles have symbols
+	archiveWithoutBinary bool
+	// put runtime details recorded when profiling started into downloaded archives
+	archiveRuntimeInfo bool
+	// returns extra files put into downloaded archives, nil means none
+	archiveExtras ArchiveExtrasFxn
+	// how long building a download archive may take, 0 means no limit
+	archiveTimeout time.Duration
+	// what happens to written profiles on disk
+	cleanupPolicy CleanupPolicy
+	// the limit of disk space taken by all the written profiles, 0 means no limit
+	maxTotalProfileBytes int64
+	// how long one-off profiles are kept
+	oneOffRetention OneOffRetention
+	// how many profiles can be started per time window
+	captureBudget CaptureBudget
+	// don't dump heap profile when 'all' profiling stops
+	noHeapOnStop bool
+	// which memory profiles are dumped when 'all' profiling stops
+	heapDumpOnStop HeapDump
+	// dump one-off profiles in the legacy text format (debug=1) instead of gzipped protobuf
+	legacyProfileFormat bool
+	// prefix of profiles directory names, empty means defaultTempDirPrefix
+	tempDirPrefix string
+	// changes the server started by ListenAndServe and Serve, nil keeps net/http defaults
+	configureServer func(server *http.Server)
+	// close connections after downloads instead of keeping them alive
+	closeAfterDownload bool
+	// serve only HTTP/1.1 over TLS
+	noHTTP2 bool
+	// environment variables recorded along with profiles
+	recordedEnv []string
+	// receives cpu profile along with the file it's written to, nil means only the file
+	cpuProfileCollector io.Writer
+	// start names of downloaded archives with the hostname
+	hostnameInArchiveNames bool
+	// the limit of downloaded archive size, 0 means no limit
+	maxArchiveBytes int64
+	// how long profiles run until autostop, profiles missing here run for defautMaxProfilingDuration
+	profileDurations map[profName]time.Duration
+	// cleaned base directories which may be downloaded besides the written profiles
+	downloadDirs []string
+	// cleaned base directories where the toggle handler may write profiles requested with 'dir' param
+	captureDirs []string
+	// stop profiling started with the handler when nobody requests status or listing for so long, 0 means never
+	idleTimeout time.Duration
+	// how long before autostop it's announced, 0 means it isn't
+	autostopWarning time.Duration
+	// names of runtime/metrics sampled by runtime-metrics handler, empty means defaultRuntimeMetrics
+	runtimeMetrics []string
+	// key of download link signatures, empty means downloads aren't signed
+	downloadSecret []byte
+	// binary put into archives and served by /binary, empty means the running executable
+	binaryPath string
+	// how often cpu-goroutines profiling samples goroutine profile
+	goroutineSampleInterval time.Duration
+	// the limit of goroutines written by goroutine-dump handler, 0 means no limit
+	maxGoroutineDump int
+	// directories profiles are written into instead of new temp dirs, no slots mean the ring is off
+	profileRing profileRing
+	// the ready handler responds with 503 while one of these profiles is being written
+	notReadyProfiles []profName
+}
+
+// defaultTempDirPrefix starts names of profiles directories unless another prefix is set with SetTempDirPrefix
+const defaultTempDirPrefix = "prof-"
+
+// CleanupPolicy tells when directories of written profiles are removed from disk
+type CleanupPolicy int
+
+const (
+	// CleanupKeep keeps written profiles until the process exits or they are cleared
+	CleanupKeep CleanupPolicy = iota
+	// CleanupOnDownload removes a profile as soon as its archive is downloaded
+	CleanupOnDownload
+	// CleanupOnStop removes profiles written before once the next profiling stops, so only the latest one stays on disk
+	CleanupOnStop
+)
+
+func (p CleanupPolicy) String() string {
+	switch p {
+	case CleanupKeep:
+		return "keep"
+	case CleanupOnDownload:
+		return "on-download"
+	case CleanupOnStop:
+		return "on-stop"
+	}
+	return fmt.Sprintf("CleanupPolicy(%d)", int(p))
+}
+
+const (
+	// defaultArchiveTimeout is long enough for packing a large binary with a long trace
+	defaultArchiveTimeout = 2 * time.Minute
+	// defaultGoroutineSampleInterval gives 30 goroutine profiles during cpu-goroutines profiling of default duration
+	defaultGoroutineSampleInterval = 10 * time.Second
+	// defaultMaxGoroutineDump keeps the full goroutine dump within a few dozen megabytes
+	defaultMaxGoroutineDump = 10000
+)
+
+var ourConfig = config{
+	archiveTimeout:          defaultArchiveTimeout,
+	goroutineSampleInterval: defaultGoroutineSampleInterval,
+	maxGoroutineDump:        defaultMaxGoroutineDump,
+}
+
+// SetUITitle sets the name shown in the title and heading of the profiling page,
+// so it's easy to understand which service's profiler is opened
+func SetUITitle(title string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.uiTitle = title
+}
+
+// SetTemplate replaces the built-in template of the profiling page. The template receives PageData and
+// should be parsed with TemplateFuncs. It's checked by rendering sample data and isn't changed if rendering fails.
+// Passing nil restores the built-in template
+func SetTemplate(t *template.Template) error {
+	if t != nil {
+		sample := &prof{Prof: profileCPU, Dir: "/tmp/prof-cpu", Start: time.Now(), Duration: time.Minute}
+		for _, data := range []PageData{
+			{Title: "sample", WrittenProfiles: []prof{*sample}, CurrentProfile: sample, Message: "sample"},
+			{},
+		} {
+			if err := t.Execute(ioutil.Discard, data); err != nil {
+				return fmt.Errorf("failed to render template: %v", err)
+			}
+		}
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.pageTemplate = t
+	return nil
+}
+
+// SetShowWebCommand sets the command which show-web script in downloaded archives runs.
+// {{bin}} and {{profile}} placeholders are replaced with the names of the binary and the profile file,
+// e.g. "/opt/pprof/bin/pprof -web {{bin}} {{profile}}". Empty command restores "go tool pprof -web {{bin}} {{profile}}"
+func SetShowWebCommand(command string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.showWebCommand = command
+}
+
+// SetPprofServer puts show-remote script into downloaded archives, which uploads the profile to the shared pprof
+// server with POST and opens the URL the server responds with, so the profile can be analyzed without local go
+// toolchain. The script is put along with show-web, for archives with a single pprof file. Empty URL turns it off
+func SetPprofServer(uploadURL string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.pprofServer = uploadURL
+}
+
+// SetArchiveBinary tells whether downloaded archives contain the binary, which is true by default.
+// Profiles written by modern go have symbols and are usable without the binary, so the archive may be much smaller.
+// If some profile lacks symbols, the binary is put into the archive anyway
+func SetArchiveBinary(include bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.archiveWithoutBinary = !include
+}
+
+// SetArchiveRuntimeInfo tells whether downloaded and stored archives contain runtime.txt with GOMAXPROCS, number
+// of cpus, number of cgo calls and the scheduler snapshot taken when profiling started, which helps to read traces.
+// The same details are always kept in metadata.json. It's disabled by default
+func SetArchiveRuntimeInfo(include bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.archiveRuntimeInfo = include
+}
+
+// SetBinaryPath sets the binary which is put into downloaded archives and served by /binary, e.g. the unstripped
+// build of the running stripped one. The running executable is used by default
+func SetBinaryPath(path string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.binaryPath = path
+}
+
+// SetArchiveTimeout limits how long building an archive for download may take, 2 minutes by default.
+// If packing takes longer, the download fails with 504 instead of hanging. Zero disables the limit
+func SetArchiveTimeout(timeout time.Duration) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.archiveTimeout = timeout
+}
+
+// SetCleanupPolicy tells when written profiles are removed from disk, CleanupKeep is the default
+func SetCleanupPolicy(policy CleanupPolicy) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.cleanupPolicy = policy
+}
+
+// OneOffRetention tells how long one-off profiles, e.g. heap or goroutine, are kept. They are cheap and captured
+// often, so they pile up faster than profiles which run for a while. Zero value keeps them as other profiles
+type OneOffRetention struct {
+	// TTL removes one-off profile this long after it's written, zero keeps it
+	TTL time.Duration
+	// MaxCount keeps only this many latest one-off profiles, older ones are removed once a new one is written.
+	// Zero means no limit
+	MaxCount int
+}
+
+// SetOneOffRetention sets how long one-off profiles are kept, on top of the cleanup policy and the disk space limit.
+// Profiles written before aren't affected. One-off profiles written into the directory of running profiling are
+// a part of that profile and are kept along with it. Panic profiles are neither removed nor counted
+func SetOneOffRetention(retention OneOffRetention) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.oneOffRetention = retention
+}
+
+// SetMaxTotalProfileBytes limits disk space taken by all the written profiles. When a new profile gets written
+// and the total size exceeds the limit, the oldest profiles are removed until it fits. Zero disables the limit
+func SetMaxTotalProfileBytes(n int64) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.maxTotalProfileBytes = n
+}
+
+// SetMaxArchiveBytes limits size of downloaded archives, so clients and proxies don't get surprise multi-gigabyte
+// responses. Packing stops as soon as the archive exceeds the limit and the download fails with 413.
+// Zero disables the limit, which is the default
+func SetMaxArchiveBytes(n int64) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.maxArchiveBytes = n
+}
+
+// SetHeapProfileOnStop tells whether heap profile is written when 'all' profiling stops, which is true by default.
+// When it's disabled, archives of 'all' profiles contain only cpu profile and trace
+func SetHeapProfileOnStop(enabled bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.noHeapOnStop = !enabled
+}
+
+// HeapDump tells which memory profiles are written when 'all' profiling stops
+type HeapDump int
+
+const (
+	// HeapDumpInuse writes heap profile, heap.pprof, which shows in-use memory by default
+	HeapDumpInuse HeapDump = iota
+	// HeapDumpAllocs writes allocs profile, allocs.pprof, which shows all allocations made since the start by default
+	HeapDumpAllocs
+	// HeapDumpBoth writes both heap.pprof and allocs.pprof
+	HeapDumpBoth
+)
+
+func (d HeapDump) String() string {
+	switch d {
+	case HeapDumpInuse:
+		return "heap"
+	case HeapDumpAllocs:
+		return "allocs"
+	case HeapDumpBoth:
+		return "heap+allocs"
+	}
+	return fmt.Sprintf("HeapDump(%d)", int(d))
+}
+
+// profiles returns the profiles written for the dump
+func (d HeapDump) profiles() []profName {
+	switch d {
+	case HeapDumpAllocs:
+		return []profName{profileAllocs}
+	case HeapDumpBoth:
+		return []profName{profileHeap, profileAllocs}
+	}
+	return []profName{profileHeap}
+}
+
+// SetHeapDumpOnStop chooses which memory profiles are written when 'all' profiling stops, heap profile
+// by default. Allocs profile has the same samples, but pprof shows allocated space instead of in-use one by default.
+// SetHeapProfileOnStop(false) turns the dump off whatever is chosen here
+func SetHeapDumpOnStop(dump HeapDump) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.heapDumpOnStop = dump
+}
+
+// SetLegacyProfileFormat makes one-off profiles started by the client, e.g. heap or goroutine, be written in the legacy
+// text format, the one /debug/pprof serves with debug=1, for old tooling which can't read protobuf. Profiles dumped
+// along with others, e.g. the heap written when "all" stops, panic profiles and goroutine samples of cpu-goroutines,
+// stay protobuf, and cpu profile can't be written in it. Analysis handlers symbolize legacy profiles with the running
+// binary, so the ones written by a previous run, e.g. recovered after restart, are left unsymbolized.
+// It's disabled by default
+func SetLegacyProfileFormat(enabled bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.legacyProfileFormat = enabled
+}
+
+// SetTempDirPrefix sets the prefix of profiles directory names, "prof-" by default. The profile type and
+// a random suffix follow it, e.g. "payments-prof-cpu123456", so it's clear which service wrote the profiles
+// when several of them share the temp dir. Empty prefix restores the default one
+func SetTempDirPrefix(prefix string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.tempDirPrefix = prefix
+}
+
+// profilesDirPrefix returns the prefix of profiles directory names for the given profile
+func profilesDirPrefix(profile profName) string {
+	prefix := ourConfig.tempDirPrefix
+	if prefix == "" {
+		prefix = defaultTempDirPrefix
+	}
+	return prefix + string(profile)
+}
+
+// SetServerOptions sets the function changing the server started by ListenAndServe and Serve before it listens,
+// e.g. to set IdleTimeout or disable keep-alives with SetKeepAlivesEnabled(false). The listen backlog can't be set
+// there, it comes from the OS (net.core.somaxconn on linux). Nil keeps net/http defaults
+func SetServerOptions(configure func(server *http.Server)) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.configureServer = configure
+}
+
+// SetHTTP2 tells whether the server started by ListenAndServeTLS speaks HTTP/2 with clients supporting it, which is
+// true by default. HTTP/2 reuses the connection for downloading many profiles, but some proxies misbehave with it
+func SetHTTP2(enabled bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.noHTTP2 = !enabled
+}
+
+// SetJSONByDefault makes handlers respond with JSON even if the client doesn't ask for it with 'json=1' param or
+// Accept header, e.g. for deployments where nobody opens the profiling page and scripts can't set headers.
+// 'json=0' param still gets the HTML response. It's disabled by default
+func SetJSONByDefault(enabled bool) {
+	ourJSONByDefault.Store(enabled)
+}
+
+// ourJSONByDefault is set with SetJSONByDefault. It's read without ourProfilingStateGuard, since responses are
+// written with the lock held as well as without it
+var ourJSONByDefault atomic.Bool
+
+// SetDownloadKeepAlive tells whether connections are kept alive after downloads, which is true by default.
+// Archives are large and downloaded rarely, so closing the connection right after one frees it sooner
+func SetDownloadKeepAlive(enabled bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.closeAfterDownload = !enabled
+}
+
+// SetRecordedEnv sets environment variables which are recorded along with every profile and put into
+// metadata.json of downloaded archives together with command line args. No variables are recorded by default,
+// allow only those which don't contain secrets. Mind that command line args are always recorded
+func SetRecordedEnv(names ...string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.recordedEnv = append([]string{}, names...)
+}
+
+// SetCPUProfileCollector sets the writer receiving cpu profile along with the file on disk, e.g. to stream it to
+// a continuous profiling collector while the profile stays available on the profiling page. The runtime writes
+// the profile in chunks, mostly when profiling stops. If the collector fails, the file is still written.
+// Nil, the default, writes the file only
+func SetCPUProfileCollector(collector io.Writer) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.cpuProfileCollector = collector
+}
+
+// SetHostnameInArchiveNames tells whether names of downloaded archives start with the hostname, e.g.
+// payments-7-prof-cpu-123.tgz, so archives collected from many hosts into one directory are told apart.
+// It's disabled by default, since hostnames may be sensitive
+func SetHostnameInArchiveNames(enabled bool) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.hostnameInArchiveNames = enabled
+}
+
+// SetProfileDuration sets how long the profile runs until it's stopped automatically when it's started without
+// explicit duration, e.g. with the start links of the profiling page. Zero resets it to 5 minutes.
+// One-off profiles are written at once, so they have no duration
+func SetProfileDuration(profile string, d time.Duration) error {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	name := profName(profile)
+	if err := checkProfileName(name); err != nil {
+		return err
+	}
+	if name.OneOff() {
+		return fmt.Errorf("%v profile is one-off, it has no duration", profile)
+	}
+	if d <= 0 {
+		delete(ourConfig.profileDurations, name)
+		return nil
+	}
+	if ourConfig.profileDurations == nil {
+		ourConfig.profileDurations = map[profName]time.Duration{}
+	}
+	ourConfig.profileDurations[name] = d
+	return nil
+}
+
+// SetDownloadDirs allows downloading directories within the given base directories, e.g. profiles written by other
+// tools. By default only profiles written by this package can be downloaded, so the download handler can't be used
+// for reading arbitrary files. Calling it without arguments restores the default
+func SetDownloadDirs(dirs ...string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.downloadDirs = nil
+	for _, dir := range dirs {
+		ourConfig.downloadDirs = append(ourConfig.downloadDirs, filepath.Clean(dir))
+	}
+}
+
+// SetIdleTimeout stops profiling started with the handler when nobody requests the profiling page or its status
+// for the given time, e.g. because the operator was pulled away. The opened profiling page polls the status, so
+// profiling isn't stopped while it's watched. It doesn't change the autostop. Zero disables it, which is the default
+func SetIdleTimeout(timeout time.Duration) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.idleTimeout = timeout
+}
+
+// SetAutostopWarning announces autostop the given time before it fires: it's logged, status of the running profile
+// has autostop_warning set and the opened profiling page shows it, so the profiling can be extended in time.
+// Zero disables the warning, which is the default
+func SetAutostopWarning(before time.Duration) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.autostopWarning = before
+}
+
+// SetGoroutineSampleInterval changes how often "cpu-goroutines" profiling writes goroutine profile while cpu is
+// profiled, 10 seconds by default. Non-positive interval resets the default. Profiling which runs already keeps
+// sampling with the interval it was started with
+func SetGoroutineSampleInterval(interval time.Duration) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if interval <= 0 {
+		interval = defaultGoroutineSampleInterval
+	}
+	ourConfig.goroutineSampleInterval = interval
+}
+
+// SetMaxGoroutineDump limits number of goroutines whose stacks are written by goroutine-dump handler, 10000
+// by default. The rest of goroutines are cut with a marker saying how many of them were left out. Zero removes the limit
+func SetMaxGoroutineDump(goroutines int) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if goroutines < 0 {
+		goroutines = 0
+	}
+	ourConfig.maxGoroutineDump = goroutines
+}
+
+// SetDownloadSecret requires download links to be signed with the secret and unexpired, see SignedDownloadURL.
+// Links on the profiling page are signed for an hour. Empty secret turns the check off, which is the default
+func SetDownloadSecret(secret string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.downloadSecret = []byte(secret)
+}
+
+// ConfigResponse shows the effective configuration set with Set* functions, e.g. to find out why profiling behaves
+// differently on some host. Durations are formatted like "5m0s". Secrets aren't shown, only whether they are set
+type ConfigResponse struct {
+	OK                     bool              `json:"ok"`
+	UITitle                string            `json:"ui_title"`
+	CustomTemplate         bool              `json:"custom_template"`
+	ShowWebCommand         string            `json:"show_web_command"`
+	PprofServer            string            `json:"pprof_server"`
+	ArchiveBinary          bool              `json:"archive_binary"`
+	BinaryPath             string            `json:"binary_path"` // empty means the running executable
+	ArchiveRuntimeInfo     bool              `json:"archive_runtime_info"`
+	ArchiveExtras          bool              `json:"archive_extras"`
+	ArchiveTimeout         string            `json:"archive_timeout"`
+	MaxArchiveBytes        int64             `json:"max_archive_bytes"`
+	HostnameInArchiveNames bool              `json:"hostname_in_archive_names"`
+	CleanupPolicy          string            `json:"cleanup_policy"`
+	MaxTotalProfileBytes   int64             `json:"max_total_profile_bytes"`
+	OneOffTTL              string            `json:"one_off_ttl"`
+	OneOffMaxCount         int               `json:"one_off_max_count"`
+	CaptureBudget          int               `json:"capture_budget"` // zero means profiles can be started without limit
+	CaptureBudgetWindow    string            `json:"capture_budget_window"`
+	HeapProfileOnStop      bool              `json:"heap_profile_on_stop"`
+	HeapDumpOnStop         string            `json:"heap_dump_on_stop"`
+	LegacyProfileFormat    bool              `json:"legacy_profile_format"`
+	TempDirPrefix          string            `json:"temp_dir_prefix"`
+	TempDir                string            `json:"temp_dir"` // where profiles directories are created
+	DownloadKeepAlive      bool              `json:"download_keep_alive"`
+	HTTP2                  bool              `json:"http2"`
+	JSONByDefault          bool              `json:"json_by_default"`
+	DownloadDirs           []string          `json:"download_dirs"`
+	CaptureDirs            []string          `json:"capture_dirs"`
+	SignedDownloads        bool              `json:"signed_downloads"`
+	RecordedEnv            []string          `json:"recorded_env"`
+	CPUProfileCollector    bool              `json:"cpu_profile_collector"`
+	ProfileDurations       map[string]string `json:"profile_durations"` // per profile type which can be started
+	IdleTimeout            string            `json:"idle_timeout"`
+	AutostopWarning        string            `json:"autostop_warning"`
+	RuntimeMetrics         []string          `json:"runtime_metrics"`
+	GoroutineSampling      string            `json:"goroutine_sample_interval"`
+	MaxGoroutineDump       int               `json:"max_goroutine_dump"`
+	RingDir                string            `json:"ring_dir"`
+	RingSlots              int               `json:"ring_slots"` // zero means profiles are written into temp dir
+	NotReadyProfiles       []string          `json:"not_ready_profiles"`
+	LogBufferLines         int               `json:"log_buffer_lines"` // zero means log messages aren't kept
+	AuditSink              bool              `json:"audit_sink"`
+	Storage                bool              `json:"storage"`
+	Rates                  ProfileRates      `json:"rates"`
+}
+
+// currentConfig returns the effective configuration. Should be called with ourProfilingStateGuard hold
+func currentConfig() ConfigResponse {
+	resp := ConfigResponse{
+		OK:                     true,
+		UITitle:                ourConfig.uiTitle,
+		CustomTemplate:         ourConfig.pageTemplate != nil,
+		ShowWebCommand:         ourConfig.showWebCommand,
+		PprofServer:            ourConfig.pprofServer,
+		ArchiveBinary:          !ourConfig.archiveWithoutBinary,
+		BinaryPath:             ourConfig.binaryPath,
+		ArchiveRuntimeInfo:     ourConfig.archiveRuntimeInfo,
+		ArchiveExtras:          ourConfig.archiveExtras != nil,
+		ArchiveTimeout:         ourConfig.archiveTimeout.String(),
+		MaxArchiveBytes:        ourConfig.maxArchiveBytes,
+		HostnameInArchiveNames: ourConfig.hostnameInArchiveNames,
+		CleanupPolicy:          ourConfig.cleanupPolicy.String(),
+		MaxTotalProfileBytes:   ourConfig.maxTotalProfileBytes,
+		OneOffTTL:              ourConfig.oneOffRetention.TTL.String(),
+		OneOffMaxCount:         ourConfig.oneOffRetention.MaxCount,
+		CaptureBudget:          ourConfig.captureBudget.Max,
+		CaptureBudgetWindow:    ourConfig.captureBudget.Window.String(),
+		HeapProfileOnStop:      !ourConfig.noHeapOnStop,
+		HeapDumpOnStop:         ourConfig.heapDumpOnStop.String(),
+		LegacyProfileFormat:    ourConfig.legacyProfileFormat,
+		TempDirPrefix:          profilesDirPrefix(""),
+		TempDir:                os.TempDir(),
+		DownloadKeepAlive:      !ourConfig.closeAfterDownload,
+		HTTP2:                  !ourConfig.noHTTP2,
+		JSONByDefault:          ourJSONByDefault.Load(),
+		DownloadDirs:           append([]string{}, ourConfig.downloadDirs...),
+		CaptureDirs:            append([]string{}, ourConfig.captureDirs...),
+		SignedDownloads:        len(ourConfig.downloadSecret) > 0,
+		RecordedEnv:            append([]string{}, ourConfig.recordedEnv...),
+		CPUProfileCollector:    ourConfig.cpuProfileCollector != nil,
+		ProfileDurations:       map[string]string{},
+		IdleTimeout:            ourConfig.idleTimeout.String(),
+		AutostopWarning:        ourConfig.autostopWarning.String(),
+		RuntimeMetrics:         append([]string{}, configuredRuntimeMetrics()...),
+		GoroutineSampling:      ourConfig.goroutineSampleInterval.String(),
+		MaxGoroutineDump:       ourConfig.maxGoroutineDump,
+		RingDir:                ourConfig.profileRing.baseDir,
+		RingSlots:              ourConfig.profileRing.slots,
+		NotReadyProfiles:       []string{},
+		LogBufferLines:         logBufferLines(),
+		AuditSink:              ourAuditSink != nil,
+		Storage:                ourStorage != nil,
+		Rates:                  currentProfileRates(),
+	}
+	for _, profile := range ourConfig.notReadyProfiles {
+		resp.NotReadyProfiles = append(resp.NotReadyProfiles, string(profile))
+	}
+	for _, info := range profileInfos() {
+		if !info.OneOff {
+			resp.ProfileDurations[string(info.Name)] = info.Duration.String()
+		}
+	}
+	if resp.ShowWebCommand == "" {
+		resp.ShowWebCommand = defaultShowWebCommand
+	}
+	sort.Strings(resp.RecordedEnv)
+	return resp
+}
+
+// handler showing the effective configuration as ConfigResponse JSON
+func showConfig(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	resp := currentConfig()
+	ourProfilingStateGuard.RUnlock()
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
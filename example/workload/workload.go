@@ -0,0 +1,77 @@
+// Package workload keeps the process busy with a mix of cpu work, goroutines and channels, so there is something
+// to see in the profiles. The example serves it, goprof tests profile it
+package workload
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// checkers is how many goroutines check the numbers concurrently
+const checkers = 11
+
+// GenerateLoad checks whether n random numbers are prime with a pool of goroutines and reports every number once
+// it's checked, from the calling goroutine. Report may be nil. It returns once all the numbers are reported
+func GenerateLoad(n int, report func(number int, prime bool)) {
+	numbers, primes, composites := make(chan int), make(chan int), make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < checkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				if isPrime(number) {
+					primes <- number
+				} else {
+					composites <- number
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(primes)
+		close(composites)
+	}()
+	go func() {
+		for i := 0; i < n; i++ {
+			numbers <- rand.Intn(10000000)
+		}
+		close(numbers)
+	}()
+
+	// both channels are closed at once, when all the checkers are done
+	for primes != nil || composites != nil {
+		select {
+		case prime, ok := <-primes:
+			if !ok {
+				primes = nil
+				continue
+			}
+			if report != nil {
+				report(prime, true)
+			}
+		case composite, ok := <-composites:
+			if !ok {
+				composites = nil
+				continue
+			}
+			if report != nil {
+				report(composite, false)
+			}
+		}
+	}
+}
+
+func isPrime(number int) bool {
+	if number < 2 {
+		return false
+	}
+	for divisor := 2; divisor <= int(math.Sqrt(float64(number))); divisor++ {
+		if number%divisor == 0 {
+			return false
+		}
+	}
+	return true
+}
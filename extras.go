@@ -0,0 +1,53 @@
+package goprof
+
+import (
+	"archive/tar"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// ArchiveExtrasFxn returns additional files put into the archive of the profiles directory, by name,
+// e.g. a config dump, recent logs or the git revision of the build. The files may differ on every call, so archives
+// with them are always packed anew and don't have ETag. It's called with the profiling state read-locked,
+// so it must not call goprof functions changing it, e.g. Set* ones, which would deadlock
+type ArchiveExtrasFxn func(profilesDir string) (map[string][]byte, error)
+
+// extraFilesDir is the directory of downloaded and stored archives which keeps files returned by ArchiveExtrasFxn,
+// so they never clash with profiles
+const extraFilesDir = "extra"
+
+// SetArchiveExtras sets the function called for every packed archive after the profiles are written into it.
+// The files it returns are put into "extra" directory of the archive, names which aren't plain file names are
+// skipped. An error returned by it is logged and the archive is packed without the extra files. Nil disables it,
+// which is the default
+func SetArchiveExtras(fxn ArchiveExtrasFxn) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.archiveExtras = fxn
+}
+
+// writeExtraFiles writes the files returned by extras into extraFilesDir of the archive, sorted by name.
+// Only failures to write the archive itself are returned
+func writeExtraFiles(archive *tar.Writer, profilesDir string, extras ArchiveExtrasFxn) error {
+	files, err := extras(profilesDir)
+	if err != nil {
+		logf("Failed to get extra files for the archive of '%s': %v", profilesDir, err)
+		return nil
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+			logf("Skipped extra file '%s' for the archive of '%s', it should be a plain file name", name, profilesDir)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeBytes(archive, path.Join(extraFilesDir, name), files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package goprof
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveExtras(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	var calledWith string
+	opts := archiveOptions{extras: func(dir string) (map[string][]byte, error) {
+		calledWith = dir
+		return map[string][]byte{"revision": []byte("abc123"), "config.json": []byte("{}"), "../escape": nil}, nil
+	}}
+	archive, err := packProfiles(context.Background(), profilesDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	names := strings.Join(archiveFiles(t, archive), " ")
+	releaseArchiveBuffer(archive)
+	if calledWith != profilesDir {
+		t.Fatalf("Expected extras to be asked for %v, got %v", profilesDir, calledWith)
+	}
+	if !strings.HasSuffix(names, " extra/config.json extra/revision") || strings.Contains(names, "escape") {
+		t.Fatalf("Expected extra files at the end of the archive, got %v", names)
+	}
+
+	opts.extras = func(string) (map[string][]byte, error) { return nil, errors.New("no logs") }
+	archive, err = packProfiles(context.Background(), profilesDir, opts)
+	if err != nil {
+		t.Fatalf("Expected failing extras not to abort the archive, got %v", err)
+	}
+	names = strings.Join(archiveFiles(t, archive), " ")
+	releaseArchiveBuffer(archive)
+	if !strings.Contains(names, "heap.pprof") || strings.Contains(names, "extra/") {
+		t.Fatalf("Expected the archive without extra files, got %v", names)
+	}
+}
+
+func TestArchiveExtrasAreNotCached(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer SetArchiveExtras(nil)
+	SetArchiveExtras(func(string) (map[string][]byte, error) {
+		return map[string][]byte{"log.txt": []byte(time.Now().String())}, nil
+	})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/download/x.tgz?binary=0&path="+url.QueryEscape(profilesDir), nil)
+	r.Header.Set("If-None-Match", "*")
+	NewHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != "" {
+		t.Fatalf("Expected the archive with extra files to be packed anew without ETag, got %v %v", w.Code, w.Header().Get("ETag"))
+	}
+}
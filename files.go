@@ -0,0 +1,119 @@
+package goprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file in profiles directory
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Profile string    `json:"profile,omitempty"` // logical name of the profile, e.g. "cpu", empty if the file isn't a profile
+	Pprof   bool      `json:"pprof"`             // the file can be opened with pprof tools
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// ProfileFiles lists files of the written profile, e.g. to feed them into your own analysis without downloading
+// the archive. The same directories as the download handler serves can be listed, profile which is being written
+// can't. Files which aren't profiles, like index.json, are listed too
+func ProfileFiles(dir string) ([]FileInfo, error) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	dir = filepath.Clean(dir)
+	if _, err := readableDir(dir); err != nil {
+		return nil, err
+	}
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []FileInfo{}
+	for _, child := range children {
+		if !child.Mode().IsRegular() {
+			continue
+		}
+		profile, isPprof, _ := profileFileName(child.Name())
+		files = append(files, FileInfo{
+			Name:    child.Name(),
+			Profile: profile,
+			Pprof:   isPprof,
+			Size:    child.Size(),
+			ModTime: child.ModTime(),
+		})
+	}
+	return files, nil
+}
+
+// OpenProfileFile opens the file listed by ProfileFiles. Files stored gzipped, e.g. "heap.pprof.gz", are read
+// decompressed. Close it when it's read
+func OpenProfileFile(dir, name string) (io.ReadCloser, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("bad file name '%v', it should be a name of the file in the directory", name)
+	}
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	dir = filepath.Clean(dir)
+	if _, err := readableDir(dir); err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(dir, name)
+	if info, err := os.Stat(filePath); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("'%v' isn't a regular file in '%v'", name, dir)
+	}
+	return openDecompressed(filePath)
+}
+
+// gzipFileExt ends names of the files in profiles directory which are stored gzipped, e.g. "heap.pprof.gz"
+const gzipFileExt = ".gz"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// openDecompressed opens the file of profiles directory, decompressing it if it's stored gzipped: its name ends
+// with ".gz" or it starts with gzip magic bytes. Pprof format is gzipped protobuf itself, so pprof files are
+// decompressed only if they are named so, the parser accepts them uncompressed anyway
+func openDecompressed(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	gzipped := strings.HasSuffix(filePath, gzipFileExt)
+	if _, isPprof, _ := profileFileName(filepath.Base(filePath)); !gzipped && !isPprof {
+		magic := make([]byte, len(gzipMagic))
+		n, _ := io.ReadFull(file, magic)
+		gzipped = bytes.Equal(magic[:n], gzipMagic)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if !gzipped {
+		return file, nil
+	}
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decompress '%v': %v", filePath, err)
+	}
+	return decompressedFile{Reader: decompressed, file: file}, nil
+}
+
+// decompressedFile closes the file along with the gzip reader
+type decompressedFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f decompressedFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
@@ -0,0 +1,137 @@
+package goprof
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfileFiles(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	if err := ioutil.WriteFile(filepath.Join(profilesDir, "notes.txt"), []byte("notes"), 0600); err != nil {
+		t.Fatalf("Failed to write notes: %v", err)
+	}
+	files, err := ProfileFiles(profilesDir)
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	found := map[string]FileInfo{}
+	for _, file := range files {
+		found[file.Name] = file
+	}
+	heap, ok := found["heap.pprof"]
+	if !ok || heap.Profile != "heap" || !heap.Pprof || heap.Size == 0 {
+		t.Errorf("Expecting heap profile to be listed, got %+v", files)
+	}
+	if notes, ok := found["notes.txt"]; !ok || notes.Profile != "" || notes.Pprof || notes.Size != 5 {
+		t.Errorf("Expecting notes to be listed as not a profile, got %+v", files)
+	}
+
+	file, err := OpenProfileFile(profilesDir, "heap.pprof")
+	if err != nil {
+		t.Fatalf("Failed to open heap profile: %v", err)
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || int64(len(content)) != heap.Size {
+		t.Errorf("Expecting to read %v bytes, got %v, %v", heap.Size, len(content), err)
+	}
+}
+
+func TestProfileFilesPathSafety(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	for _, name := range []string{"../heap.pprof", "..", ".", "sub/heap.pprof", "missing.pprof"} {
+		if file, err := OpenProfileFile(profilesDir, name); err == nil {
+			file.Close()
+			t.Errorf("Expecting '%v' not to be opened", name)
+		}
+	}
+	if _, err := OpenProfileFile(filepath.Dir(profilesDir), filepath.Base(profilesDir)); err == nil {
+		t.Errorf("Expecting not written directory not to be opened")
+	}
+	if _, err := ProfileFiles("/etc"); err == nil {
+		t.Errorf("Expecting not written directory not to be listed")
+	} else if _, ok := err.(forbiddenDirError); !ok {
+		t.Errorf("Expecting forbidden error, got %T: %v", err, err)
+	}
+
+	ourProfilingStateGuard.Lock()
+	ourCurrentProfile = &prof{Prof: profileHeap, Dir: profilesDir}
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		ourCurrentProfile = nil
+		ourProfilingStateGuard.Unlock()
+	}()
+	if _, err := ProfileFiles(profilesDir); err == nil {
+		t.Errorf("Expecting the profile which is being written not to be listed")
+	} else if errorStatus(err) != 409 {
+		t.Errorf("Expecting conflict, got %v", err)
+	}
+}
+
+func TestGzippedProfileFiles(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	raw, err := ioutil.ReadFile(filepath.Join(profilesDir, "heap.pprof"))
+	if err != nil {
+		t.Fatalf("Failed to read heap profile: %v", err)
+	}
+	gzipFile := func(name string, data []byte) {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(data)
+		gz.Close()
+		if err := ioutil.WriteFile(filepath.Join(profilesDir, name), compressed.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write %v: %v", name, err)
+		}
+	}
+	gzipFile("goroutine.pprof.gz", raw)
+	// traces are recognized by the magic bytes, even if they aren't named as gzipped
+	gzipFile(traceFileName, []byte("go 1.11 trace"))
+
+	for _, name := range []string{"heap.pprof", "goroutine.pprof.gz"} {
+		if _, err := parseProfileFile(filepath.Join(profilesDir, name)); err != nil {
+			t.Errorf("Expected %v to be parsed: %v", name, err)
+		}
+	}
+	for name, expected := range map[string][]byte{"heap.pprof": raw, "goroutine.pprof.gz": raw, traceFileName: []byte("go 1.11 trace")} {
+		file, err := OpenProfileFile(profilesDir, name)
+		if err != nil {
+			t.Fatalf("Failed to open %v: %v", name, err)
+		}
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || !bytes.Equal(content, expected) {
+			t.Errorf("Expected %v to be read as it was written, got %v bytes instead of %v: %v", name, len(content), len(expected), err)
+		}
+	}
+
+	// the archive keeps the files as they are stored
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: true})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Expected gzipped goroutine profile in the archive: %v", err)
+		}
+		if header.Name != "goroutine.pprof.gz" {
+			continue
+		}
+		if stored, _ := ioutil.ReadAll(reader); !bytes.HasPrefix(stored, gzipMagic) {
+			t.Fatalf("Expected the profile to be packed gzipped")
+		}
+		break
+	}
+}
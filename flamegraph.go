@@ -0,0 +1,143 @@
+package goprof
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	flameGraphWidth     = 1200
+	flameGraphRowHeight = 16
+	// frames narrower than this aren't drawn, otherwise huge profiles produce huge pictures nobody can read
+	flameGraphMinFrameWidth = 0.5
+)
+
+// flameNode is a frame of the flame graph, its value includes values of all the children
+type flameNode struct {
+	name     string
+	value    int64
+	children map[string]*flameNode
+}
+
+func newFlameNode(name string) *flameNode {
+	return &flameNode{name: name, children: make(map[string]*flameNode)}
+}
+
+func (n *flameNode) add(stack []string, value int64) {
+	n.value += value
+	if len(stack) == 0 {
+		return
+	}
+	child, ok := n.children[stack[0]]
+	if !ok {
+		child = newFlameNode(stack[0])
+		n.children[stack[0]] = child
+	}
+	child.add(stack[1:], value)
+}
+
+func (n *flameNode) depth() int {
+	maxDepth := 0
+	for _, child := range n.children {
+		if d := child.depth(); d > maxDepth {
+			maxDepth = d
+		}
+	}
+	return maxDepth + 1
+}
+
+// sortedChildren returns children ordered by name, so the same profile always looks the same
+func (n *flameNode) sortedChildren() []*flameNode {
+	children := make([]*flameNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// handler rendering flame graph of the written profile as SVG. It parses the profile in-process,
+// so it works without go toolchain. See requestedProfileDir and requestedProfile for the params, 'sample' param chooses sample type
+func showFlameGraph(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+
+	profilesDir, ok := requestedProfileDir(w, r)
+	if !ok {
+		return
+	}
+	p, err := requestedProfile(r, profilesDir)
+	if err != nil {
+		requestedProfileError(w, r, err)
+		return
+	}
+	index, err := sampleIndex(p, r.URL.Query().Get("sample"))
+	if err != nil {
+		fatalError(w, r, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if err := writeFlameGraph(w, buildFlameGraph(p.Sample, index), p.SampleType[index].Unit); err != nil {
+		logf("Failed to write flame graph: %v", err)
+	}
+}
+
+func buildFlameGraph(samples []*profile.Sample, index int) *flameNode {
+	root := newFlameNode("root")
+	for _, sample := range samples {
+		root.add(sampleStack(sample), sample.Value[index])
+	}
+	return root
+}
+
+// writeFlameGraph draws the tree as SVG with the root at the bottom
+func writeFlameGraph(out io.Writer, root *flameNode, unit string) error {
+	w := bufio.NewWriter(out)
+	height := root.depth() * flameGraphRowHeight
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="11">`+"\n",
+		flameGraphWidth, height)
+	if root.value > 0 {
+		scale := float64(flameGraphWidth) / float64(root.value)
+		writeFlameNode(w, root, 0, height-flameGraphRowHeight, scale, root.value, unit)
+	}
+	fmt.Fprintln(w, `</svg>`)
+	return w.Flush()
+}
+
+func writeFlameNode(w io.Writer, node *flameNode, x float64, y int, scale float64, total int64, unit string) {
+	width := float64(node.value) * scale
+	if width < flameGraphMinFrameWidth {
+		return
+	}
+	name := html.EscapeString(node.name)
+	fmt.Fprintf(w, `<g><title>%s (%d %s, %.2f%%)</title><rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s" stroke="white"/>`,
+		name, node.value, html.EscapeString(unit), 100*float64(node.value)/float64(total), x, y, width, flameGraphRowHeight-1, frameColor(node.name))
+	// roughly 7px per character, show the name only if it fits
+	if chars := int(width / 7); chars > 2 {
+		label := node.name
+		if len(label) > chars {
+			label = label[:chars-2] + ".."
+		}
+		fmt.Fprintf(w, `<text x="%.1f" y="%d">%s</text>`, x+2, y+flameGraphRowHeight-4, html.EscapeString(label))
+	}
+	fmt.Fprintln(w, `</g>`)
+	for _, child := range node.sortedChildren() {
+		writeFlameNode(w, child, x, y-flameGraphRowHeight, scale, total, unit)
+		x += float64(child.value) * scale
+	}
+}
+
+// frameColor returns warm color which is the same for the same function
+func frameColor(name string) string {
+	h := fnv.New32a()
+	io.WriteString(h, name)
+	sum := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+sum%50, 80+(sum>>8)%130, (sum>>16)%60)
+}
@@ -0,0 +1,87 @@
+package goprof
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"time"
+)
+
+// flight recorder keeps the last seconds of execution trace in memory. Unlike trace profile, which shows only
+// what happens after you start it, flight recorder can show what happened right before something went wrong
+var (
+	// running flight recorder, nil if it's not started. Should be changed with ourProfilingStateGuard hold
+	ourFlightRecorder *trace.FlightRecorder
+	// how much of the trace flight recorder keeps, zero means runtime's default
+	ourFlightRecorderWindow time.Duration
+)
+
+// StartFlightRecorder starts keeping the last window of execution trace in memory, maxBytes limits its size.
+// Zero values mean runtime defaults, which are a few seconds. Use flight-trace handler to write the trace when
+// something interesting happens. Flight recorder works along with trace profile, but only one can be started
+func StartFlightRecorder(window time.Duration, maxBytes uint64) error {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if ourFlightRecorder != nil {
+		return fmt.Errorf("flight recorder is already started")
+	}
+	recorder := trace.NewFlightRecorder(trace.FlightRecorderConfig{MinAge: window, MaxBytes: maxBytes})
+	if err := recorder.Start(); err != nil {
+		return fmt.Errorf("failed to start flight recorder: %v", err)
+	}
+	ourFlightRecorder = recorder
+	ourFlightRecorderWindow = window
+	logf("Started flight recorder keeping %v of trace", window)
+	return nil
+}
+
+// StopFlightRecorder stops flight recorder and drops the trace it keeps, does nothing if it's not started
+func StopFlightRecorder() {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if ourFlightRecorder == nil {
+		return
+	}
+	ourFlightRecorder.Stop()
+	ourFlightRecorder = nil
+	logf("Stopped flight recorder")
+}
+
+// writeFlightTrace writes the trace kept by flight recorder as a new written profile
+// Should be called with ourProfilingStateGuard hold
+func writeFlightTrace() (profilesDirectory string, err error) {
+	if ourFlightRecorder == nil {
+		return "", stateError("flight recorder isn't started, call StartFlightRecorder first")
+	}
+	profilesDir, err := createProfilesDir(profileFlightTrace)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			if removeErr := os.RemoveAll(profilesDir); removeErr != nil {
+				logf("Failed to remove %v: %v", profilesDir, removeErr)
+			}
+		}
+	}()
+	traceFile, err := os.Create(filepath.Join(profilesDir, traceFileName))
+	if err != nil {
+		return "", err
+	}
+	defer traceFile.Close()
+	if _, err := ourFlightRecorder.WriteTo(traceFile); err != nil {
+		return "", fmt.Errorf("failed to write flight recorder trace: %v", err)
+	}
+	// the window is only a lower bound of what is written, but it's the best we know
+	now := time.Now()
+	addWrittenProfile(prof{
+		Prof:     profileFlightTrace,
+		Dir:      profilesDir,
+		Start:    now.Add(-ourFlightRecorderWindow),
+		Duration: ourFlightRecorderWindow,
+		Process:  currentProcessInfo(),
+	})
+	logf("Wrote flight recorder trace to '%s'", profilesDir)
+	return profilesDir, nil
+}
@@ -0,0 +1,35 @@
+package goprof
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFlightTrace(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	_, err := writeFlightTrace()
+	ourProfilingStateGuard.Unlock()
+	if err == nil {
+		t.Fatalf("Expected writing flight trace to fail when flight recorder isn't started")
+	}
+	if err := StartFlightRecorder(time.Second, 0); err != nil {
+		t.Fatalf("Failed to start flight recorder: %v", err)
+	}
+	defer StopFlightRecorder()
+	time.Sleep(10 * time.Millisecond)
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := writeFlightTrace()
+	if err != nil {
+		t.Fatalf("Failed to write flight trace: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if info, err := os.Stat(filepath.Join(dir, traceFileName)); err != nil || info.Size() == 0 {
+		t.Fatalf("Expected non-empty trace in '%s', got %v", dir, err)
+	}
+	if written := findWrittenProfile(dir); written == nil || written.Prof != profileFlightTrace {
+		t.Fatalf("Expected flight trace to be listed in written profiles, got %#v", ourWrittenProfiles)
+	}
+}
@@ -0,0 +1,121 @@
+// Package goproftest provides utilities for testing how the profiling tools are mounted into your application
+// over HTTP, like net/http/httptest does for handlers.
+//
+// The profiling state is global, so tests using the server shouldn't run in parallel with each other
+// or with other code starting profiling.
+package goproftest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lazada/goprof"
+)
+
+// Server is a test HTTP server serving your handler, which has the profiling tools mounted under Prefix
+type Server struct {
+	*httptest.Server
+	Prefix string // where the profiling tools are mounted, e.g. "/pprof", empty for goprof.NewHandler() itself
+}
+
+// NewServer starts the server serving the handler, which has the profiling tools mounted under the prefix with
+// goprof.RegisterHandlers or http.StripPrefix. Use NewServer(goprof.NewHandler(), "") for the tools alone.
+// Close the server when the test is done
+func NewServer(handler http.Handler, prefix string) *Server {
+	return &Server{Server: httptest.NewServer(handler), Prefix: prefix}
+}
+
+// Close stops profiling left running by the test, so the following tests start clean, and shuts the server down
+func (s *Server) Close() {
+	if status, err := s.Status(); err == nil && status.Current != nil {
+		s.Stop()
+	}
+	s.Server.Close()
+}
+
+// Start starts the profile with the toggle handler
+func (s *Server) Start(profile string) error {
+	return s.get("/toggle?enable=1&profile="+url.QueryEscape(profile), &goprof.SimpleResponse{})
+}
+
+// Stop stops profiling with the toggle handler
+func (s *Server) Stop() error {
+	return s.get("/toggle?enable=0", &goprof.SimpleResponse{})
+}
+
+// Status returns the profiling state and the written profiles as the profiling page shows them, the latest first
+func (s *Server) Status() (goprof.ProfileListResponse, error) {
+	var resp goprof.ProfileListResponse
+	err := s.get("/", &resp)
+	return resp, err
+}
+
+// Download downloads the archive with the written profiles from the directory. The binary isn't put into
+// the archive to keep tests fast
+func (s *Server) Download(dir string) ([]byte, error) {
+	resp, err := http.Get(s.URL + s.Prefix + "/download/profile.tgz?binary=0&path=" + url.QueryEscape(dir))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	archive, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %v: %v %s", dir, resp.Status, archive)
+	}
+	return archive, nil
+}
+
+// RequireProfiling fails the test unless the profile is being written at the moment and returns its status
+func (s *Server) RequireProfiling(t testing.TB, profile string) *goprof.CurrentProfileStatus {
+	t.Helper()
+	status, err := s.Status()
+	if err != nil {
+		t.Fatalf("Failed to get profiling status: %v", err)
+	}
+	if status.Current == nil || string(status.Current.Prof) != profile {
+		t.Fatalf("Expected %v profile to be written, got %#v", profile, status.Current)
+	}
+	return status.Current
+}
+
+// RequireStopped fails the test if profiling is running
+func (s *Server) RequireStopped(t testing.TB) {
+	t.Helper()
+	status, err := s.Status()
+	if err != nil {
+		t.Fatalf("Failed to get profiling status: %v", err)
+	}
+	if status.Current != nil {
+		t.Fatalf("Expected profiling to be stopped, but %v profile is written", status.Current.Prof)
+	}
+}
+
+// get requests JSON response of the profiling tools and decodes it into resp, error responses are returned as errors
+func (s *Server) get(path string, resp interface{}) error {
+	req, err := http.NewRequest("GET", s.URL+s.Prefix+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	httpResp, err := s.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode >= http.StatusBadRequest {
+		var errResp goprof.SimpleResponse
+		if err := json.NewDecoder(httpResp.Body).Decode(&errResp); err != nil {
+			return fmt.Errorf("request to %v failed: %v", path, httpResp.Status)
+		}
+		return fmt.Errorf("request to %v failed: %v %v", path, httpResp.Status, errResp.ErrorMessage)
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
@@ -0,0 +1,60 @@
+package goproftest_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lazada/goprof"
+	"github.com/lazada/goprof/goproftest"
+)
+
+func Example() {
+	mux := http.NewServeMux()
+	goprof.RegisterHandlers(mux, "/pprof")
+	server := goproftest.NewServer(mux, "/pprof")
+	defer server.Close()
+
+	if err := server.Start("cpu"); err != nil {
+		panic(err)
+	}
+	if err := server.Stop(); err != nil {
+		panic(err)
+	}
+	status, err := server.Status()
+	if err != nil {
+		panic(err)
+	}
+	written := status.Items[0]
+	fmt.Println("written:", written.Prof)
+	archive, err := server.Download(written.Dir)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("gzipped:", len(archive) > 2 && archive[0] == 0x1f && archive[1] == 0x8b)
+	// Output:
+	// written: cpu
+	// gzipped: true
+}
+
+func TestRequireProfiling(t *testing.T) {
+	server := goproftest.NewServer(goprof.NewHandler(), "")
+	defer server.Close()
+	server.RequireStopped(t)
+	if err := server.Start("nosuchprofile"); err == nil {
+		t.Fatalf("Expected unknown profile to fail")
+	}
+	if err := server.Start("cpu"); err != nil {
+		t.Fatalf("Failed to start profiling: %v", err)
+	}
+	if current := server.RequireProfiling(t, "cpu"); current.Dir == "" {
+		t.Fatalf("Expected profiles directory in the status")
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatalf("Failed to stop profiling: %v", err)
+	}
+	server.RequireStopped(t)
+	if _, err := server.Download("/nonexistent"); err == nil {
+		t.Fatalf("Expected download of nonexistent profile to fail")
+	}
+}
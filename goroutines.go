@@ -0,0 +1,372 @@
+package goprof
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTopGoroutineGroups   = 20
+	defaultGoroutineDeltaWindow = 10 * time.Second
+)
+
+// GoroutinesResponse lists groups of goroutines with the same stack, the largest groups first
+type GoroutinesResponse struct {
+	OK     bool             `json:"ok"`
+	Total  int              `json:"total"` // number of all goroutines
+	Groups []GoroutineGroup `json:"groups"`
+}
+
+// GoroutineGroup is a number of goroutines with the same stack. Stack frames are "function file:line", leaf first
+type GoroutineGroup struct {
+	Count int      `json:"count"`
+	Stack []string `json:"stack"`
+}
+
+// handler returning the largest groups of goroutines with the same stack, e.g. to spot thousands of goroutines
+// blocked on the same mutex. 'top' limits number of groups (20 by default). Responds with text unless JSON is requested
+func showGoroutineGroups(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTopGoroutineGroups
+	if top := r.URL.Query().Get("top"); top != "" {
+		var err error
+		if limit, err = strconv.Atoi(top); err != nil || limit <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'top' param: '%v'. Please, use positive number.", top))
+			return
+		}
+	}
+	resp, err := captureGoroutineGroups()
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to group goroutines: %v", err))
+		return
+	}
+	if len(resp.Groups) > limit {
+		resp.Groups = resp.Groups[:limit]
+	}
+	if isJsonRequest(r) {
+		setJSONHeaders(w)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d goroutines in total\n", resp.Total)
+	for _, group := range resp.Groups {
+		fmt.Fprintf(w, "\n%d goroutines:\n", group.Count)
+		for _, frame := range group.Stack {
+			fmt.Fprintf(w, "\t%s\n", frame)
+		}
+	}
+}
+
+// captureGoroutineGroups groups the goroutines running at the moment
+func captureGoroutineGroups() (GoroutinesResponse, error) {
+	var dump bytes.Buffer
+	if err := pprof.Lookup(string(profileGoroutine)).WriteTo(&dump, 1); err != nil {
+		return GoroutinesResponse{}, fmt.Errorf("failed to write goroutine profile: %v", err)
+	}
+	resp, err := groupGoroutines(&dump)
+	if err != nil {
+		return resp, fmt.Errorf("failed to parse goroutine profile: %v", err)
+	}
+	return resp, nil
+}
+
+// groupGoroutines parses goroutine profile written with debug=1, see scanGoroutineGroups
+func groupGoroutines(dump io.Reader) (GoroutinesResponse, error) {
+	resp := GoroutinesResponse{OK: true, Groups: []GoroutineGroup{}}
+	total, err := scanGoroutineGroups(dump, func(group GoroutineGroup) error {
+		resp.Groups = append(resp.Groups, group)
+		return nil
+	})
+	resp.Total = total
+	if err != nil {
+		return resp, err
+	}
+	sort.SliceStable(resp.Groups, func(i, j int) bool { return resp.Groups[i].Count > resp.Groups[j].Count })
+	return resp, nil
+}
+
+// scanGoroutineGroups parses goroutine profile written with debug=1, where the runtime already groups goroutines
+// by stack and puts the largest groups first. Each group starts with "<count> @ <addresses>" line followed by
+// "#\t<address>\t<function>+<offset>\t<file:line>" frames and ends with an empty line. Every group is passed
+// to found as soon as it's parsed, so the dump isn't kept in memory. Returns number of all goroutines
+func scanGoroutineGroups(dump io.Reader, found func(group GoroutineGroup) error) (total int, err error) {
+	var group *GoroutineGroup
+	flush := func() error {
+		if group == nil {
+			return nil
+		}
+		err := found(*group)
+		group = nil
+		return err
+	}
+	scanner := bufio.NewScanner(dump)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "goroutine profile: total "):
+			if total, err = strconv.Atoi(strings.TrimPrefix(line, "goroutine profile: total ")); err != nil {
+				return total, fmt.Errorf("bad header '%v'", line)
+			}
+		case strings.Contains(line, " @ "):
+			if err := flush(); err != nil {
+				return total, err
+			}
+			count, err := strconv.Atoi(line[:strings.Index(line, " @ ")])
+			if err != nil {
+				return total, fmt.Errorf("bad stack header '%v'", line)
+			}
+			group = &GoroutineGroup{Count: count}
+		case strings.HasPrefix(line, "#\t") && group != nil:
+			// columns are aligned with extra tabs
+			fields := []string{}
+			for _, field := range strings.Split(line, "\t") {
+				if field != "" {
+					fields = append(fields, field)
+				}
+			}
+			if len(fields) < 4 {
+				continue
+			}
+			function := fields[2]
+			if offset := strings.LastIndex(function, "+0x"); offset >= 0 {
+				function = function[:offset]
+			}
+			group.Stack = append(group.Stack, function+" "+fields[3])
+		case line == "":
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, err
+	}
+	return total, flush()
+}
+
+// handler streaming groups of goroutines with the same stack as newline-delimited JSON, one GoroutineGroup
+// per line, the largest groups first. Unlike showGoroutineGroups it never holds the whole dump or response
+// in memory, so it's safe with hundreds of thousands of goroutines. 'top' limits number of groups, no limit by default
+func streamGoroutineGroups(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if top := r.URL.Query().Get("top"); top != "" {
+		var err error
+		if limit, err = strconv.Atoi(top); err != nil || limit <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'top' param: '%v'. Please, use positive number.", top))
+			return
+		}
+	}
+	dump, dumpWriter := io.Pipe()
+	go func() {
+		dumpWriter.CloseWithError(pprof.Lookup(string(profileGoroutine)).WriteTo(dumpWriter, 1))
+	}()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	setNoStore(w)
+	encoder := json.NewEncoder(w)
+	written := 0
+	_, err := scanGoroutineGroups(dump, func(group GoroutineGroup) error {
+		if limit > 0 && written == limit {
+			return errEnoughGroups
+		}
+		written++
+		return encoder.Encode(group)
+	})
+	// unblocks writing the dump if we stopped reading it earlier
+	dump.CloseWithError(errEnoughGroups)
+	if err != nil && err != errEnoughGroups {
+		// the status is sent already, so the client can only notice the cut stream
+		logf("Failed to stream goroutine groups: %v", err)
+	}
+}
+
+// errEnoughGroups stops scanning goroutine groups once 'top' of them are streamed
+var errEnoughGroups = errors.New("enough goroutine groups")
+
+// GoroutineDeltaResponse lists stacks whose number of goroutines grew the most over the window, e.g. to catch
+// a goroutine leak without comparing two full dumps by eye
+type GoroutineDeltaResponse struct {
+	OK     bool                  `json:"ok"`
+	Before int                   `json:"before"` // number of all goroutines at the start of the window
+	After  int                   `json:"after"`  // number of all goroutines at the end of the window
+	Groups []GoroutineGroupDelta `json:"groups"`
+}
+
+// GoroutineGroupDelta tells how number of goroutines with the same stack changed over the window
+type GoroutineGroupDelta struct {
+	Before int      `json:"before"`
+	After  int      `json:"after"`
+	Delta  int      `json:"delta"`
+	Stack  []string `json:"stack"`
+}
+
+// handler grouping goroutines twice, 'seconds' apart (10 by default), and returning the stacks whose number
+// of goroutines grew the most. 'top' limits number of stacks (20 by default). Responds with text unless JSON
+// is requested
+func showGoroutineDelta(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultTopGoroutineGroups
+	if top := query.Get("top"); top != "" {
+		var err error
+		if limit, err = strconv.Atoi(top); err != nil || limit <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'top' param: '%v'. Please, use positive number.", top))
+			return
+		}
+	}
+	window := defaultGoroutineDeltaWindow
+	if secondsParam := query.Get("seconds"); secondsParam != "" {
+		seconds, err := strconv.Atoi(secondsParam)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > defautMaxProfilingDuration {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'seconds' param: '%v'. Please, use positive number up to %v.",
+				secondsParam, int(defautMaxProfilingDuration.Seconds())))
+			return
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+	before, err := captureGoroutineGroups()
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to group goroutines: %v", err))
+		return
+	}
+	select {
+	case <-time.After(window):
+	case <-r.Context().Done():
+		// nobody waits for the response anymore
+		return
+	}
+	after, err := captureGoroutineGroups()
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to group goroutines: %v", err))
+		return
+	}
+	resp := GoroutineDeltaResponse{
+		OK:     true,
+		Before: before.Total,
+		After:  after.Total,
+		Groups: diffGoroutineGroups(before.Groups, after.Groups),
+	}
+	if len(resp.Groups) > limit {
+		resp.Groups = resp.Groups[:limit]
+	}
+	if isJsonRequest(r) {
+		setJSONHeaders(w)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d goroutines in total, %+d over %v\n", resp.After, resp.After-resp.Before, window)
+	for _, group := range resp.Groups {
+		fmt.Fprintf(w, "\n%+d goroutines, %d -> %d:\n", group.Delta, group.Before, group.After)
+		for _, frame := range group.Stack {
+			fmt.Fprintf(w, "\t%s\n", frame)
+		}
+	}
+}
+
+// diffGoroutineGroups matches groups by their stacks and returns the stacks with more goroutines after than
+// before, the largest growth first
+func diffGoroutineGroups(before, after []GoroutineGroup) []GoroutineGroupDelta {
+	// different addresses may resolve to the same lines, so groups with the same stack are summed up
+	deltas := map[string]*GoroutineGroupDelta{}
+	delta := func(stack []string) *GoroutineGroupDelta {
+		key := strings.Join(stack, "\n")
+		if deltas[key] == nil {
+			deltas[key] = &GoroutineGroupDelta{Stack: stack}
+		}
+		return deltas[key]
+	}
+	for _, group := range before {
+		delta(group.Stack).Before += group.Count
+	}
+	for _, group := range after {
+		delta(group.Stack).After += group.Count
+	}
+	grown := []GoroutineGroupDelta{}
+	for _, d := range deltas {
+		if d.Delta = d.After - d.Before; d.Delta > 0 {
+			grown = append(grown, *d)
+		}
+	}
+	sort.Slice(grown, func(i, j int) bool {
+		if grown[i].Delta != grown[j].Delta {
+			return grown[i].Delta > grown[j].Delta
+		}
+		return strings.Join(grown[i].Stack, "\n") < strings.Join(grown[j].Stack, "\n")
+	})
+	return grown
+}
+
+// handler writing the full stacks of all goroutines, i.e. goroutine profile with debug=2, the same format as
+// a panic prints. At most SetMaxGoroutineDump goroutines are written, the rest are cut with a marker saying how
+// many of them were left out, so a process with millions of goroutines doesn't send gigabytes. The dump is streamed,
+// it's never kept whole by the handler
+func showGoroutineDump(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	limit := ourConfig.maxGoroutineDump
+	ourProfilingStateGuard.RUnlock()
+	dump, dumpWriter := io.Pipe()
+	go func() {
+		dumpWriter.CloseWithError(pprof.Lookup(string(profileGoroutine)).WriteTo(dumpWriter, 2))
+	}()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	setNoStore(w)
+	_, err := writeGoroutineDump(w, dump, limit)
+	// unblocks writing the dump if we stopped reading it earlier
+	dump.Close()
+	if err != nil {
+		// the status is sent already, so the client can only notice the cut dump
+		logf("Failed to write goroutine dump: %v", err)
+	}
+}
+
+// writeGoroutineDump copies the goroutines of a debug=2 dump, where every goroutine starts with "goroutine <id> ["
+// line and is followed by an empty line. Only the first limit goroutines are written followed by the truncation
+// marker, non-positive limit means all of them. The rest of the dump is only read to count the goroutines left out,
+// which are returned
+func writeGoroutineDump(w io.Writer, dump io.Reader, limit int) (int, error) {
+	if limit <= 0 {
+		_, err := io.Copy(w, dump)
+		return 0, err
+	}
+	reader := bufio.NewReader(dump)
+	written, truncated := 0, 0
+	lineStart := true
+	for {
+		// long lines come in several pieces, only the first one may start a goroutine
+		line, err := reader.ReadSlice('\n')
+		if lineStart && bytes.HasPrefix(line, []byte("goroutine ")) {
+			if written == limit {
+				truncated++
+			} else {
+				written++
+			}
+		}
+		if truncated == 0 && len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return 0, err
+			}
+		}
+		lineStart = err != bufio.ErrBufferFull
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return 0, err
+		}
+	}
+	if truncated == 0 {
+		return 0, nil
+	}
+	_, err := fmt.Fprintf(w, "... %d more goroutines truncated, the dump is limited to %d goroutines\n", truncated, limit)
+	return truncated, err
+}
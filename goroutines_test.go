@@ -0,0 +1,189 @@
+package goprof
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func blockedGoroutine(started, wait chan struct{}) {
+	started <- struct{}{}
+	<-wait
+}
+
+func TestGroupGoroutines(t *testing.T) {
+	started, wait := make(chan struct{}), make(chan struct{})
+	defer close(wait)
+	for i := 0; i < 5; i++ {
+		go blockedGoroutine(started, wait)
+		<-started
+	}
+	var dump bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&dump, 1); err != nil {
+		t.Fatalf("Failed to write goroutine profile: %v", err)
+	}
+	resp, err := groupGoroutines(&dump)
+	if err != nil {
+		t.Fatalf("Failed to group goroutines: %v", err)
+	}
+	if resp.Total < 5 {
+		t.Fatalf("Expected at least 5 goroutines, got %v", resp.Total)
+	}
+	for _, group := range resp.Groups {
+		for _, frame := range group.Stack {
+			if strings.HasPrefix(frame, "github.com/lazada/goprof.blockedGoroutine ") {
+				if group.Count != 5 {
+					t.Fatalf("Expected 5 blocked goroutines in the group, got %v", group.Count)
+				}
+				return
+			}
+		}
+	}
+	t.Fatalf("Blocked goroutines weren't found in %#v", resp.Groups)
+}
+
+func TestStreamGoroutineGroups(t *testing.T) {
+	started, wait := make(chan struct{}), make(chan struct{})
+	defer close(wait)
+	for i := 0; i < 5; i++ {
+		go blockedGoroutine(started, wait)
+		<-started
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goroutines-stream", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected NDJSON response, got %v %v", w.Code, w.Header())
+	}
+	decoder := json.NewDecoder(w.Body)
+	found, previous := false, 0
+	for decoder.More() {
+		var group GoroutineGroup
+		if err := decoder.Decode(&group); err != nil {
+			t.Fatalf("Failed to decode group: %v", err)
+		}
+		if previous > 0 && group.Count > previous {
+			t.Fatalf("Expected the largest groups first")
+		}
+		previous = group.Count
+		for _, frame := range group.Stack {
+			found = found || strings.HasPrefix(frame, "github.com/lazada/goprof.blockedGoroutine ")
+		}
+	}
+	if !found {
+		t.Fatalf("Blocked goroutines weren't streamed")
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goroutines-stream?top=1", nil))
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 1 {
+		t.Fatalf("Expected only the top group, got %v lines", lines)
+	}
+}
+
+func TestDiffGoroutineGroups(t *testing.T) {
+	before, err := captureGoroutineGroups()
+	if err != nil {
+		t.Fatalf("Failed to group goroutines: %v", err)
+	}
+	started, wait := make(chan struct{}), make(chan struct{})
+	// the goroutines should be gone before the next run of the test groups them again
+	var exited sync.WaitGroup
+	defer exited.Wait()
+	defer close(wait)
+	for i := 0; i < 3; i++ {
+		exited.Add(1)
+		go func() {
+			defer exited.Done()
+			blockedGoroutine(started, wait)
+		}()
+		<-started
+	}
+	after, err := captureGoroutineGroups()
+	if err != nil {
+		t.Fatalf("Failed to group goroutines: %v", err)
+	}
+	grown := diffGoroutineGroups(before.Groups, after.Groups)
+	for _, group := range grown {
+		for _, frame := range group.Stack {
+			if strings.HasPrefix(frame, "github.com/lazada/goprof.blockedGoroutine ") {
+				if group.Delta != 3 {
+					t.Fatalf("Expected 3 new blocked goroutines, got %#v", group)
+				}
+				return
+			}
+		}
+	}
+	t.Fatalf("Blocked goroutines weren't found in %#v", grown)
+}
+
+func TestGoroutineDeltaParams(t *testing.T) {
+	for _, query := range []string{"seconds=0", "seconds=x", "seconds=100000", "top=-1"} {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goroutine-delta?json=1&"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v to be rejected, got %v", query, w.Code)
+		}
+	}
+}
+
+func TestGoroutineDump(t *testing.T) {
+	started, wait := make(chan struct{}), make(chan struct{})
+	defer close(wait)
+	for i := 0; i < 5; i++ {
+		go blockedGoroutine(started, wait)
+		<-started
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goroutine-dump", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goprof.blockedGoroutine(") {
+		t.Fatalf("Expected full stacks of blocked goroutines, got %v %v", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "truncated") {
+		t.Fatalf("Expected the dump under the default limit to be complete")
+	}
+
+	SetMaxGoroutineDump(2)
+	defer SetMaxGoroutineDump(defaultMaxGoroutineDump)
+	w = httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goroutine-dump", nil))
+	body := w.Body.String()
+	if goroutines := strings.Count(body, "\ngoroutine ") + 1; goroutines != 2 || !strings.HasPrefix(body, "goroutine ") {
+		t.Fatalf("Expected 2 goroutines, got %v in %v", goroutines, body)
+	}
+	if !strings.Contains(body, "more goroutines truncated, the dump is limited to 2 goroutines\n") {
+		t.Fatalf("Expected truncation marker, got %v", body)
+	}
+}
+
+func TestWriteGoroutineDump(t *testing.T) {
+	dump := "goroutine 1 [running]:\nmain.main()\n\ngoroutine 2 [chan receive]:\nmain.f()\n\ngoroutine 3 [select]:\nmain.g()\n"
+	for _, tc := range []struct {
+		limit, truncated int
+		expected         string
+	}{
+		{0, 0, dump},
+		{3, 0, dump},
+		{2, 1, "goroutine 1 [running]:\nmain.main()\n\ngoroutine 2 [chan receive]:\nmain.f()\n\n" +
+			"... 1 more goroutines truncated, the dump is limited to 2 goroutines\n"},
+	} {
+		var w bytes.Buffer
+		truncated, err := writeGoroutineDump(&w, strings.NewReader(dump), tc.limit)
+		if err != nil || truncated != tc.truncated || w.String() != tc.expected {
+			t.Fatalf("Limit %v: expected %v truncated %q, got %v %q %v", tc.limit, tc.truncated, tc.expected, truncated, w.String(), err)
+		}
+	}
+
+	// a frame longer than the read buffer, whose tail looks like the start of a goroutine
+	long := "goroutine 1 [running]:\nmain.main(" + strings.Repeat("x", 4096-len("main.main(")) +
+		"goroutine 9 [select]:\n\ngoroutine 2 [select]:\nmain.g()\n"
+	var w bytes.Buffer
+	truncated, err := writeGoroutineDump(&w, strings.NewReader(long), 1)
+	if err != nil || truncated != 1 || !strings.HasPrefix(w.String(), long[:len(long)-len("goroutine 2 [select]:\nmain.g()\n")]) {
+		t.Fatalf("Expected the long frame to be written whole and 1 goroutine truncated, got %v %q %v", truncated, w.String(), err)
+	}
+}
@@ -1,12 +1,16 @@
 package goprof
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime/pprof"
 	"runtime/trace"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,13 +25,106 @@ var (
 	// at the time it's possible to have only one goroutine waiting for stopping profiling by timeout
 	// we use the channel for stopping that goroutine and cancelling autostopping
 	ourCancelAutostop chan bool
+	// the moment when running profiling will be stopped automatically, zero if autostop is disarmed
+	ourAutostopDeadline time.Time
+	// function stopping running profiling with the functions it was started with,
+	// e.g. autostop goroutine calls it. Should be called with ourProfilingStateGuard hold
+	ourStopProfiling func(reason stopReason)
+	// the latest maxFailedAttempts profilings which failed to start or were aborted, the oldest first
+	ourFailedAttempts = make([]failedAttempt, 0)
+	// the file cpu profile is being written to, it's closed when cpu profiling stops
+	ourCPUProfileFile *os.File
+	// closed to stop the goroutine sampling goroutine profile while cpu-goroutines profiling runs
+	ourStopGoroutineSampling chan struct{}
 )
 
 type prof struct {
-	Prof     profName      `json:"prof_name"` // which profile is this related to
-	Dir      string        `json:"dir"`       // directory where profiles will be placed
-	Start    time.Time     `json:"start"`     // profile start time
-	Duration time.Duration `json:"duration"`  // how long did profile writing lasted, zero if profile is one-off
+	Prof     profName      `json:"prof_name"`         // which profile is this related to
+	Dir      string        `json:"dir"`               // directory where profiles will be placed
+	Start    time.Time     `json:"start"`             // profile start time
+	Duration time.Duration `json:"duration"`          // how long did profile writing lasted, zero if profile is one-off
+	Dumps    []profDump    `json:"dumps,omitempty"`   // one-off profiles written into the directory while profiling was running
+	Process  *processInfo  `json:"process,omitempty"` // how the process was run when profiling started
+	// why profiling was stopped, empty if profile is one-off
+	StopReason stopReason `json:"stop_reason,omitempty"`
+	// build or deploy the profile was taken for, e.g. "baseline" or "canary", so variants can be compared
+	Variant string `json:"variant,omitempty"`
+	// value the process panicked with, only for panic profiles
+	Panic string `json:"panic,omitempty"`
+	// what the profile shows, e.g. "the spike at 3:05", it may be set once the profile is written
+	Label string `json:"label,omitempty"`
+	// name of the written profile shown instead of its type, e.g. "baseline" or "after-fix"
+	Name string `json:"name,omitempty"`
+	// wall time of the capture steps in nanoseconds, e.g. "heap" dump or "cpu_start"
+	Timings captureTimings `json:"timings,omitempty"`
+	// the directory was requested by the client and existed before, so removing the profile keeps it
+	KeepDir bool `json:"-"`
+}
+
+// stopReason tells why profiling was stopped, so it's clear whether the interesting part could be cut off
+type stopReason string
+
+const (
+	stopManual      stopReason = "manual"
+	stopAutostop    stopReason = "autostop"
+	stopShutdown    stopReason = "shutdown"           // profiling tools server was shut down
+	stopDirUnusable stopReason = "directory-unusable" // nothing can be written into profiles directory anymore
+	stopCanceled    stopReason = "canceled"           // context passed to ProfileFor was done
+	stopIdle        stopReason = "idle"               // nobody watched profiling for the idle timeout
+	stopRecovered   stopReason = "recovered"          // the process writing the profile exited before it was stopped
+	stopPanic       stopReason = "panic"              // the process panicked, see CapturePanic
+	stopAborted     stopReason = "aborted"            // profiling was stopped and its profiles were thrown away
+)
+
+// processInfo tells how the process was run, it's put into downloaded archives as metadata
+type processInfo struct {
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env,omitempty"` // only the variables allowed with SetRecordedEnv, so secrets don't leak
+	Runtime *runtimeInfo      `json:"runtime,omitempty"`
+	// pid and start time tell profiles written by this process from the ones recovered after restart
+	PID     int       `json:"pid,omitempty"`
+	Started time.Time `json:"started,omitempty"`
+}
+
+// ourProcessStarted is when goprof was loaded into the process, it stands for the process start time
+var ourProcessStarted = time.Now()
+
+// current returns true if the profile was written by this process rather than by a previous run of it
+func (info *processInfo) current() bool {
+	return info != nil && info.PID == os.Getpid() && info.Started.Equal(ourProcessStarted)
+}
+
+// currentProcessInfo returns command line args, the allowed environment variables and the runtime details
+// Should be called with ourProfilingStateGuard hold
+func currentProcessInfo() *processInfo {
+	info := &processInfo{Args: append([]string{}, os.Args...), Runtime: currentRuntimeInfo(), PID: os.Getpid(), Started: ourProcessStarted}
+	for _, name := range ourConfig.recordedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			if info.Env == nil {
+				info.Env = make(map[string]string)
+			}
+			info.Env[name] = value
+		}
+	}
+	return info
+}
+
+// profDump is one-off profile written into the directory of running profiling
+type profDump struct {
+	Prof  profName  `json:"prof_name"`
+	File  string    `json:"file"`
+	Time  time.Time `json:"time"`
+	Label string    `json:"label,omitempty"` // what the dump was taken for, e.g. the event it correlates to
+	// how long the dump took in nanoseconds
+	Took time.Duration `json:"took"`
+}
+
+// failedAttempt is profiling which failed to start or was aborted. They are kept, so it's possible to find out later
+// why there are no profiles from some host
+type failedAttempt struct {
+	Prof  profName  `json:"prof_name"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
 }
 
 type profName string
@@ -39,49 +136,350 @@ const (
 	profileThreadcreate profName = "threadcreate"
 	profileHeap         profName = "heap"
 	profileBlock        profName = "block"
+	profileMutex        profName = "mutex"
 	profileAll          profName = "all"
+	// allocs isn't started on its own, it's only written when 'all' profiling stops, see SetHeapDumpOnStop
+	profileAllocs profName = "allocs"
+	// cpu-goroutines writes cpu profile and samples goroutine profile periodically meanwhile
+	profileCPUGoroutines profName = "cpu-goroutines"
+	// snapshot dumps all the one-off profiles at once
+	profileSnapshot profName = "snapshot"
+	// flight-trace is the trace kept by flight recorder, it's written with flight-trace handler instead of toggling
+	profileFlightTrace profName = "flight-trace"
+	// panic profiles are written by CapturePanic when the process panics
+	profilePanic profName = "panic"
 )
 
+// snapshotProfiles are written by profileSnapshot
+var snapshotProfiles = []profName{profileHeap, profileGoroutine, profileThreadcreate, profileBlock, profileMutex}
+
+// panicProfiles are written by profilePanic
+var panicProfiles = []profName{profileGoroutine, profileHeap}
+
+// ProfileInfo describes a profile which can be started
+type ProfileInfo struct {
+	Name        profName `json:"name"`
+	OneOff      bool     `json:"one_off"`
+	Description string   `json:"description"`
+	// how long the profile runs until autostop unless another duration is requested, zero for one-off profiles
+	Duration time.Duration `json:"duration,omitempty"`
+	// the profile slows the process down noticeably while it runs, since it writes execution trace
+	Heavy bool `json:"heavy"`
+	// the profile shows no contention unless block profile rate or mutex profile fraction is set, e.g. with arm handler
+	NeedsRate bool              `json:"needs_rate"`
+	Overhead  ProfilingOverhead `json:"overhead"` // how much the profile slows this process down while it runs
+}
+
+// supportedProfiles lists profiles which can be started, in the order they are shown in UI
+var supportedProfiles = []ProfileInfo{
+	{Name: profileAll, OneOff: profileAll.OneOff(), Description: "cpu and trace, heap on stop"},
+	{Name: profileCPU, OneOff: profileCPU.OneOff(), Description: "where cpu time is spent"},
+	{Name: profileCPUGoroutines, OneOff: profileCPUGoroutines.OneOff(), Description: "cpu along with goroutine stacks sampled periodically"},
+	{Name: profileHeap, OneOff: profileHeap.OneOff(), Description: "allocations since last gc"},
+	{Name: profileTrace, OneOff: profileTrace.OneOff(), Description: "execution tracer events"},
+	{Name: profileGoroutine, OneOff: profileGoroutine.OneOff(), Description: "stacks of all goroutines"},
+	{Name: profileThreadcreate, OneOff: profileThreadcreate.OneOff(), Description: "stacks which created os threads"},
+	{Name: profileBlock, OneOff: profileBlock.OneOff(), Description: "where goroutines block on synchronization"},
+	{Name: profileSnapshot, OneOff: profileSnapshot.OneOff(), Description: "heap, goroutine, threadcreate, block and mutex at once"},
+}
+
+// profileInfos returns supportedProfiles with their configured durations
+// Should be called with ourProfilingStateGuard hold
+func profileInfos() []ProfileInfo {
+	infos := make([]ProfileInfo, len(supportedProfiles))
+	for i, info := range supportedProfiles {
+		if !info.OneOff {
+			info.Duration = profileDuration(info.Name)
+		}
+		info.Heavy = info.Name.writesTrace()
+		info.NeedsRate = info.Name.needsRate()
+		info.Overhead = estimateOverhead(info.Name)
+		infos[i] = info
+	}
+	return infos
+}
+
+// profileDuration returns how long the profile runs until autostop by default
+// Should be called with ourProfilingStateGuard hold
+func profileDuration(profile profName) time.Duration {
+	if d, ok := ourConfig.profileDurations[profile]; ok {
+		return d
+	}
+	return defautMaxProfilingDuration
+}
+
 // OneOff returns true if profile is being written constantly and we don't need to start it manually
 // everything we can do with such profiles is to dump current state to some file
 func (p profName) OneOff() bool {
 	switch p {
-	case profileGoroutine, profileThreadcreate, profileHeap, profileBlock:
+	case profileGoroutine, profileThreadcreate, profileHeap, profileBlock, profileMutex, profileSnapshot, profilePanic:
 		return true
 	}
 	return false
 }
 
+// retained returns true if the one-off retention applies to the profile. Panic profiles are rare and show
+// why the process crashed, so routine captures never remove them
+func (p profName) retained() bool {
+	return p.OneOff() && p != profilePanic
+}
+
+// dumpedProfiles returns the profiles written when one-off profile is requested
+func (p profName) dumpedProfiles() []profName {
+	switch p {
+	case profileSnapshot:
+		return snapshotProfiles
+	case profilePanic:
+		return panicProfiles
+	}
+	return []profName{p}
+}
+
+// writesTrace returns true if trace is written while the profile runs
+func (p profName) writesTrace() bool {
+	return p == profileTrace || p == profileAll
+}
+
+// writesCPU returns true if cpu profile is written while the profile runs
+func (p profName) writesCPU() bool {
+	return p == profileCPU || p == profileAll || p == profileCPUGoroutines
+}
+
+// needsRate returns true if the profile contains block or mutex profile, which are empty until their rates are set
+func (p profName) needsRate() bool {
+	return p == profileBlock || p == profileMutex || p == profileSnapshot
+}
+
+// HasPprof returns false if profile doesn't produce any pprof files, so it cannot be visualized with pprof tools
+func (p profName) HasPprof() bool {
+	return p != profileTrace && p != profileFlightTrace
+}
+
 const (
 	defautMaxProfilingDuration = 5 * time.Minute // max duration for profiling process. When this duration exceeds we stop profiling automatically
-	// following constants define names of files inside profiles directory
-	traceFileName      = "trace"
-	cpuProfileFileName = "cpu-profile"
+	maxFailedAttempts          = 100             // how many failed attempts to start profiling we remember
+	// following constants define names of files inside profiles directory. One-off profiles are written
+	// to "<profile>.pprof", or to "<profile>-<time>.pprof" when they are written during profiling
+	traceFileName      = "trace.out"
+	cpuProfileFileName = "cpu.pprof"
+	pprofFileExt       = ".pprof"
+	indexFileName      = "index.json" // maps logical names of the profiles, e.g. "cpu" or "trace", to their files
+	// names written by older versions, they are still recognized in profiles directories
+	legacyTraceFileName      = "trace"
+	legacyCPUProfileFileName = "cpu-profile"
+	legacyProfileSuffix      = "-profile"
 )
 
+// profileFileName returns logical name of the profile kept in the file, e.g. "cpu" for "cpu.pprof" or "trace"
+// for "trace.out". Old names and gzipped files, e.g. "heap.pprof.gz", are recognized as well.
+// It returns false if the file isn't a profile
+func profileFileName(fileName string) (logicalName string, isPprof bool, ok bool) {
+	if stored := strings.TrimSuffix(fileName, gzipFileExt); stored != fileName && stored != "" {
+		return profileFileName(stored)
+	}
+	switch {
+	case fileName == traceFileName || fileName == legacyTraceFileName:
+		return "trace", false, true
+	case fileName == legacyCPUProfileFileName:
+		return "cpu", true, true
+	case strings.HasSuffix(fileName, pprofFileExt):
+		return strings.TrimSuffix(fileName, pprofFileExt), true, true
+	case strings.HasSuffix(fileName, legacyProfileSuffix):
+		return strings.TrimSuffix(fileName, legacyProfileSuffix), true, true
+	case strings.Contains(fileName, legacyProfileSuffix+"-"):
+		return strings.Replace(fileName, legacyProfileSuffix+"-", "-", 1), true, true
+	}
+	return "", false, false
+}
+
+// writeProfilesIndex writes index file mapping logical names of the profiles in the directory to their files,
+// so scripts can find the right file by profile type
+func writeProfilesIndex(profilesDir string) error {
+	children, err := ioutil.ReadDir(profilesDir)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]string)
+	for _, child := range children {
+		if name, _, ok := profileFileName(child.Name()); ok && child.Mode().IsRegular() {
+			index[name] = child.Name()
+		}
+	}
+	encoded, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(profilesDir, indexFileName), encoded, 0644)
+}
+
+// writeProfileMetadata writes the record of the written profile into its directory, so the profile can be
+// recovered by RecoverProfiles after the process restarts
+func writeProfileMetadata(written prof) error {
+	forgetDirSize(written.Dir)
+	forgetPackTime(written.Dir)
+	encoded, err := json.MarshalIndent(written, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(written.Dir, metadataFileName), encoded, 0644)
+}
+
 // these types used for mocking functions which start/stop profiling
 type dumpFxn func(profile profName, dir string) error
 type startFxn func(profilesDir string) error
 type stopFxn func()
+type dumpToFxn func(profile profName, filePath string) error
 
-// StartProfiling starts writing profiles and automatically stops it after 5 minutes if not stopped yet
+// StartProfiling starts writing profiles and automatically stops it after the duration configured for the profile
+// (5 minutes by default) if not stopped yet
 // It returns path to the directory where they will be placed
 // if anything goes wrong, corresponding error is returned and no profiling is started
-// If writing profiles is in progress it returns an error
+// If writing profiles is in progress it returns an error, unless one-off profile is requested:
+// it's written into the directory of running profiling then
 func startProfiling(profile profName) (profilesDirectory string, err error) {
-	switch profile {
-	case profileCPU, profileTrace, profileGoroutine, profileThreadcreate, profileHeap, profileBlock, profileAll: // ok
-	default:
-		return "", fmt.Errorf("unknown profile: '%v'", profile)
+	return startProfilingFor(profile, profileDuration(profile))
+}
+
+// startProfilingFor works like startProfiling, but stops profiling automatically after the given duration
+func startProfilingFor(profile profName, maxProfilingDuration time.Duration) (profilesDirectory string, err error) {
+	return startProfilingContext(context.Background(), profile, maxProfilingDuration)
+}
+
+// startProfilingContext works like startProfilingFor, but one-off profiles stop being dumped once ctx is done,
+// e.g. when the request is aborted. Profiling which isn't one-off doesn't depend on ctx once it's started
+func startProfilingContext(ctx context.Context, profile profName, maxProfilingDuration time.Duration) (profilesDirectory string, err error) {
+	return startProfilingIn(ctx, profile, maxProfilingDuration, "")
+}
+
+// startProfilingIn works like startProfilingContext, but writes profiles into the given directory allowed with
+// SetCaptureDirs instead of a new temp one, unless it's empty
+func startProfilingIn(ctx context.Context, profile profName, maxProfilingDuration time.Duration, dir string) (profilesDirectory string, err error) {
+	start := time.Now()
+	span := startProfilingSpan(ctx, profile)
+	defer func() {
+		if err != nil {
+			recordFailedAttempt(profile, err)
+		}
+		session := ProfilingSession{Profile: string(profile), Dir: profilesDirectory, Start: start}
+		if err != nil || profile.OneOff() {
+			session.Duration = time.Since(start)
+			session.Outcome = outcomeWritten
+			endProfilingSpan(span, session, err)
+			return
+		}
+		// the span ends when profiling stops
+		ourProfilingSpan = span
+	}()
+	if err := checkProfileName(profile); err != nil {
+		return "", err
+	}
+	if dir != "" && profilingInProgress() {
+		return "", stateError(fmt.Sprintf("cannot write profiles into '%s', since profiling is already started", dir))
+	}
+	if profile.OneOff() && profilingInProgress() {
+		return doAppendProfile(profile, "", func(profile profName, filePath string) error {
+			return dumpOneOffProfileTo(ctx, profile, filePath)
+		})
+	}
+	dump := dumpProfile
+	if profile.OneOff() {
+		// heap profile dumped when profiling stops must not depend on the request which started it
+		dump = func(profile profName, profilesDir string) error {
+			return dumpOneOffProfileTo(ctx, profile, filepath.Join(profilesDir, string(profile)+pprofFileExt))
+		}
+	}
+	return doStartProfilingIn(profile, maxProfilingDuration, dir, startWritingTrace, trace.Stop, startCPUProfiling, stopCPUProfiling, dump)
+}
+
+// recordFailedAttempt remembers that profiling failed to start, forgetting the oldest attempts if there are too many
+func recordFailedAttempt(profile profName, err error) {
+	if len(ourFailedAttempts) >= maxFailedAttempts {
+		ourFailedAttempts = append(ourFailedAttempts[:0:0], ourFailedAttempts[len(ourFailedAttempts)-maxFailedAttempts+1:]...)
 	}
-	return doStartProfiling(profile, defautMaxProfilingDuration, startWritingTrace, trace.Stop, startCPUProfiling, pprof.StopCPUProfile, dumpProfile)
+	ourFailedAttempts = append(ourFailedAttempts, failedAttempt{Prof: profile, Time: time.Now(), Error: err.Error()})
 }
 
 // stopProfiling stops writing all profiles. Before stopping it tries to write a heap dump
 // to the same folder where the other profiles are kept. It returns path to the folder which contains just written profiling files
 // If profiling is not in progress, this method does nothing and returns empty string
-func stopProfiling() (profilesDirectory string) {
-	return doStopProfiling(dumpProfile, trace.Stop, pprof.StopCPUProfile)
+func stopProfiling(reason stopReason) (profilesDirectory string) {
+	return doStopProfiling(reason, dumpProfile, trace.Stop, stopCPUProfiling)
+}
+
+// abortProfiling stops writing all profiles and removes them instead of keeping them as written, e.g. when
+// the profiling overhead hurts the process. It returns path to the removed folder, empty if profiling is not in progress
+func abortProfiling() (profilesDirectory string) {
+	return doStopProfiling(stopAborted, dumpProfile, trace.Stop, stopCPUProfiling)
+}
+
+// stopProfilingContext works like stopProfiling, but gives up writing the heap dump once ctx is done,
+// e.g. when the server is shutting down, profiling is stopped anyway
+func stopProfilingContext(ctx context.Context, reason stopReason) (profilesDirectory string) {
+	return doStopProfiling(reason, func(profile profName, profilesDir string) error {
+		return dumpProfileContext(ctx, profile, profilesDir)
+	}, trace.Stop, stopCPUProfiling)
+}
+
+// validateProfiling runs the same checks as startProfilingIn does, but doesn't start anything
+// It returns nil if profiling of the given type can be started right now in dir, see startProfilingIn
+func validateProfiling(profile profName, dir string) error {
+	if err := checkProfileName(profile); err != nil {
+		return err
+	}
+	if dir != "" && profilingInProgress() {
+		return stateError(fmt.Sprintf("cannot write profiles into '%s', since profiling is already started", dir))
+	}
+	if profilingInProgress() {
+		if profile.OneOff() {
+			// it will be written into the directory of running profiling
+			return nil
+		}
+		return stateError("cannot start profiling, since it's already started")
+	}
+	if err := checkCaptureBudget(time.Now()); err != nil {
+		return err
+	}
+	if dir != "" {
+		_, _, err := checkCaptureDir(dir)
+		return err
+	}
+	if ring := ourConfig.profileRing; ring.slots > 0 {
+		if _, err := nextRingSlot(ring); err != nil {
+			return err
+		}
+	}
+	// make sure we are able to create profiles directory
+	profilesDir, err := ioutil.TempDir(ourConfig.profileRing.baseDir, profilesDirPrefix(profile))
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(profilesDir); err != nil {
+		logf("Failed to remove %v: %v", profilesDir, err)
+	}
+	return nil
+}
+
+// unknownProfileError is returned when requested profile isn't one of the supported ones
+type unknownProfileError profName
+
+func (e unknownProfileError) Error() string {
+	return fmt.Sprintf("unknown profile: '%v'", string(e))
+}
+
+// stateError is returned when the action doesn't fit the profiling state, e.g. profiling is started while it's running
+type stateError string
+
+func (e stateError) Error() string {
+	return string(e)
+}
+
+func checkProfileName(profile profName) error {
+	for _, info := range supportedProfiles {
+		if info.Name == profile {
+			return nil
+		}
+	}
+	return unknownProfileError(profile)
 }
 
 func profilingInProgress() bool {
@@ -89,74 +487,283 @@ func profilingInProgress() bool {
 }
 
 func doStartProfiling(profile profName, maxProfilingDuration time.Duration,
+	startWritingTrace startFxn, stopWritingTrace stopFxn, startCPUProfiling startFxn, stopCPUProfiling stopFxn,
+	dumpProfile dumpFxn) (profilesDirectory string, err error) {
+	return doStartProfilingIn(profile, maxProfilingDuration, "", startWritingTrace, stopWritingTrace, startCPUProfiling, stopCPUProfiling, dumpProfile)
+}
+
+// doStartProfilingIn works like doStartProfiling, but writes profiles into dir requested by the client, unless it's empty
+func doStartProfilingIn(profile profName, maxProfilingDuration time.Duration, dir string,
 	startWritingTrace startFxn, stopWritingTrace stopFxn, startCPUProfiling startFxn, stopCPUProfiling stopFxn,
 	dumpProfile dumpFxn) (profilesDirectory string, err error) {
 	if profilingInProgress() {
-		return "", fmt.Errorf("cannot start profiling, since it's already started")
+		return "", stateError("cannot start profiling, since it's already started")
+	}
+	now := time.Now()
+	if err := checkCaptureBudget(now); err != nil {
+		return "", err
+	}
+	var profilesDir string
+	created := true
+	if dir != "" {
+		profilesDir, created, err = createCaptureDir(dir)
+	} else {
+		profilesDir, err = createProfilesDir(profile)
 	}
-	profilesDir, err := ioutil.TempDir("", fmt.Sprintf("prof-%v", profile))
 	if err != nil {
 		return "", err
 	}
 	// don't show that we are "writing profiles..." when user wants heap profile:
 	// it confuses people, they think heap profile works as cpu profile and collects data during recording time
+	timings := captureTimings{}
 	if profile.OneOff() {
-		err := dumpProfile(profile, profilesDir)
-		if err != nil {
-			return "", fmt.Errorf("failed to write heap profile: %v", err)
+		for _, dumped := range profile.dumpedProfiles() {
+			if err := timings.timed(string(dumped), func() error { return dumpProfile(dumped, profilesDir) }); err != nil {
+				return "", fmt.Errorf("failed to write %v profile: %v", dumped, err)
+			}
 		}
-		ourWrittenProfiles = append(ourWrittenProfiles, prof{
-			Prof:  profile,
-			Dir:   profilesDir,
-			Start: time.Now(),
+		addWrittenProfile(prof{
+			Prof:    profile,
+			Dir:     profilesDir,
+			Start:   time.Now(),
+			Process: currentProcessInfo(),
+			Timings: timings,
+			KeepDir: !created,
 		})
+		retainOneOffProfile(profile, profilesDir, ourConfig.oneOffRetention)
+		spendCaptureBudget(now)
 		return profilesDir, nil
 	}
 	// if we failed to start profiling we do cleanup finally
 	defer func() {
 		if err != nil {
-			if profile == profileTrace || profile == profileAll {
+			if profile.writesTrace() {
 				stopWritingTrace()
 			}
-			if profile == profileCPU || profile == profileAll {
+			if profile.writesCPU() {
 				stopCPUProfiling()
 			}
 			ourCurrentProfile = nil
-			if removeErr := os.RemoveAll(profilesDir); removeErr != nil {
+			if removeErr := removeProfilesDir(profilesDir, !created); removeErr != nil {
 				logf("Failed to remove %v: %v", profilesDir, removeErr)
 			}
 			logf("Failed to start writing profiles: %v", err)
 		}
 	}()
-	if profile == profileTrace || profile == profileAll {
-		if err := startWritingTrace(profilesDir); err != nil {
+	if profile.writesTrace() {
+		if err := timings.timed(timingTraceStart, func() error { return startWritingTrace(profilesDir) }); err != nil {
 			return "", err
 		}
 	}
-	if profile == profileCPU || profile == profileAll {
-		if err := startCPUProfiling(profilesDir); err != nil {
+	if profile.writesCPU() {
+		if err := timings.timed(timingCPUStart, func() error { return startCPUProfiling(profilesDir) }); err != nil {
 			return "", err
 		}
 	}
-	ourCancelAutostop = make(chan bool, 1)
-	go func(cancelAutostop chan bool) {
-		select {
-		case <-time.After(maxProfilingDuration):
+	armAutostop(maxProfilingDuration, func(reason stopReason) {
+		// this meaningless assignment makes gohint happy
+		_ = doStopProfiling(reason, dumpProfile, stopWritingTrace, stopCPUProfiling)
+	})
+	ourCurrentProfile = &prof{
+		Prof:    profile,
+		Dir:     profilesDir,
+		Start:   time.Now(),
+		Process: currentProcessInfo(),
+		Timings: timings,
+		KeepDir: !created,
+	}
+	if profile == profileCPUGoroutines {
+		startGoroutineSampling(ourConfig.goroutineSampleInterval)
+	}
+	spendCaptureBudget(now)
+	// the profile is recovered from its metadata if the process exits before it's stopped, see RecoverProfiles
+	if err := writeProfileMetadata(*ourCurrentProfile); err != nil {
+		logf("Failed to write metadata of '%s': %v", profilesDir, err)
+	}
+	logf("Start writing %v profiles to '%s'", profile, ourCurrentProfile.Dir)
+	if warning := estimateOverhead(profile).Warning; warning != "" {
+		logf("Profiling '%s' may be expensive: %s", ourCurrentProfile.Dir, warning)
+	}
+	return profilesDir, nil
+}
+
+// goroutineSampleLabel labels goroutine profiles sampled while cpu-goroutines profiling runs
+const goroutineSampleLabel = "sampled"
+
+// startGoroutineSampling starts goroutine which writes goroutine profile into the directory of running profiling
+// right away and then every interval, until stopGoroutineSampling is called. The profiles are named with the time
+// they are written at and are kept in the dumps of the profile, so they make a time series to correlate with cpu
+func startGoroutineSampling(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultGoroutineSampleInterval
+	}
+	stop := make(chan struct{})
+	ourStopGoroutineSampling = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ourProfilingStateGuard.Lock()
+			select {
+			case <-stop:
+				// profiling was stopped while we were waiting for the lock
+				ourProfilingStateGuard.Unlock()
+				return
+			default:
+			}
+			if _, err := doAppendProfile(profileGoroutine, goroutineSampleLabel, dumpProfileTo); err != nil {
+				logf("Failed to sample goroutine profile: %v", err)
+			}
+			ourProfilingStateGuard.Unlock()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopGoroutineSampling stops the goroutine started with startGoroutineSampling, if any
+func stopGoroutineSampling() {
+	if ourStopGoroutineSampling != nil {
+		close(ourStopGoroutineSampling)
+		ourStopGoroutineSampling = nil
+	}
+}
+
+// retainOneOffProfile applies the retention to the one-off profile which was just written: it removes the oldest
+// one-off profiles beyond the limit and schedules removal of this one after TTL
+func retainOneOffProfile(profile profName, profilesDir string, retention OneOffRetention) {
+	if !profile.retained() {
+		return
+	}
+	if retention.MaxCount > 0 {
+		var oneOff []string
+		for _, written := range ourWrittenProfiles {
+			if written.Prof.retained() {
+				oneOff = append(oneOff, written.Dir)
+			}
+		}
+		for len(oneOff) > retention.MaxCount {
+			if err := removeWrittenProfile(oneOff[0]); err != nil {
+				logf("Failed to remove one-off profile '%s': %v", oneOff[0], err)
+			}
+			oneOff = oneOff[1:]
+		}
+	}
+	if retention.TTL > 0 {
+		time.AfterFunc(retention.TTL, func() {
 			ourProfilingStateGuard.Lock()
 			defer ourProfilingStateGuard.Unlock()
-			// this meaningless assignment makes gohint happy
-			_ = doStopProfiling(dumpProfile, stopWritingTrace, stopCPUProfiling)
-		case <-cancelAutostop:
-			return
+			// it may have been removed already, e.g. cleared on the profiling page
+			if findWrittenProfile(profilesDir) == nil {
+				return
+			}
+			if err := removeWrittenProfile(profilesDir); err != nil {
+				logf("Failed to remove expired one-off profile '%s': %v", profilesDir, err)
+			}
+		})
+	}
+}
+
+// armAutostop starts goroutine which calls stop after the given duration unless it's cancelled.
+// If the autostop warning is configured, the goroutine logs it that long before the stop
+// Should be called with ourProfilingStateGuard hold
+func armAutostop(after time.Duration, stop func(reason stopReason)) {
+	ourCancelAutostop = make(chan bool, 1)
+	ourAutostopDeadline = time.Now().Add(after)
+	ourStopProfiling = stop
+	var warnAfter time.Duration
+	if before := ourConfig.autostopWarning; before > 0 && before < after {
+		warnAfter = after - before
+	}
+	go func(cancelAutostop chan bool) {
+		// nil channel never fires, so there is no warning unless it's configured
+		var warning <-chan time.Time
+		if warnAfter > 0 {
+			warning = time.After(warnAfter)
+		}
+		autostop := time.After(after)
+		for {
+			select {
+			case <-warning:
+				warning = nil
+				ourProfilingStateGuard.Lock()
+				select {
+				case <-cancelAutostop:
+					ourProfilingStateGuard.Unlock()
+					return
+				default:
+				}
+				logf("Writing profiles to '%s' stops automatically in %v, extend or cancel autostop to keep it running",
+					ourCurrentProfile.Dir, after-warnAfter)
+				ourProfilingStateGuard.Unlock()
+			case <-autostop:
+				ourProfilingStateGuard.Lock()
+				defer ourProfilingStateGuard.Unlock()
+				select {
+				case <-cancelAutostop:
+					// autostop was cancelled while we were waiting for the lock
+					return
+				default:
+				}
+				stop(stopAutostop)
+				return
+			case <-cancelAutostop:
+				return
+			}
 		}
 	}(ourCancelAutostop)
-	ourCurrentProfile = &prof{
-		Prof:  profile,
-		Dir:   profilesDir,
-		Start: time.Now(),
+}
+
+// autostopWarned returns true if autostop of running profiling is closer than the autostop warning
+// Should be called with ourProfilingStateGuard hold
+func autostopWarned() bool {
+	return autostopArmed() && ourConfig.autostopWarning > 0 && time.Until(ourAutostopDeadline) <= ourConfig.autostopWarning
+}
+
+// extendAutostop moves autostop of running profiling by the given duration.
+// If autostop was cancelled, profiling will be stopped after the given duration from now
+func extendAutostop(extra time.Duration) error {
+	if !profilingInProgress() {
+		return stateError("profiling is not in progress")
 	}
-	logf("Start writing %v profiles to '%s'", profile, ourCurrentProfile.Dir)
-	return profilesDir, nil
+	if extra <= 0 {
+		return fmt.Errorf("autostop can be only moved forward, got %v", extra)
+	}
+	deadline := ourAutostopDeadline
+	if deadline.IsZero() {
+		deadline = time.Now()
+	}
+	cancelAutoStop()
+	armAutostop(time.Until(deadline.Add(extra)), ourStopProfiling)
+	return nil
+}
+
+// doAppendProfile writes one-off profile into the directory of running profiling without interrupting it.
+// File names contain the time of the dump, so several dumps of the same profile don't overwrite each other.
+// The label is kept along with the dump
+func doAppendProfile(profile profName, label string, dumpTo dumpToFxn) (profilesDirectory string, err error) {
+	if !profilingInProgress() {
+		return "", stateError("profiling is not in progress")
+	}
+	now := time.Now()
+	for _, dumped := range profile.dumpedProfiles() {
+		fileName := fmt.Sprintf("%v-%v%v", dumped, now.Format("20060102T150405.000"), pprofFileExt)
+		start := time.Now()
+		if err := dumpTo(dumped, filepath.Join(ourCurrentProfile.Dir, fileName)); err != nil {
+			if dirErr := checkProfilesDir(ourCurrentProfile.Dir); dirErr != nil {
+				// nothing can be written there anymore, so stop profiling instead of leaving it running in vain
+				ourStopProfiling(stopDirUnusable)
+			}
+			return "", fmt.Errorf("failed to write %v profile: %v", dumped, err)
+		}
+		ourCurrentProfile.Dumps = append(ourCurrentProfile.Dumps, profDump{Prof: dumped, File: fileName, Time: now, Label: label,
+			Took: time.Since(start)})
+	}
+	logf("Wrote %v profile to '%s'", profile, ourCurrentProfile.Dir)
+	return ourCurrentProfile.Dir, nil
 }
 
 func cancelAutoStop() {
@@ -168,53 +775,397 @@ func cancelAutoStop() {
 	}
 }
 
-func doStopProfiling(dumpProfile dumpFxn, stopTrace, stopCPU stopFxn) (profilesDirectory string) {
+// disarmAutostop cancels automatic stop of running profiling, so it lasts until it's stopped manually
+func disarmAutostop() error {
+	if !profilingInProgress() {
+		return stateError("profiling is not in progress")
+	}
+	cancelAutoStop()
+	ourAutostopDeadline = time.Time{}
+	return nil
+}
+
+func autostopArmed() bool {
+	return !ourAutostopDeadline.IsZero()
+}
+
+func doStopProfiling(reason stopReason, dumpProfile dumpFxn, stopTrace, stopCPU stopFxn) (profilesDirectory string) {
 	cancelAutoStop()
+	ourAutostopDeadline = time.Time{}
 	if !profilingInProgress() {
 		return ""
 	}
-	if ourCurrentProfile.Prof == profileAll {
-		if err := dumpProfile(profileHeap, ourCurrentProfile.Dir); err != nil {
-			logf("Failed to write heap profile: %v", err)
+	// the directory may become unusable while profiling runs, e.g. tmpfs is remounted read-only
+	dirErr := checkProfilesDir(ourCurrentProfile.Dir)
+	aborted := reason == stopAborted
+	if ourCurrentProfile.Timings == nil {
+		ourCurrentProfile.Timings = captureTimings{}
+	}
+	timings := ourCurrentProfile.Timings
+	if ourCurrentProfile.Prof == profileAll && !ourConfig.noHeapOnStop && dirErr == nil && !aborted {
+		for _, dumped := range ourConfig.heapDumpOnStop.profiles() {
+			profilesDir := ourCurrentProfile.Dir
+			if err := timings.timed(string(dumped), func() error { return dumpProfile(dumped, profilesDir) }); err != nil {
+				logf("Failed to write %v profile: %v", dumped, err)
+			}
 		}
 	}
 	// stop everything no matter whether we succeeded with heap profile
 	// our main goal here is to stop, so, do it
-	if ourCurrentProfile.Prof == profileCPU || ourCurrentProfile.Prof == profileAll {
-		stopCPU()
+	stopGoroutineSampling()
+	if ourCurrentProfile.Prof.writesCPU() {
+		timings.timed(timingCPUStop, func() error { stopCPU(); return nil })
 	}
-	if ourCurrentProfile.Prof == profileTrace || ourCurrentProfile.Prof == profileAll {
-		stopTrace()
+	if ourCurrentProfile.Prof.writesTrace() {
+		timings.timed(timingTraceStop, func() error { stopTrace(); return nil })
 	}
-	logf("Stop writing profiles to '%s'", ourCurrentProfile.Dir)
+	logf("Stop writing profiles to '%s' (%v)", ourCurrentProfile.Dir, reason)
 	ourCurrentProfile.Duration = time.Since(ourCurrentProfile.Start)
-	ourWrittenProfiles = append(ourWrittenProfiles, *ourCurrentProfile)
+	ourCurrentProfile.StopReason = reason
+	if aborted {
+		if err := removeProfilesDir(ourCurrentProfile.Dir, ourCurrentProfile.KeepDir); err != nil {
+			logf("Failed to remove %v: %v", ourCurrentProfile.Dir, err)
+		}
+	} else if dirErr != nil {
+		// profiles in the directory are broken or lost, so don't pretend they were written
+		err := fmt.Errorf("profiles directory '%s' became unusable while profiling: %v", ourCurrentProfile.Dir, dirErr)
+		logf("Failed to write profiles: %v", err)
+		recordFailedAttempt(ourCurrentProfile.Prof, err)
+		if removeErr := removeProfilesDir(ourCurrentProfile.Dir, ourCurrentProfile.KeepDir); removeErr != nil {
+			logf("Failed to remove %v: %v", ourCurrentProfile.Dir, removeErr)
+		}
+	} else {
+		addWrittenProfile(*ourCurrentProfile)
+	}
+	endProfilingSpan(ourProfilingSpan, ProfilingSession{
+		Profile:  string(ourCurrentProfile.Prof),
+		Dir:      ourCurrentProfile.Dir,
+		Start:    ourCurrentProfile.Start,
+		Duration: ourCurrentProfile.Duration,
+		Outcome:  string(reason),
+	}, dirErr)
+	ourProfilingSpan = nil
 	profilesDirectory = ourCurrentProfile.Dir
 	ourCurrentProfile = nil
 	return profilesDirectory
 }
 
+// checkProfilesDir returns an error if files can't be created in the directory anymore
+func checkProfilesDir(profilesDir string) error {
+	probe, err := ioutil.TempFile(profilesDir, ".probe")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// setVariant labels the profile which is being written or is written into the directory with the variant.
+// Should be called with ourProfilingStateGuard hold
+func setVariant(profilesDir, variant string) {
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		ourCurrentProfile.Variant = variant
+	} else if written := findWrittenProfile(profilesDir); written != nil {
+		written.Variant = variant
+		if err := writeProfileMetadata(*written); err != nil {
+			logf("Failed to write metadata of '%s': %v", written.Dir, err)
+		}
+	}
+}
+
+// setLabel labels the profile which is being written, if profilesDir is empty, or the written profile in profilesDir.
+// Empty label removes it. Should be called with ourProfilingStateGuard hold
+func setLabel(profilesDir, label string) error {
+	if profilesDir == "" {
+		if !profilingInProgress() {
+			return stateError("profiling is not in progress, pass the directory of the written profile to label it")
+		}
+		ourCurrentProfile.Label = label
+		return nil
+	}
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		ourCurrentProfile.Label = label
+		return nil
+	}
+	written := findWrittenProfile(profilesDir)
+	if written == nil {
+		return notWrittenProfileError(profilesDir)
+	}
+	written.Label = label
+	if err := writeProfileMetadata(*written); err != nil {
+		logf("Failed to write metadata of '%s': %v", written.Dir, err)
+	}
+	return nil
+}
+
+// renameProfile sets the name of the written profile in profilesDir, the directory itself isn't moved, so download
+// links keep working. Empty name removes it. Names are unique among written profiles.
+// Should be called with ourProfilingStateGuard hold
+func renameProfile(profilesDir, name string) error {
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		return stateError("cannot rename the profile which is being written, stop it first")
+	}
+	written := findWrittenProfile(profilesDir)
+	if written == nil {
+		return notWrittenProfileError(profilesDir)
+	}
+	for _, other := range ourWrittenProfiles {
+		if name != "" && other.Name == name && other.Dir != profilesDir {
+			return stateError(fmt.Sprintf("'%v' is the name of the profile in '%v' already", name, other.Dir))
+		}
+	}
+	written.Name = name
+	if err := writeProfileMetadata(*written); err != nil {
+		logf("Failed to write metadata of '%s': %v", written.Dir, err)
+	}
+	return nil
+}
+
+// notWrittenProfileError is returned when the directory isn't one of the written profiles
+type notWrittenProfileError string
+
+func (e notWrittenProfileError) Error() string {
+	return fmt.Sprintf("'%v' isn't a written profile", string(e))
+}
+
+// addWrittenProfile writes the index and the metadata of the profile which was just written, remembers it and puts
+// it into the storage. Profiles written before are removed if the cleanup policy says so
+func addWrittenProfile(written prof) {
+	if err := writeProfilesIndex(written.Dir); err != nil {
+		logf("Failed to write index of '%s': %v", written.Dir, err)
+	}
+	if err := writeProfileMetadata(written); err != nil {
+		logf("Failed to write metadata of '%s': %v", written.Dir, err)
+	}
+	if ourConfig.cleanupPolicy == CleanupOnStop && len(ourWrittenProfiles) > 0 {
+		clearWrittenProfiles()
+	}
+	ourWrittenProfiles = append(ourWrittenProfiles, written)
+	storeWrittenProfile(written)
+	if ourConfig.maxTotalProfileBytes > 0 {
+		evictWrittenProfiles(ourConfig.maxTotalProfileBytes)
+	}
+}
+
+// evictWrittenProfiles removes the oldest written profiles until all of them take no more than maxBytes.
+// The latest profile is never removed, even if it's larger than maxBytes alone
+func evictWrittenProfiles(maxBytes int64) {
+	sizes := make([]int64, len(ourWrittenProfiles))
+	var total int64
+	for i, written := range ourWrittenProfiles {
+		sizes[i] = cachedDirSize(written.Dir)
+		total += sizes[i]
+	}
+	evicted := 0
+	for ; total > maxBytes && evicted < len(ourWrittenProfiles)-1; evicted++ {
+		oldest := ourWrittenProfiles[evicted]
+		if err := removeProfilesDir(oldest.Dir, oldest.KeepDir); err != nil {
+			logf("Failed to evict profile '%s': %v", oldest.Dir, err)
+			break
+		}
+		forgetDirSize(oldest.Dir)
+		forgetPackTime(oldest.Dir)
+		logf("Evicted profile '%s' of %d bytes, written profiles take %d bytes, the limit is %d",
+			oldest.Dir, sizes[evicted], total, maxBytes)
+		total -= sizes[evicted]
+	}
+	ourWrittenProfiles = append(ourWrittenProfiles[:0:0], ourWrittenProfiles[evicted:]...)
+}
+
+// dirSize returns total size of files in the directory, files which can't be read are ignored
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+var (
+	// ourDirSizes keeps sizes of written profiles directories, so polled listings don't walk all of them every time
+	ourDirSizes      = make(map[string]int64)
+	ourDirSizesGuard sync.Mutex
+)
+
+// cachedDirSize works like dirSize, but walks the directory only once until it's changed by goprof.
+// It may be called with ourProfilingStateGuard read-locked
+func cachedDirSize(dir string) int64 {
+	ourDirSizesGuard.Lock()
+	defer ourDirSizesGuard.Unlock()
+	size, ok := ourDirSizes[dir]
+	if !ok {
+		size = dirSize(dir)
+		ourDirSizes[dir] = size
+	}
+	return size
+}
+
+// forgetDirSize drops the cached size of the directory once files are added to it or it's removed
+func forgetDirSize(dir string) {
+	ourDirSizesGuard.Lock()
+	defer ourDirSizesGuard.Unlock()
+	delete(ourDirSizes, dir)
+}
+
+// removeWrittenProfile removes directory of the written profile and forgets about it.
+// Directories which aren't written profiles are never touched
+func removeWrittenProfile(profilesDir string) error {
+	for i, written := range ourWrittenProfiles {
+		if written.Dir != profilesDir {
+			continue
+		}
+		if err := removeProfilesDir(written.Dir, written.KeepDir); err != nil {
+			return err
+		}
+		forgetDirSize(written.Dir)
+		forgetPackTime(written.Dir)
+		ourWrittenProfiles = append(ourWrittenProfiles[:i:i], ourWrittenProfiles[i+1:]...)
+		logf("Removed written profile '%s'", profilesDir)
+		return nil
+	}
+	return fmt.Errorf("'%s' isn't a written profile", profilesDir)
+}
+
+// clearWrittenProfiles removes directories of all the written profiles and forgets about them.
+// Profiles which failed to be removed are kept in the list
+func clearWrittenProfiles() (removed int, errs []error) {
+	kept := make([]prof, 0)
+	for _, written := range ourWrittenProfiles {
+		if err := removeProfilesDir(written.Dir, written.KeepDir); err != nil {
+			errs = append(errs, err)
+			kept = append(kept, written)
+			continue
+		}
+		forgetDirSize(written.Dir)
+		forgetPackTime(written.Dir)
+		removed++
+	}
+	ourWrittenProfiles = kept
+	logf("Removed %d written profiles, failed to remove %d", removed, len(errs))
+	return removed, errs
+}
+
 func startWritingTrace(profilesDir string) error {
 	traceFile, err := os.Create(filepath.Join(profilesDir, traceFileName))
 	if err != nil {
 		return err
 	}
-	return trace.Start(traceFile)
+	if err := trace.Start(traceFile); err != nil {
+		traceFile.Close()
+		return stateError(fmt.Sprintf("cannot start trace, it's written by somebody else in the process, e.g. net/http/pprof: %v", err))
+	}
+	return nil
 }
 
 func dumpProfile(profile profName, profilesDir string) error {
-	file, err := os.Create(filepath.Join(profilesDir, fmt.Sprintf("%v-profile", profile)))
+	return dumpProfileContext(context.Background(), profile, profilesDir)
+}
+
+func dumpProfileTo(profile profName, filePath string) error {
+	return dumpProfileToContext(context.Background(), profile, filePath)
+}
+
+// dumpProfileContext works like dumpProfile, but returns ctx error as soon as ctx is done, see dumpProfileToContext
+func dumpProfileContext(ctx context.Context, profile profName, profilesDir string) error {
+	return dumpProfileToContext(ctx, profile, filepath.Join(profilesDir, string(profile)+pprofFileExt))
+}
+
+// dumpProfileToContext writes the profile into the file, but returns ctx error as soon as ctx is done. Collecting
+// a huge goroutine or heap profile can't be interrupted, so it's left to finish in the background: nothing is written
+// into the file after ctx is done, and the partial file is removed
+func dumpProfileToContext(ctx context.Context, profile profName, filePath string) error {
+	return dumpProfileInFormat(ctx, profile, filePath, 0)
+}
+
+// dumpOneOffProfileTo works like dumpProfileToContext, but writes the one-off profile requested by the client
+// in the legacy text format if it's enabled, see SetLegacyProfileFormat. Should be called with ourProfilingStateGuard hold
+func dumpOneOffProfileTo(ctx context.Context, profile profName, filePath string) error {
+	debug := 0
+	if ourConfig.legacyProfileFormat {
+		debug = 1
+	}
+	return dumpProfileInFormat(ctx, profile, filePath, debug)
+}
+
+// dumpProfileInFormat works like dumpProfileToContext, debug is passed to pprof.Profile.WriteTo
+func dumpProfileInFormat(ctx context.Context, profile profName, filePath string, debug int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	file, err := os.Create(filePath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	return pprof.Lookup(string(profile)).WriteTo(file, 0)
+	done := make(chan error, 1)
+	go func() {
+		err := pprof.Lookup(string(profile)).WriteTo(contextWriter{ctx: ctx, w: file}, debug)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if ctx.Err() != nil {
+			if removeErr := os.Remove(filePath); removeErr != nil {
+				logf("Failed to remove %v: %v", filePath, removeErr)
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// startCPUProfiling writes cpu profile into the directory. The runtime gzips cpu profile itself,
+// so it takes little disk space even for long profiling and there is no point in compressing it once more
 func startCPUProfiling(profilesDir string) error {
 	cpuProfileFile, err := os.Create(filepath.Join(profilesDir, cpuProfileFileName))
 	if err != nil {
 		return err
 	}
-	return pprof.StartCPUProfile(cpuProfileFile)
+	var output io.Writer = cpuProfileFile
+	if ourConfig.cpuProfileCollector != nil {
+		output = io.MultiWriter(cpuProfileFile, &collectorWriter{collector: ourConfig.cpuProfileCollector})
+	}
+	// only one cpu profile can be written in the process, so it fails if somebody started it bypassing us
+	if err := pprof.StartCPUProfile(output); err != nil {
+		cpuProfileFile.Close()
+		return stateError(fmt.Sprintf("cannot start cpu profile, it's written by somebody else in the process, e.g. net/http/pprof: %v", err))
+	}
+	ourCPUProfileFile = cpuProfileFile
+	return nil
+}
+
+// collectorWriter writes cpu profile to the collector, but never fails, since the runtime stops writing
+// the profile at all after the first error and the file would be cut. After the collector fails, it's skipped
+type collectorWriter struct {
+	collector io.Writer
+	failed    bool
+}
+
+func (w *collectorWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	if _, err := w.collector.Write(p); err != nil {
+		logf("Failed to write cpu profile to the collector: %v", err)
+		w.failed = true
+	}
+	return len(p), nil
+}
+
+// stopCPUProfiling stops cpu profiling and closes the file it was written to
+func stopCPUProfiling() {
+	pprof.StopCPUProfile()
+	if ourCPUProfileFile == nil {
+		return
+	}
+	if err := ourCPUProfileFile.Close(); err != nil {
+		logf("Failed to close cpu profile: %v", err)
+	}
+	ourCPUProfileFile = nil
 }
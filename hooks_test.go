@@ -1,10 +1,21 @@
 package goprof
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"runtime/trace"
 	"testing"
 	"time"
+
+	"github.com/google/pprof/profile"
 )
 
 // mockStopper is an object returning stopFxn instances which just remembers the fact they were called and does nothing else
@@ -35,13 +46,15 @@ func (m *mockStarter) fxn(result error) startFxn {
 // mockDumper is an object with dump function which does nothing, remembers passed params and returns constant result
 type mockDumper struct {
 	profileDir string
-	profile    prof
+	profile    profName
+	dumped     []profName
 }
 
 func (m *mockDumper) fxn(result error) dumpFxn {
-	return func(profile prof, dir string) error {
+	return func(profile profName, dir string) error {
 		m.profileDir = dir
 		m.profile = profile
+		m.dumped = append(m.dumped, profile)
 		return result
 	}
 }
@@ -55,7 +68,7 @@ func TestMain(m *testing.M) {
 func TestStopWhenNotRunning(t *testing.T) {
 	ourProfilingStateGuard.Lock()
 	defer ourProfilingStateGuard.Unlock()
-	if path := stopProfiling(); path != "" {
+	if path := stopProfiling(stopManual); path != "" {
 		t.Fatalf("Expected empty string when stopping not running profiling. Got '%s'", path)
 	}
 }
@@ -63,10 +76,10 @@ func TestStopWhenNotRunning(t *testing.T) {
 func TestStopManyTimesWhenNotRunning(t *testing.T) {
 	ourProfilingStateGuard.Lock()
 	defer ourProfilingStateGuard.Unlock()
-	if path := stopProfiling(); path != "" {
+	if path := stopProfiling(stopManual); path != "" {
 		t.Fatalf("Expected empty string when stopping not running profiling. Got '%s'", path)
 	}
-	if path := stopProfiling(); path != "" {
+	if path := stopProfiling(stopManual); path != "" {
 		t.Fatalf("Expected empty string when stopping not running profiling. Got '%s'", path)
 	}
 }
@@ -147,7 +160,7 @@ func TestStopFailedToDumpHeap(t *testing.T) {
 	defer os.RemoveAll(startDir)
 	writeHeap := &mockDumper{}
 	stopTrace, stopCPU := &mockStopper{}, &mockStopper{}
-	stopDir := doStopProfiling(writeHeap.fxn(fmt.Errorf("test")), stopTrace.fxn(), stopCPU.fxn())
+	stopDir := doStopProfiling(stopManual, writeHeap.fxn(fmt.Errorf("test")), stopTrace.fxn(), stopCPU.fxn())
 	if stopDir != startDir {
 		t.Fatalf("Different dirs for start and stop: '%s' and '%s'", startDir, stopDir)
 	}
@@ -170,7 +183,7 @@ func TestStopCallsStop(t *testing.T) {
 	defer os.RemoveAll(startDir)
 	writeHeap := &mockDumper{}
 	stopTrace, stopCPU := &mockStopper{}, &mockStopper{}
-	stopDir := doStopProfiling(writeHeap.fxn(nil), stopTrace.fxn(), stopCPU.fxn())
+	stopDir := doStopProfiling(stopManual, writeHeap.fxn(nil), stopTrace.fxn(), stopCPU.fxn())
 	if stopDir != startDir {
 		t.Fatalf("Different dirs for start and stop: '%s' and '%s'", startDir, stopDir)
 	}
@@ -184,3 +197,746 @@ func TestStopCallsStop(t *testing.T) {
 		t.Fatalf("Profiling is running")
 	}
 }
+
+func TestValidateDoesNotStart(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if err := validateProfiling(profileCPU, ""); err != nil {
+		t.Fatalf("Expected cpu profiling to be valid, got %v", err)
+	}
+	if profilingInProgress() {
+		t.Fatalf("Profiling is running after validation")
+	}
+	if err := validateProfiling(profName("unknown"), ""); err == nil {
+		t.Fatalf("Expected unknown profile to be invalid")
+	}
+	startDir, err := startMockProfiling()
+	defer cancelAutoStop()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(startDir)
+	defer doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	if err := validateProfiling(profileCPU, ""); err == nil {
+		t.Fatalf("Expected validation to fail while profiling is running")
+	}
+}
+
+func TestDisarmedAutostopDoesNotStop(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	startDir, err := startMockProfiling()
+	if err != nil {
+		ourProfilingStateGuard.Unlock()
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(startDir)
+	err = disarmAutostop()
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to disarm autostop: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if !profilingInProgress() {
+		t.Fatalf("Profiling was stopped automatically after autostop was disarmed")
+	}
+	if autostopArmed() {
+		t.Fatalf("Autostop is reported as armed")
+	}
+	if stopDir := doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn()); stopDir != startDir {
+		t.Fatalf("Different dirs for start and stop: '%s' and '%s'", startDir, stopDir)
+	}
+}
+
+func TestExtendAutostop(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if err := extendAutostop(time.Minute); err == nil {
+		t.Fatalf("Expected error extending profiling which is not running")
+	}
+	startDir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(startDir)
+	defer doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	before := ourAutostopDeadline
+	if err := extendAutostop(time.Hour); err != nil {
+		t.Fatalf("Failed to extend autostop: %v", err)
+	}
+	if got := ourAutostopDeadline.Sub(before); got < time.Hour-time.Second || got > time.Hour+time.Second {
+		t.Fatalf("Expected deadline to be moved by an hour, moved by %v", got)
+	}
+	if err := disarmAutostop(); err != nil {
+		t.Fatalf("Failed to disarm autostop: %v", err)
+	}
+	if err := extendAutostop(time.Hour); err != nil || !autostopArmed() {
+		t.Fatalf("Expected extending to arm cancelled autostop, got %v", err)
+	}
+}
+
+func TestStartSnapshotDumpsAllOneOffProfiles(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	written := len(ourWrittenProfiles)
+	dumped := map[profName]string{}
+	dump := func(profile profName, dir string) error {
+		dumped[profile] = dir
+		return nil
+	}
+	dir, err := doStartProfiling(profileSnapshot, testProfilingDuration, nil, nil, nil, nil, dump)
+	if dir == "" || err != nil {
+		t.Fatalf("Profiling should start without errors. I got '%s' and %v", dir, err)
+	}
+	defer os.RemoveAll(dir)
+	for _, profile := range snapshotProfiles {
+		if dumped[profile] != dir {
+			t.Errorf("Expecting %v to be dumped to %v, got %#v instead", profile, dir, dumped)
+		}
+	}
+	if len(ourWrittenProfiles) != written+1 {
+		t.Fatalf("Expecting snapshot to be recorded as a single profile")
+	}
+}
+
+func TestClearWrittenProfiles(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+	if err != nil {
+		t.Fatalf("Profiling should start without errors. I got %v", err)
+	}
+	removed, errs := clearWrittenProfiles()
+	if removed == 0 || len(errs) != 0 {
+		t.Fatalf("Expected profiles to be removed without errors, removed %v, errors %v", removed, errs)
+	}
+	if len(ourWrittenProfiles) != 0 {
+		t.Fatalf("Written profiles are still listed: %#v", ourWrittenProfiles)
+	}
+	if _, statErr := os.Stat(dir); statErr == nil {
+		t.Fatalf("Profile dir '%s' still exists", dir)
+	}
+}
+
+func TestOneOffDuringProfilingIsAppended(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	startDir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(startDir)
+	defer doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	dumped := []string{}
+	dumpTo := func(profile profName, filePath string) error {
+		dumped = append(dumped, filePath)
+		return nil
+	}
+	dir, err := doAppendProfile(profileGoroutine, "", dumpTo)
+	if err != nil || dir != startDir {
+		t.Fatalf("Expected goroutine profile to be written to '%s', got '%s' and %v", startDir, dir, err)
+	}
+	if len(dumped) != 1 || filepath.Dir(dumped[0]) != startDir {
+		t.Fatalf("Expected single file in '%s', got %v", startDir, dumped)
+	}
+	if !profilingInProgress() || len(ourCurrentProfile.Dumps) != 1 || ourCurrentProfile.Dumps[0].Prof != profileGoroutine {
+		t.Fatalf("Expected the dump to be recorded in running profile, got %#v", ourCurrentProfile)
+	}
+}
+
+func TestCleanupOnStop(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.cleanupPolicy = CleanupOnStop
+	defer func() { ourConfig.cleanupPolicy = CleanupKeep }()
+	first, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+	if err != nil {
+		t.Fatalf("Profiling should start without errors. I got %v", err)
+	}
+	second, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+	if err != nil {
+		t.Fatalf("Profiling should start without errors. I got %v", err)
+	}
+	defer os.RemoveAll(second)
+	if _, statErr := os.Stat(first); statErr == nil {
+		t.Fatalf("Previous profile dir '%s' still exists", first)
+	}
+	if len(ourWrittenProfiles) != 1 || ourWrittenProfiles[0].Dir != second {
+		t.Fatalf("Expected only the latest profile to be listed, got %#v", ourWrittenProfiles)
+	}
+}
+
+func TestEvictWrittenProfiles(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func(written []prof) { ourWrittenProfiles = written }(ourWrittenProfiles)
+	ourWrittenProfiles = make([]prof, 0)
+	dirs := []string{}
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "prof-heap")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "heap-profile"), make([]byte, 100), 0644); err != nil {
+			t.Fatalf("Failed to write profile: %v", err)
+		}
+		dirs = append(dirs, dir)
+		ourWrittenProfiles = append(ourWrittenProfiles, prof{Prof: profileHeap, Dir: dir})
+	}
+	evictWrittenProfiles(250)
+	if len(ourWrittenProfiles) != 2 || ourWrittenProfiles[0].Dir != dirs[1] {
+		t.Fatalf("Expected only the oldest profile to be evicted, got %#v", ourWrittenProfiles)
+	}
+	if _, err := os.Stat(dirs[0]); err == nil {
+		t.Fatalf("Evicted profile dir '%s' still exists", dirs[0])
+	}
+	evictWrittenProfiles(10)
+	if len(ourWrittenProfiles) != 1 || ourWrittenProfiles[0].Dir != dirs[2] {
+		t.Fatalf("Expected the latest profile to be kept, got %#v", ourWrittenProfiles)
+	}
+}
+
+func TestCachedDirSize(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := ioutil.TempDir("", "prof-heap")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer forgetDirSize(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "heap-profile"), make([]byte, 100), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	if size := cachedDirSize(dir); size != 100 {
+		t.Fatalf("Expected 100 bytes, got %v", size)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "goroutine-profile"), make([]byte, 50), 0644); err != nil {
+		t.Fatalf("Failed to write profile: %v", err)
+	}
+	if size := cachedDirSize(dir); size != 100 {
+		t.Fatalf("Expected the cached size to be returned, got %v", size)
+	}
+	written := prof{Prof: profileHeap, Dir: dir}
+	if err := writeProfileMetadata(written); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	if size := cachedDirSize(dir); size != dirSize(dir) || size <= 150 {
+		t.Fatalf("Expected the size to be walked again once metadata is written, got %v", size)
+	}
+}
+
+func TestAbortProfiling(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dumper := &mockDumper{}
+	stopTrace, stopCPU := &mockStopper{}, &mockStopper{}
+	if aborted := doStopProfiling(stopAborted, dumper.fxn(nil), stopTrace.fxn(), stopCPU.fxn()); aborted != dir {
+		t.Fatalf("Expected '%s' to be aborted, got '%s'", dir, aborted)
+	}
+	if !stopTrace.called || !stopCPU.called {
+		t.Fatalf("Expected trace and cpu profiling to be stopped")
+	}
+	if dumper.profile != "" {
+		t.Fatalf("Expected no profile to be dumped on abort, got %v", dumper.profile)
+	}
+	if profilingInProgress() || findWrittenProfile(dir) != nil {
+		t.Fatalf("Expected aborted profile to be neither running nor written")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected aborted profile dir to be removed, got %v", err)
+	}
+}
+
+func TestNoHeapOnStop(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.noHeapOnStop = true
+	defer func() { ourConfig.noHeapOnStop = false }()
+	dir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	dumper := &mockDumper{}
+	doStopProfiling(stopManual, dumper.fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	if dumper.profile != "" {
+		t.Fatalf("Expected no profile to be dumped on stop, got %v", dumper.profile)
+	}
+}
+
+func TestHeapDumpOnStop(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func() { ourConfig.heapDumpOnStop = HeapDumpInuse }()
+	for _, tc := range []struct {
+		dump     HeapDump
+		expected string
+	}{
+		{HeapDumpInuse, "[heap]"},
+		{HeapDumpAllocs, "[allocs]"},
+		{HeapDumpBoth, "[heap allocs]"},
+	} {
+		ourConfig.heapDumpOnStop = tc.dump
+		dir, err := startMockProfiling()
+		if err != nil {
+			t.Fatalf("Profiling should be started successfully. I got %v", err)
+		}
+		dumper := &mockDumper{}
+		doStopProfiling(stopManual, dumper.fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+		os.RemoveAll(dir)
+		if dumped := fmt.Sprint(dumper.dumped); dumped != tc.expected {
+			t.Fatalf("Expected %v to be dumped on stop with %v, got %v", tc.expected, tc.dump, dumped)
+		}
+	}
+}
+
+func TestFailedAttemptsAreRecorded(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func(attempts []failedAttempt) { ourFailedAttempts = attempts }(ourFailedAttempts)
+	ourFailedAttempts = make([]failedAttempt, 0)
+	if _, err := startProfiling("nosuchprofile"); err == nil {
+		t.Fatalf("Expected unknown profile to fail")
+	}
+	if len(ourFailedAttempts) != 1 || ourFailedAttempts[0].Prof != "nosuchprofile" || ourFailedAttempts[0].Error == "" {
+		t.Fatalf("Expected the failure to be recorded, got %#v", ourFailedAttempts)
+	}
+	for i := 0; i < 2*maxFailedAttempts; i++ {
+		recordFailedAttempt(profileCPU, fmt.Errorf("attempt %d", i))
+	}
+	if len(ourFailedAttempts) != maxFailedAttempts {
+		t.Fatalf("Expected %d failed attempts to be kept, got %d", maxFailedAttempts, len(ourFailedAttempts))
+	}
+	if last := ourFailedAttempts[maxFailedAttempts-1]; last.Error != fmt.Sprintf("attempt %d", 2*maxFailedAttempts-1) {
+		t.Fatalf("Expected the latest attempt to be kept, got %#v", last)
+	}
+}
+
+func TestCPUProfileIsCompressed(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := ioutil.TempDir("", "prof-cpu")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := startCPUProfiling(dir); err != nil {
+		t.Fatalf("Failed to start cpu profiling: %v", err)
+	}
+	stopCPUProfiling()
+	if ourCPUProfileFile != nil {
+		t.Fatalf("Expected cpu profile file to be closed")
+	}
+	written, err := ioutil.ReadFile(filepath.Join(dir, cpuProfileFileName))
+	if err != nil {
+		t.Fatalf("Failed to read cpu profile: %v", err)
+	}
+	// gzip magic bytes
+	if len(written) < 2 || written[0] != 0x1f || written[1] != 0x8b {
+		t.Fatalf("Expected cpu profile to be gzipped by the runtime")
+	}
+}
+
+func TestProfilingStartedElsewhere(t *testing.T) {
+	if err := pprof.StartCPUProfile(ioutil.Discard); err != nil {
+		t.Fatalf("Failed to start cpu profile: %v", err)
+	}
+	defer pprof.StopCPUProfile()
+	if err := trace.Start(ioutil.Discard); err != nil {
+		t.Fatalf("Failed to start trace: %v", err)
+	}
+	defer trace.Stop()
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := ioutil.TempDir("", "prof-cpu")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, start := range map[string]func(string) error{"cpu": startCPUProfiling, "trace": startWritingTrace} {
+		err := start(dir)
+		if _, ok := err.(stateError); !ok {
+			t.Errorf("Expected %v started elsewhere to be a state error, got %v", name, err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("collector is down") }
+
+func TestCPUProfileCollector(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func() { ourConfig.cpuProfileCollector = nil }()
+	var collected bytes.Buffer
+	for _, collector := range []io.Writer{&collected, failingWriter{}} {
+		dir, err := ioutil.TempDir("", "prof-cpu")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		ourConfig.cpuProfileCollector = collector
+		if err := startCPUProfiling(dir); err != nil {
+			t.Fatalf("Failed to start cpu profiling: %v", err)
+		}
+		stopCPUProfiling()
+		written, err := ioutil.ReadFile(filepath.Join(dir, cpuProfileFileName))
+		if err != nil {
+			t.Fatalf("Failed to read cpu profile: %v", err)
+		}
+		if _, err := profile.ParseData(written); err != nil {
+			t.Fatalf("Expected complete cpu profile to be written to the file: %v", err)
+		}
+		if collector == &collected && !bytes.Equal(written, collected.Bytes()) {
+			t.Fatalf("Expected the collector to receive the same profile as the file")
+		}
+	}
+}
+
+func TestProcessInfoIsRecorded(t *testing.T) {
+	t.Setenv("GOPROF_TEST_ALLOWED", "yes")
+	t.Setenv("GOPROF_TEST_SECRET", "password")
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.recordedEnv = []string{"GOPROF_TEST_ALLOWED", "GOPROF_TEST_MISSING"}
+	defer func() { ourConfig.recordedEnv = nil }()
+	dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+	if err != nil {
+		t.Fatalf("Profiling should start without errors. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	process := ourWrittenProfiles[len(ourWrittenProfiles)-1].Process
+	if process == nil || len(process.Args) == 0 || process.Args[0] != os.Args[0] {
+		t.Fatalf("Expected command line args to be recorded, got %#v", process)
+	}
+	if len(process.Env) != 1 || process.Env["GOPROF_TEST_ALLOWED"] != "yes" {
+		t.Fatalf("Expected only the allowed variable to be recorded, got %v", process.Env)
+	}
+}
+
+func TestProfilesDirRemovedWhileProfiling(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func(attempts []failedAttempt) { ourFailedAttempts = attempts }(ourFailedAttempts)
+	ourFailedAttempts = make([]failedAttempt, 0)
+	dir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove profiles dir: %v", err)
+	}
+	dumpTo := func(profile profName, filePath string) error {
+		file, err := os.Create(filePath)
+		if err == nil {
+			file.Close()
+		}
+		return err
+	}
+	if _, err := doAppendProfile(profileGoroutine, "", dumpTo); err == nil {
+		t.Fatalf("Expected writing into removed directory to fail")
+	}
+	if profilingInProgress() {
+		t.Fatalf("Expected profiling to be stopped")
+	}
+	if findWrittenProfile(dir) != nil {
+		t.Fatalf("Expected profile in removed directory not to be listed as written")
+	}
+	if len(ourFailedAttempts) != 1 || ourFailedAttempts[0].Prof != profileAll {
+		t.Fatalf("Expected the aborted profiling to be recorded, got %#v", ourFailedAttempts)
+	}
+}
+
+func TestAutostopReason(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileCPU, testProfilingDuration, nil, nil, (&mockStarter{}).fxn(nil), (&mockStopper{}).fxn(), nil)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	time.Sleep(10 * time.Millisecond)
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	written := findWrittenProfile(dir)
+	if written == nil || written.StopReason != stopAutostop {
+		t.Fatalf("Expected profiling to be stopped by autostop, got %#v", written)
+	}
+}
+
+func TestProfileFileName(t *testing.T) {
+	cases := []struct {
+		fileName, logicalName string
+		isPprof, ok           bool
+	}{
+		{cpuProfileFileName, "cpu", true, true},
+		{traceFileName, "trace", false, true},
+		{"heap.pprof", "heap", true, true},
+		{"goroutine-20170411T122811.423.pprof", "goroutine-20170411T122811.423", true, true},
+		// written by older versions
+		{"cpu-profile", "cpu", true, true},
+		{"trace", "trace", false, true},
+		{"heap-profile", "heap", true, true},
+		{"goroutine-profile-20170411T122811.423", "goroutine-20170411T122811.423", true, true},
+		// stored gzipped
+		{"heap.pprof.gz", "heap", true, true},
+		{"trace.out.gz", "trace", false, true},
+		{".gz", "", false, false},
+		{indexFileName, "", false, false},
+	}
+	for _, c := range cases {
+		name, isPprof, ok := profileFileName(c.fileName)
+		if name != c.logicalName || isPprof != c.isPprof || ok != c.ok {
+			t.Errorf("Expected %v to be %q (pprof: %v, ok: %v), got %q (%v, %v)", c.fileName, c.logicalName, c.isPprof, c.ok, name, isPprof, ok)
+		}
+	}
+}
+
+func TestProfilesIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prof-all")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{cpuProfileFileName, traceFileName, "heap.pprof"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("Failed to write %v: %v", name, err)
+		}
+	}
+	if err := writeProfilesIndex(dir); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatalf("Failed to read index: %v", err)
+	}
+	index := map[string]string{}
+	if err := json.Unmarshal(encoded, &index); err != nil {
+		t.Fatalf("Failed to decode index: %v", err)
+	}
+	expected := map[string]string{"cpu": cpuProfileFileName, "trace": traceFileName, "heap": "heap.pprof"}
+	if fmt.Sprint(index) != fmt.Sprint(expected) {
+		t.Fatalf("Expected index %v, got %v", expected, index)
+	}
+	if name, err := mainProfileFile(dir); err != nil || name != cpuProfileFileName {
+		t.Fatalf("Expected cpu profile to be the main one, got %v %v", name, err)
+	}
+}
+
+func TestCPUGoroutinesSamplesGoroutines(t *testing.T) {
+	startCPU, stopCPU := &mockStarter{}, &mockStopper{}
+	ourProfilingStateGuard.Lock()
+	ourConfig.goroutineSampleInterval = 10 * time.Millisecond
+	dir, err := doStartProfiling(profileCPUGoroutines, time.Minute, nil, nil, startCPU.fxn(nil), stopCPU.fxn(), nil)
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		ourConfig.goroutineSampleInterval = defaultGoroutineSampleInterval
+		ourProfilingStateGuard.Unlock()
+	}()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ourProfilingStateGuard.RLock()
+		sampled := len(ourCurrentProfile.Dumps)
+		ourProfilingStateGuard.RUnlock()
+		if sampled >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected goroutine profile to be sampled 3 times, got %v", sampled)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ourProfilingStateGuard.Lock()
+	doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), stopCPU.fxn())
+	written := findWrittenProfile(dir)
+	ourProfilingStateGuard.Unlock()
+	if startCPU.profileDir != dir || !stopCPU.called {
+		t.Errorf("Expected cpu profiling to be started in '%s' and stopped, got '%s' and %v", dir, startCPU.profileDir, stopCPU.called)
+	}
+	if written == nil {
+		t.Fatalf("Expected the profile to be written")
+	}
+	sampled := len(written.Dumps)
+	for _, dump := range written.Dumps {
+		if dump.Prof != profileGoroutine || dump.Label != goroutineSampleLabel {
+			t.Errorf("Expected sampled goroutine profile, got %#v", dump)
+		}
+		if _, err := os.Stat(filepath.Join(dir, dump.File)); err != nil {
+			t.Errorf("Expected the sample to be written: %v", err)
+		}
+	}
+	// sampling should stop along with profiling
+	time.Sleep(50 * time.Millisecond)
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	if len(written.Dumps) != sampled || ourStopGoroutineSampling != nil {
+		t.Errorf("Expected sampling to stop, got %v samples instead of %v", len(written.Dumps), sampled)
+	}
+}
+
+func TestOneOffRetention(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	savedProfiles := ourWrittenProfiles
+	ourWrittenProfiles = []prof{}
+	ourConfig.oneOffRetention = OneOffRetention{MaxCount: 2, TTL: 50 * time.Millisecond}
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		for _, written := range ourWrittenProfiles {
+			os.RemoveAll(written.Dir)
+		}
+		ourWrittenProfiles = savedProfiles
+		ourConfig.oneOffRetention = OneOffRetention{}
+	}()
+	dirs := []string{}
+	for i := 0; i < 3; i++ {
+		ourProfilingStateGuard.Lock()
+		dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+		ourProfilingStateGuard.Unlock()
+		if err != nil {
+			t.Fatalf("Profiling should be started successfully. I got %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	ourProfilingStateGuard.RLock()
+	kept := len(ourWrittenProfiles)
+	oldest := findWrittenProfile(dirs[0])
+	ourProfilingStateGuard.RUnlock()
+	if kept != 2 || oldest != nil {
+		t.Fatalf("Expected only 2 latest one-off profiles to be kept, got %v", kept)
+	}
+	if _, err := os.Stat(dirs[0]); !os.IsNotExist(err) {
+		t.Fatalf("Expected the oldest profile to be removed from disk, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ourProfilingStateGuard.RLock()
+		kept = len(ourWrittenProfiles)
+		ourProfilingStateGuard.RUnlock()
+		if kept == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected one-off profiles to expire, %v are kept", kept)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected expired profile '%s' to be removed from disk, got %v", dir, err)
+		}
+	}
+}
+
+func TestOneOffRetentionKeepsPanicProfiles(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	savedProfiles := ourWrittenProfiles
+	ourWrittenProfiles = []prof{}
+	ourConfig.oneOffRetention = OneOffRetention{MaxCount: 2}
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		for _, written := range ourWrittenProfiles {
+			os.RemoveAll(written.Dir)
+		}
+		ourWrittenProfiles = savedProfiles
+		ourConfig.oneOffRetention = OneOffRetention{}
+	}()
+	panicDir, err := writePanicProfiles("boom")
+	if err != nil {
+		t.Fatalf("Failed to write panic profiles: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ourProfilingStateGuard.Lock()
+		_, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+		ourProfilingStateGuard.Unlock()
+		if err != nil {
+			t.Fatalf("Profiling should be started successfully. I got %v", err)
+		}
+	}
+	ourProfilingStateGuard.RLock()
+	kept := len(ourWrittenProfiles)
+	crash := findWrittenProfile(panicDir)
+	ourProfilingStateGuard.RUnlock()
+	if crash == nil || kept != 3 {
+		t.Fatalf("Expected the panic profile and 2 latest heap profiles to be kept, got %v profiles, panic one kept: %v",
+			kept, crash != nil)
+	}
+}
+
+func TestAutostopWarning(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	ourConfig.autostopWarning = 150 * time.Millisecond
+	dir, err := doStartProfiling(profileCPU, 200*time.Millisecond, nil, nil, (&mockStarter{}).fxn(nil), (&mockStopper{}).fxn(), nil)
+	warned := autostopWarned()
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		ourConfig.autostopWarning = 0
+		doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+		removeWrittenProfile(dir)
+	}()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	if warned {
+		t.Fatalf("Expected no warning right after start")
+	}
+	time.Sleep(100 * time.Millisecond)
+	ourProfilingStateGuard.Lock()
+	status := currentProfileStatus()
+	if status == nil || !status.AutostopWarning {
+		ourProfilingStateGuard.Unlock()
+		t.Fatalf("Expected autostop warning in the status, got %#v", status)
+	}
+	// extending autostop moves the warning too
+	err = extendAutostop(time.Minute)
+	warned = autostopWarned()
+	ourProfilingStateGuard.Unlock()
+	if err != nil || warned {
+		t.Fatalf("Expected extended autostop not to be warned about, got %v %v", warned, err)
+	}
+}
+
+func TestDumpProfileContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goprof-dump")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := dumpProfileContext(context.Background(), profileGoroutine, dir); err != nil {
+		t.Fatalf("Failed to dump goroutine profile: %v", err)
+	}
+	if _, err := parseProfileFile(filepath.Join(dir, "goroutine.pprof")); err != nil {
+		t.Fatalf("Expected goroutine profile to be written, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dumpProfileContext(ctx, profileHeap, dir); err != context.Canceled {
+		t.Fatalf("Expected dumping to be canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "heap.pprof")); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be written after cancel, got %v", err)
+	}
+	if _, err := (contextWriter{ctx: ctx, w: ioutil.Discard}).Write([]byte("profile")); err != context.Canceled {
+		t.Fatalf("Expected writing to fail after cancel, got %v", err)
+	}
+}
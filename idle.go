@@ -0,0 +1,37 @@
+package goprof
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ourLastActivity is the time of the latest status or listing request in unix nanoseconds. It's changed atomically,
+// since listing handlers hold ourProfilingStateGuard only for reading
+var ourLastActivity atomic.Int64
+
+// recordActivity tells that somebody is watching the profiling
+func recordActivity() {
+	ourLastActivity.Store(time.Now().UnixNano())
+}
+
+// watchIdle stops profiling written into the directory once nobody requests status or listing for idleTimeout.
+// Profiling started after that isn't touched. Should be called with ourProfilingStateGuard hold
+func watchIdle(profilesDir string, idleTimeout time.Duration) {
+	recordActivity()
+	var check func()
+	check = func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		if ourCurrentProfile == nil || ourCurrentProfile.Dir != profilesDir {
+			return
+		}
+		idle := time.Since(time.Unix(0, ourLastActivity.Load()))
+		if idle < idleTimeout {
+			time.AfterFunc(idleTimeout-idle, check)
+			return
+		}
+		logf("Nobody watched writing profiles to '%s' for %v, stopping it", profilesDir, idle)
+		ourStopProfiling(stopIdle)
+	}
+	time.AfterFunc(idleTimeout, check)
+}
@@ -0,0 +1,44 @@
+package goprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	SetIdleTimeout(50 * time.Millisecond)
+	defer SetIdleTimeout(0)
+	handler := NewHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=cpu&json=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to start profiling: %v", w.Body.String())
+	}
+	ourProfilingStateGuard.RLock()
+	dir := ourCurrentProfile.Dir
+	ourProfilingStateGuard.RUnlock()
+	defer os.RemoveAll(dir)
+
+	// the status is polled, so profiling keeps running
+	for i := 0; i < 15; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?json=1&limit=1", nil))
+		time.Sleep(10 * time.Millisecond)
+	}
+	ourProfilingStateGuard.RLock()
+	running := profilingInProgress() && ourCurrentProfile.Dir == dir
+	ourProfilingStateGuard.RUnlock()
+	if !running {
+		t.Fatalf("Expected profiling to keep running while the status is polled")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	ourProfilingStateGuard.RLock()
+	written := findWrittenProfile(dir)
+	ourProfilingStateGuard.RUnlock()
+	if written == nil || written.StopReason != stopIdle {
+		t.Fatalf("Expected profiling to be stopped when idle, got %#v", written)
+	}
+}
@@ -0,0 +1,74 @@
+package goprof
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// liveTracePollInterval is how often the followed trace file is checked for the bytes written since
+const liveTracePollInterval = 200 * time.Millisecond
+
+// streamLiveTrace serves the trace file of running profiling as it's written so far, e.g. to start looking into
+// a long trace before it's stopped. With follow=1 it keeps streaming the bytes appended to the file until profiling
+// stops, the trace is complete then. The runtime writes trace in batches and finishes it only on trace.Stop, so the
+// streamed trace is valid only if the stream ends after the stop: go tool trace may fail on a cut one.
+// If downloads are signed, the link should be signed for the directory of the running profile
+func streamLiveTrace(w http.ResponseWriter, r *http.Request) {
+	ourDownloads.Add(1)
+	defer ourDownloads.Done()
+	follow := r.URL.Query().Get("follow") == "1"
+	ourProfilingStateGuard.RLock()
+	if !profilingInProgress() || !ourCurrentProfile.Prof.writesTrace() {
+		ourProfilingStateGuard.RUnlock()
+		writeError(w, r, http.StatusConflict, "Trace isn't being written at the moment. Start trace or all profile first")
+		return
+	}
+	profilesDir := ourCurrentProfile.Dir
+	if err := checkDownloadSignature(profilesDir, r.URL.Query()); err != nil {
+		ourProfilingStateGuard.RUnlock()
+		writeError(w, r, http.StatusForbidden, fmt.Sprintf("Cannot stream the trace: %v", err))
+		return
+	}
+	// the file is opened with the lock hold, so it isn't removed before we open it, e.g. by cleanup on stop
+	traceFile, err := os.Open(filepath.Join(profilesDir, traceFileName))
+	ourProfilingStateGuard.RUnlock()
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to open the trace: %v", err))
+		return
+	}
+	defer traceFile.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+traceFileName+`"`)
+	setNoStore(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		if _, err := io.Copy(w, traceFile); err != nil {
+			// the status is sent already, so the client can only notice the cut stream
+			logf("Failed to stream the trace of '%s': %v", profilesDir, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !follow {
+			return
+		}
+		ourProfilingStateGuard.RLock()
+		running := ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir
+		ourProfilingStateGuard.RUnlock()
+		if !running {
+			// trace is stopped with the lock hold, so it's complete now: stream the rest and finish
+			io.Copy(w, traceFile)
+			return
+		}
+		select {
+		case <-time.After(liveTracePollInterval):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
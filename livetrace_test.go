@@ -0,0 +1,67 @@
+package goprof
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamLiveTrace(t *testing.T) {
+	handler := NewReadOnlyHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/live-trace", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 while trace isn't written, got %v", w.Code)
+	}
+
+	writeTrace := func(dir string) error {
+		return ioutil.WriteFile(filepath.Join(dir, traceFileName), []byte("begin"), 0644)
+	}
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileTrace, time.Minute, writeTrace, (&mockStopper{}).fxn(), nil, nil, nil)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/live-trace", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "begin" {
+		t.Fatalf("Expected the trace written so far, got %v %q", w.Code, w.Body.String())
+	}
+
+	// the followed trace ends once profiling stops, with everything written till the stop
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/live-trace?follow=1")
+	if err != nil {
+		t.Fatalf("Failed to follow the trace: %v", err)
+	}
+	defer resp.Body.Close()
+	begin := make([]byte, len("begin"))
+	if _, err := io.ReadFull(resp.Body, begin); err != nil || string(begin) != "begin" {
+		t.Fatalf("Expected the trace written so far, got %q %v", begin, err)
+	}
+	stopTrace := func() {
+		traceFile, err := os.OpenFile(filepath.Join(dir, traceFileName), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Errorf("Failed to open the trace: %v", err)
+			return
+		}
+		traceFile.WriteString(" end")
+		traceFile.Close()
+	}
+	ourProfilingStateGuard.Lock()
+	doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), stopTrace, (&mockStopper{}).fxn())
+	ourProfilingStateGuard.Unlock()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != " end" {
+		t.Fatalf("Expected the rest of the trace, got %q %v", rest, err)
+	}
+}
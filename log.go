@@ -1,15 +1,143 @@
 package goprof
 
-import "log"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // LogFxn is function which is used for writing log messages
 // It doesn't have many levels, since all the messages has quite the same level
 type LogFxn func(format string, args ...interface{})
 
-var logf = log.Printf
+// defaultLogPrefix starts all the log messages, so they are easy to find in a shared log
+const defaultLogPrefix = "[goprof] "
+
+var (
+	ourLogFxn LogFxn = log.Printf
+	// ourLogPrefix is set with SetLogPrefix, nil means defaultLogPrefix. It's read without ourProfilingStateGuard,
+	// since messages are logged with it hold as well as without it
+	ourLogPrefix atomic.Pointer[string]
+)
+
+// logPrefix returns the prefix set with SetLogPrefix
+func logPrefix() string {
+	if prefix := ourLogPrefix.Load(); prefix != nil {
+		return *prefix
+	}
+	return defaultLogPrefix
+}
+
+// logf writes the message with the log function set with SetLogFunction, prefixed with the log prefix
+func logf(format string, args ...interface{}) {
+	ourLogFxn(strings.Replace(logPrefix(), "%", "%%", -1)+format, args...)
+	ourLogBufferGuard.Lock()
+	defer ourLogBufferGuard.Unlock()
+	if ourLogBuffer != nil {
+		ourLogBuffer.add(LogLine{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	}
+}
 
 // SetLogFunction changes function used for logging.
 // Logging is very basic and doesn't have many levels, since all the messages has quite the same level
 func SetLogFunction(fxn LogFxn) {
-	logf = fxn
+	ourLogFxn = fxn
+}
+
+// SetLogPrefix changes the prefix of all the log messages, "[goprof] " by default. Set it to empty string
+// if the log function already tells where the messages come from, e.g. with a structured logger field
+func SetLogPrefix(prefix string) {
+	ourLogPrefix.Store(&prefix)
+}
+
+// SetLogBuffer keeps the given number of the latest log messages in memory, so log handler shows them to operators
+// who can't read the process log, e.g. why profiling failed to start. Messages are still written with the log
+// function. Zero disables it and forgets the kept messages, which is the default
+func SetLogBuffer(lines int) {
+	ourLogBufferGuard.Lock()
+	defer ourLogBufferGuard.Unlock()
+	ourLogBuffer = nil
+	if lines > 0 {
+		ourLogBuffer = &logBuffer{lines: make([]LogLine, 0, lines)}
+	}
+}
+
+// LogLine is a log message kept in memory
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// LogResponse is returned by log handler, the oldest messages first
+type LogResponse struct {
+	OK    bool      `json:"ok"`
+	Lines []LogLine `json:"lines"`
+}
+
+// logBuffer keeps the latest log messages, the oldest ones are overwritten once it's full
+type logBuffer struct {
+	lines []LogLine
+	next  int // where the next message is put once the buffer is full
+}
+
+func (b *logBuffer) add(line LogLine) {
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+}
+
+// ordered returns the kept messages, the oldest first
+func (b *logBuffer) ordered() []LogLine {
+	return append(append([]LogLine{}, b.lines[b.next:]...), b.lines[:b.next]...)
+}
+
+var (
+	// nil unless messages are kept with SetLogBuffer
+	ourLogBuffer *logBuffer
+	// logf is called with ourProfilingStateGuard hold as well as without it, so the buffer has its own lock
+	ourLogBufferGuard sync.Mutex
+)
+
+// logBufferLines returns how many log messages are kept, zero if the log buffer is disabled
+func logBufferLines() int {
+	ourLogBufferGuard.Lock()
+	defer ourLogBufferGuard.Unlock()
+	if ourLogBuffer == nil {
+		return 0
+	}
+	return cap(ourLogBuffer.lines)
+}
+
+// handler responding with the latest log messages kept since SetLogBuffer was called, as text or LogResponse JSON.
+// Responds with 409 if the log buffer is disabled
+func showLog(w http.ResponseWriter, r *http.Request) {
+	ourLogBufferGuard.Lock()
+	var lines []LogLine
+	enabled := ourLogBuffer != nil
+	if enabled {
+		lines = ourLogBuffer.ordered()
+	}
+	ourLogBufferGuard.Unlock()
+	if !enabled {
+		writeError(w, r, http.StatusConflict, "Log messages aren't kept, enable it with SetLogBuffer")
+		return
+	}
+	if isJsonRequest(r) {
+		setJSONHeaders(w)
+		json.NewEncoder(w).Encode(LogResponse{OK: true, Lines: lines})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	setNoStore(w)
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s %s\n", line.Time.Format(time.RFC3339), line.Message)
+	}
 }
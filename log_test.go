@@ -0,0 +1,62 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogBuffer(t *testing.T) {
+	handler := NewHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/log", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 while the log buffer is disabled, got %v", w.Code)
+	}
+	SetLogBuffer(3)
+	defer SetLogBuffer(0)
+	for i := 0; i < 5; i++ {
+		logf("message %d", i)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/log?json=1", nil))
+	var resp LogResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	var messages []string
+	for _, line := range resp.Lines {
+		messages = append(messages, line.Message)
+	}
+	if fmt.Sprint(messages) != "[message 2 message 3 message 4]" {
+		t.Fatalf("Expected the latest 3 messages, the oldest first, got %v", messages)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/log", nil))
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[2], " message 4") {
+		t.Fatalf("Expected the latest messages as text, got %v", w.Body.String())
+	}
+}
+
+func TestSetLogPrefixWhileLogging(t *testing.T) {
+	defer SetLogPrefix(defaultLogPrefix)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			logf("message %d", i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetLogPrefix(fmt.Sprintf("[prefix %d] ", i))
+	}
+	<-done
+	if prefix := logPrefix(); prefix != "[prefix 99] " {
+		t.Fatalf("Expected the latest prefix, got %q", prefix)
+	}
+}
@@ -0,0 +1,114 @@
+package goprof
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"runtime/metrics"
+)
+
+// defaultRuntimeMetrics are sampled by runtime-metrics handler unless other metrics are set with SetRuntimeMetrics
+var defaultRuntimeMetrics = []string{
+	"/sched/pauses/total/gc:seconds",
+	"/sched/latencies:seconds",
+	"/sched/goroutines:goroutines",
+	"/gc/heap/goal:bytes",
+	"/gc/cycles/total:gc-cycles",
+	"/memory/classes/total:bytes",
+}
+
+// RuntimeMetricsResponse lists sampled runtime/metrics, in the order they are requested
+type RuntimeMetricsResponse struct {
+	OK      bool            `json:"ok"`
+	Metrics []RuntimeMetric `json:"metrics"`
+}
+
+// RuntimeMetric is a single sampled metric, Kind tells which of the values is set: "uint64", "float64"
+// or "histogram". Metrics which the runtime doesn't support have "unsupported" kind and no value
+type RuntimeMetric struct {
+	Name      string            `json:"name"`
+	Kind      string            `json:"kind"`
+	Uint64    *uint64           `json:"uint64,omitempty"`
+	Float64   *float64          `json:"float64,omitempty"`
+	Histogram *RuntimeHistogram `json:"histogram,omitempty"`
+}
+
+// RuntimeHistogram is a sampled runtime/metrics histogram, e.g. of gc pauses. Counts[i] is the number of values
+// between Buckets[i] and Buckets[i+1]. The outermost boundaries may be infinite, they are null then
+type RuntimeHistogram struct {
+	Counts  []uint64   `json:"counts"`
+	Buckets []*float64 `json:"buckets"`
+}
+
+// SetRuntimeMetrics sets the names of runtime/metrics sampled by runtime-metrics handler, e.g.
+// "/gc/heap/goal:bytes". See metrics.All() for the supported ones. No names reset the default set of gc
+// and scheduler metrics
+func SetRuntimeMetrics(names ...string) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.runtimeMetrics = append([]string{}, names...)
+}
+
+// configuredRuntimeMetrics returns the names of sampled metrics. Should be called with ourProfilingStateGuard hold
+func configuredRuntimeMetrics() []string {
+	if len(ourConfig.runtimeMetrics) == 0 {
+		return defaultRuntimeMetrics
+	}
+	return ourConfig.runtimeMetrics
+}
+
+// handler sampling runtime/metrics set with SetRuntimeMetrics as RuntimeMetricsResponse JSON.
+// 'name' params sample the given metrics instead
+func showRuntimeMetrics(w http.ResponseWriter, r *http.Request) {
+	names := r.URL.Query()["name"]
+	if len(names) == 0 {
+		ourProfilingStateGuard.RLock()
+		names = configuredRuntimeMetrics()
+		ourProfilingStateGuard.RUnlock()
+	}
+	resp := RuntimeMetricsResponse{OK: true, Metrics: readRuntimeMetrics(names)}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readRuntimeMetrics samples the metrics with the given names
+func readRuntimeMetrics(names []string) []RuntimeMetric {
+	samples := make([]metrics.Sample, len(names))
+	for i, name := range names {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	sampled := make([]RuntimeMetric, len(samples))
+	for i, sample := range samples {
+		metric := RuntimeMetric{Name: sample.Name}
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			value := sample.Value.Uint64()
+			metric.Kind, metric.Uint64 = "uint64", &value
+		case metrics.KindFloat64:
+			value := sample.Value.Float64()
+			metric.Kind, metric.Float64 = "float64", &value
+		case metrics.KindFloat64Histogram:
+			metric.Kind, metric.Histogram = "histogram", newRuntimeHistogram(sample.Value.Float64Histogram())
+		default:
+			metric.Kind = "unsupported"
+		}
+		sampled[i] = metric
+	}
+	return sampled
+}
+
+// newRuntimeHistogram copies the histogram, which JSON can encode: infinite boundaries become nil
+func newRuntimeHistogram(histogram *metrics.Float64Histogram) *RuntimeHistogram {
+	converted := &RuntimeHistogram{
+		Counts:  append([]uint64{}, histogram.Counts...),
+		Buckets: make([]*float64, len(histogram.Buckets)),
+	}
+	for i, boundary := range histogram.Buckets {
+		if !math.IsInf(boundary, 0) {
+			boundary := boundary
+			converted.Buckets[i] = &boundary
+		}
+	}
+	return converted
+}
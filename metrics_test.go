@@ -0,0 +1,54 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShowRuntimeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/runtime-metrics", nil))
+	var resp RuntimeMetricsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to decode response with status %v: %v", w.Code, err)
+	}
+	if !resp.OK || len(resp.Metrics) != len(defaultRuntimeMetrics) {
+		t.Fatalf("Expected default metrics, got %#v", resp)
+	}
+	for _, metric := range resp.Metrics {
+		if metric.Kind == "unsupported" {
+			t.Errorf("Expected default metric %v to be supported", metric.Name)
+		}
+		if histogram := metric.Histogram; histogram != nil && len(histogram.Buckets) != len(histogram.Counts)+1 {
+			t.Errorf("Expected %v buckets boundaries to enclose the counts, got %v and %v",
+				metric.Name, len(histogram.Buckets), len(histogram.Counts))
+		}
+	}
+}
+
+func TestSetRuntimeMetrics(t *testing.T) {
+	SetRuntimeMetrics("/gc/heap/goal:bytes", "/no/such/metric:bytes")
+	defer SetRuntimeMetrics()
+	w := httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/runtime-metrics", nil))
+	var resp RuntimeMetricsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Metrics) != 2 || resp.Metrics[0].Kind != "uint64" || resp.Metrics[0].Uint64 == nil ||
+		resp.Metrics[1].Kind != "unsupported" {
+		t.Fatalf("Expected configured metrics, got %#v", resp.Metrics)
+	}
+
+	w = httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/runtime-metrics?name=/sched/latencies:seconds", nil))
+	resp = RuntimeMetricsResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Metrics) != 1 || resp.Metrics[0].Histogram == nil {
+		t.Fatalf("Expected requested histogram, got %#v", resp.Metrics)
+	}
+}
@@ -0,0 +1,45 @@
+package goprof
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const (
+	// cpuProfileHz is how often cpu profile samples running threads, runtime/pprof doesn't allow to change it
+	cpuProfileHz = 100
+	// rough share of cpu time taken by writing cpu profile and execution trace, as measured by the Go team
+	cpuProfileOverheadPercent = 1
+	traceOverheadPercent      = 2
+	// cpu profile of this many threads is worth a warning: every sample interrupts a thread with a signal
+	// and unwinds its stack, so latency of hot services may suffer even if the average overhead is low
+	highCoreCount = 64
+)
+
+// ProfilingOverhead estimates how much the profile slows the process down while it runs. The numbers are rough,
+// they depend on the load, so use them to compare profiles rather than to plan capacity
+type ProfilingOverhead struct {
+	Percent float64 `json:"percent"` // estimated share of cpu time taken by profiling
+	// how many samples cpu profile takes at most, when all GOMAXPROCS threads are busy
+	CPUSamplesPerSecond int    `json:"cpu_samples_per_second"`
+	Warning             string `json:"warning,omitempty"` // why the profile may hurt latency of this process
+}
+
+// estimateOverhead returns the overhead of the profile running in this process, one-off profiles don't have any,
+// since they are dumped at once
+func estimateOverhead(profile profName) ProfilingOverhead {
+	var overhead ProfilingOverhead
+	if profile.writesCPU() {
+		threads := runtime.GOMAXPROCS(0)
+		overhead.Percent += cpuProfileOverheadPercent
+		overhead.CPUSamplesPerSecond = cpuProfileHz * threads
+		if threads >= highCoreCount {
+			overhead.Warning = fmt.Sprintf("cpu profile samples up to %d threads %d times a second, which may hurt "+
+				"latency, profile for a shorter time or lower GOMAXPROCS of the process", threads, cpuProfileHz)
+		}
+	}
+	if profile.writesTrace() {
+		overhead.Percent += traceOverheadPercent
+	}
+	return overhead
+}
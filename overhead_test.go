@@ -0,0 +1,27 @@
+package goprof
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestEstimateOverhead(t *testing.T) {
+	if overhead := estimateOverhead(profileHeap); overhead != (ProfilingOverhead{}) {
+		t.Fatalf("Expected one-off profile to have no overhead, got %#v", overhead)
+	}
+	cpu := estimateOverhead(profileCPU)
+	if cpu.Percent <= 0 || cpu.CPUSamplesPerSecond != cpuProfileHz*runtime.GOMAXPROCS(0) {
+		t.Fatalf("Expected cpu profile overhead, got %#v", cpu)
+	}
+	if all := estimateOverhead(profileAll); all.Percent <= cpu.Percent {
+		t.Fatalf("Expected trace to add to cpu profile overhead, got %#v", all)
+	}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(highCoreCount))
+	if warning := estimateOverhead(profileCPU).Warning; warning == "" {
+		t.Fatalf("Expected a warning about cpu profile of %d threads", highCoreCount)
+	}
+	if warning := estimateOverhead(profileTrace).Warning; warning != "" {
+		t.Fatalf("Expected no warning for profile without cpu profile, got %v", warning)
+	}
+}
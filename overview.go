@@ -0,0 +1,108 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+// OverviewResponse is a snapshot of the process health and profiling state in one response, so triage starts with
+// a single request instead of opening several handlers
+type OverviewResponse struct {
+	OK         bool                  `json:"ok"`
+	Goroutines int                   `json:"goroutines"`
+	Memory     OverviewMemory        `json:"memory"`
+	GC         OverviewGC            `json:"gc"`
+	Current    *CurrentProfileStatus `json:"current,omitempty"` // profile being written at the moment
+	// number of written profiles and the disk space taken by them
+	WrittenProfiles int            `json:"written_profiles"`
+	WrittenBytes    int64          `json:"written_bytes"`
+	Rates           ProfileRates   `json:"rates"`
+	Armed           []ArmedProfile `json:"armed"` // block and mutex profiles armed with the arm handler
+}
+
+// OverviewMemory contains the key fields of runtime.MemStats, in bytes unless the name says otherwise
+type OverviewMemory struct {
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapIdle     uint64 `json:"heap_idle"`
+	HeapReleased uint64 `json:"heap_released"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	StackInuse   uint64 `json:"stack_inuse"`
+	Sys          uint64 `json:"sys"` // obtained from the OS
+	TotalAlloc   uint64 `json:"total_alloc"`
+	Mallocs      uint64 `json:"mallocs"`
+	Frees        uint64 `json:"frees"`
+}
+
+// OverviewGC shows gc settings and how much gc has done
+type OverviewGC struct {
+	Percent      int64     `json:"percent"`      // GOGC, -1 means gc is off
+	MemoryLimit  int64     `json:"memory_limit"` // GOMEMLIMIT, math.MaxInt64 means no limit
+	NextGC       uint64    `json:"next_gc"`      // heap size the next gc is started at
+	NumGC        uint32    `json:"num_gc"`
+	NumForcedGC  uint32    `json:"num_forced_gc"`
+	PauseTotalNs uint64    `json:"pause_total_ns"`
+	LastGC       time.Time `json:"last_gc"` // zero if gc hasn't run yet
+	CPUFraction  float64   `json:"cpu_fraction"`
+}
+
+// handler showing OverviewResponse JSON. It reads runtime.MemStats, which stops the world for a moment,
+// so don't poll it too often
+func showOverview(w http.ResponseWriter, r *http.Request) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	resp := OverviewResponse{
+		OK:         true,
+		Goroutines: runtime.NumGoroutine(),
+		Memory: OverviewMemory{
+			HeapAlloc:    stats.HeapAlloc,
+			HeapInuse:    stats.HeapInuse,
+			HeapIdle:     stats.HeapIdle,
+			HeapReleased: stats.HeapReleased,
+			HeapObjects:  stats.HeapObjects,
+			StackInuse:   stats.StackInuse,
+			Sys:          stats.Sys,
+			TotalAlloc:   stats.TotalAlloc,
+			Mallocs:      stats.Mallocs,
+			Frees:        stats.Frees,
+		},
+		GC: OverviewGC{
+			Percent:      gcPercent(),
+			MemoryLimit:  debug.SetMemoryLimit(-1), // negative limit isn't set, only the current one is returned
+			NextGC:       stats.NextGC,
+			NumGC:        stats.NumGC,
+			NumForcedGC:  stats.NumForcedGC,
+			PauseTotalNs: stats.PauseTotalNs,
+			CPUFraction:  stats.GCCPUFraction,
+		},
+	}
+	if stats.LastGC > 0 {
+		resp.GC.LastGC = time.Unix(0, int64(stats.LastGC))
+	}
+	ourProfilingStateGuard.RLock()
+	resp.Current = currentProfileStatus()
+	resp.WrittenProfiles = len(ourWrittenProfiles)
+	for _, written := range ourWrittenProfiles {
+		resp.WrittenBytes += cachedDirSize(written.Dir)
+	}
+	resp.Rates = currentProfileRates()
+	resp.Armed = armedProfiles()
+	ourProfilingStateGuard.RUnlock()
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// gcPercent returns GOGC without changing it, which debug.SetGCPercent can't do
+func gcPercent() int64 {
+	sample := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	// the runtime keeps gc off as -1
+	return int64(sample[0].Value.Uint64())
+}
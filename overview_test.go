@@ -0,0 +1,31 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestShowOverview(t *testing.T) {
+	previous := debug.SetGCPercent(150)
+	defer debug.SetGCPercent(previous)
+	runtime.GC()
+	w := httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/overview", nil))
+	var resp OverviewResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to decode response with status %v: %v", w.Code, err)
+	}
+	if !resp.OK || resp.Goroutines == 0 || resp.Memory.HeapAlloc == 0 || resp.Memory.Sys == 0 {
+		t.Fatalf("Expected goroutines and memory stats, got %#v", resp)
+	}
+	if resp.GC.Percent != 150 || resp.GC.NumGC == 0 || resp.GC.LastGC.IsZero() || resp.GC.MemoryLimit <= 0 {
+		t.Fatalf("Expected gc settings and stats, got %#v", resp.GC)
+	}
+	if resp.Current != nil || resp.Armed == nil {
+		t.Fatalf("Expected no profiling and no armed profiles, got %#v", resp)
+	}
+}
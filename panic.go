@@ -0,0 +1,55 @@
+package goprof
+
+import (
+	"fmt"
+	"time"
+)
+
+// CapturePanic writes goroutine and heap profiles when the function it's deferred in panics, and then panics again
+// with the same value, so the process still crashes. Profiling in progress is stopped first, so its files are
+// complete. Defer it at the start of main and of the goroutines which may panic:
+//
+//	defer goprof.CapturePanic()
+//
+// The profiles are written as a "panic" profile into a new profiles directory, which outlives the process and
+// can be listed after restart with RecoverProfiles. The crash output shows the stack of CapturePanic re-panicking,
+// the goroutine profile keeps the stack of the original panic
+func CapturePanic() {
+	value := recover()
+	if value == nil {
+		return
+	}
+	if profilesDir, err := writePanicProfiles(value); err != nil {
+		logf("Failed to write profiles on panic: %v", err)
+	} else {
+		logf("Wrote profiles on panic to '%s'", profilesDir)
+	}
+	panic(value)
+}
+
+// writePanicProfiles stops profiling in progress and writes panic profiles into a new directory
+// or a slot of the profile ring
+func writePanicProfiles(value interface{}) (string, error) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if profilingInProgress() {
+		ourStopProfiling(stopPanic)
+	}
+	profilesDir, err := createProfilesDir(profilePanic)
+	if err != nil {
+		return "", err
+	}
+	for _, dumped := range profilePanic.dumpedProfiles() {
+		if err := dumpProfile(dumped, profilesDir); err != nil {
+			return "", fmt.Errorf("failed to write %v profile: %v", dumped, err)
+		}
+	}
+	addWrittenProfile(prof{
+		Prof:    profilePanic,
+		Dir:     profilesDir,
+		Start:   time.Now(),
+		Process: currentProcessInfo(),
+		Panic:   fmt.Sprint(value),
+	})
+	return profilesDir, nil
+}
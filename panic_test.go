@@ -0,0 +1,67 @@
+package goprof
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapturePanic(t *testing.T) {
+	func() {
+		defer func() {
+			if value := recover(); value != "boom" {
+				t.Fatalf("Expected the panic to be raised again, got %v", value)
+			}
+		}()
+		defer CapturePanic()
+		panic("boom")
+	}()
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if len(ourWrittenProfiles) == 0 {
+		t.Fatalf("Expected panic profile to be written")
+	}
+	written := ourWrittenProfiles[len(ourWrittenProfiles)-1]
+	defer removeWrittenProfile(written.Dir)
+	if written.Prof != profilePanic || written.Panic != "boom" {
+		t.Fatalf("Expected panic profile, got %#v", written)
+	}
+	for _, name := range []string{"goroutine.pprof", "heap.pprof", metadataFileName} {
+		if _, err := os.Stat(filepath.Join(written.Dir, name)); err != nil {
+			t.Errorf("Expected %v to be written: %v", name, err)
+		}
+	}
+}
+
+func TestCapturePanicWithoutPanic(t *testing.T) {
+	ourProfilingStateGuard.RLock()
+	before := len(ourWrittenProfiles)
+	ourProfilingStateGuard.RUnlock()
+	func() {
+		defer CapturePanic()
+	}()
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	if len(ourWrittenProfiles) != before {
+		t.Fatalf("Expected nothing to be written without panic")
+	}
+}
+
+func TestPanicOnPage(t *testing.T) {
+	profilesDir, err := writePanicProfiles("boom")
+	if err != nil {
+		t.Fatalf("Failed to write panic profiles: %v", err)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(profilesDir)
+	}()
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "panicked: boom") {
+		t.Fatalf("Expected the panic value on the page, got %v", body)
+	}
+}
@@ -0,0 +1,105 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// runtime doesn't allow to read block profile rate, so we remember the one set with SetBlockProfileRate
+var ourBlockProfileRate int
+
+// ProfileRates shows whether block and mutex profiles collect anything and how often heap allocations are sampled
+type ProfileRates struct {
+	BlockProfileRate     int `json:"block_profile_rate"`     // zero means block profile is empty, unless it was set bypassing goprof
+	MutexProfileFraction int `json:"mutex_profile_fraction"` // zero means mutex profile is empty
+	MemProfileRate       int `json:"mem_profile_rate"`
+}
+
+// SetBlockProfileRate calls runtime.SetBlockProfileRate and remembers the rate, so it's shown in the status.
+// Block profile collects nothing until the rate is set
+func SetBlockProfileRate(rate int) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	runtime.SetBlockProfileRate(rate)
+	ourBlockProfileRate = rate
+}
+
+// SetMutexProfileFraction calls runtime.SetMutexProfileFraction and returns the previous fraction.
+// Mutex profile collects nothing until the fraction is set
+func SetMutexProfileFraction(rate int) int {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	return runtime.SetMutexProfileFraction(rate)
+}
+
+// SetMemProfileRate sets runtime.MemProfileRate, heap profile samples one allocation per rate bytes allocated.
+// Smaller rate catches small but frequent allocations at the cost of some overhead, 1 records every allocation.
+// Set it as early as possible, ideally at the start of main: allocations made before are sampled with the old rate
+func SetMemProfileRate(rate int) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	runtime.MemProfileRate = rate
+}
+
+func currentProfileRates() ProfileRates {
+	return ProfileRates{
+		BlockProfileRate: ourBlockProfileRate,
+		// negative value doesn't change the fraction, just returns the current one
+		MutexProfileFraction: runtime.SetMutexProfileFraction(-1),
+		MemProfileRate:       runtime.MemProfileRate,
+	}
+}
+
+// RatesRequest is the body of the request to the config handler, missing fields are left unchanged
+type RatesRequest struct {
+	BlockProfileRate     *int `json:"block_profile_rate"`
+	MutexProfileFraction *int `json:"mutex_profile_fraction"`
+	MemProfileRate       *int `json:"mem_profile_rate"`
+}
+
+// RatesResponse returns the rates after they were changed
+type RatesResponse struct {
+	OK    bool         `json:"ok"`
+	Rates ProfileRates `json:"rates"`
+}
+
+// handler setting block profile rate, mutex profile fraction and heap profile rate at once, e.g. to arm contention
+// and allocation profiling before capturing them. Expects POST with RatesRequest JSON body, responds with the rates
+func setRates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		ourProfilingStateGuard.RLock()
+		defer ourProfilingStateGuard.RUnlock()
+		flashError(w, r, http.StatusMethodNotAllowed, "Configuration can be shown with GET request, rates can be changed only with POST request")
+		return
+	}
+	var req RatesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fatalError(w, r, fmt.Sprintf("Failed to decode request body: %v", err))
+		return
+	}
+	if req.MutexProfileFraction != nil && *req.MutexProfileFraction < 0 {
+		fatalError(w, r, fmt.Sprintf("Bad value for 'mutex_profile_fraction': %v. Please, use non-negative number.", *req.MutexProfileFraction))
+		return
+	}
+	if req.MemProfileRate != nil && *req.MemProfileRate < 0 {
+		fatalError(w, r, fmt.Sprintf("Bad value for 'mem_profile_rate': %v. Please, use non-negative number.", *req.MemProfileRate))
+		return
+	}
+	if req.BlockProfileRate != nil {
+		SetBlockProfileRate(*req.BlockProfileRate)
+	}
+	if req.MutexProfileFraction != nil {
+		SetMutexProfileFraction(*req.MutexProfileFraction)
+	}
+	if req.MemProfileRate != nil {
+		SetMemProfileRate(*req.MemProfileRate)
+	}
+	ourProfilingStateGuard.RLock()
+	rates := currentProfileRates()
+	ourProfilingStateGuard.RUnlock()
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(RatesResponse{OK: true, Rates: rates})
+}
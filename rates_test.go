@@ -0,0 +1,75 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetRates(t *testing.T) {
+	memProfileRate := runtime.MemProfileRate
+	defer SetMemProfileRate(memProfileRate)
+	defer SetBlockProfileRate(0)
+	defer SetMutexProfileFraction(0)
+	handler := NewHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/config",
+		strings.NewReader(`{"block_profile_rate": 100, "mutex_profile_fraction": 5}`)))
+	var resp RatesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	expected := ProfileRates{BlockProfileRate: 100, MutexProfileFraction: 5, MemProfileRate: memProfileRate}
+	if !resp.OK || resp.Rates != expected {
+		t.Fatalf("Expected rates %#v, got %#v", expected, resp)
+	}
+
+	for _, body := range []string{`{"mem_profile_rate": -1}`, `garbage`} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/config", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %v to be rejected, got %v", body, w.Code)
+		}
+	}
+	if runtime.MemProfileRate != memProfileRate {
+		t.Fatalf("Expected rejected request to change nothing")
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/config", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected PUT to be rejected, got %v", w.Code)
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	defer SetDownloadSecret("")
+	SetDownloadSecret("topsecret")
+	defer SetIdleTimeout(0)
+	SetIdleTimeout(time.Minute)
+	defer SetCleanupPolicy(CleanupKeep)
+	SetCleanupPolicy(CleanupOnStop)
+
+	w := httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	if strings.Contains(w.Body.String(), "topsecret") {
+		t.Fatalf("Expected the secret not to be shown, got %s", w.Body.String())
+	}
+	var resp ConfigResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !resp.OK || !resp.SignedDownloads || resp.IdleTimeout != "1m0s" || resp.CleanupPolicy != "on-stop" {
+		t.Fatalf("Expected the configuration to be shown, got %#v", resp)
+	}
+	if resp.ProfileDurations["cpu"] != defautMaxProfilingDuration.String() {
+		t.Fatalf("Expected default cpu duration, got %#v", resp.ProfileDurations)
+	}
+	if _, ok := resp.ProfileDurations["heap"]; ok {
+		t.Fatalf("Expected no durations of one-off profiles, got %#v", resp.ProfileDurations)
+	}
+}
@@ -0,0 +1,57 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ReadyResponse is returned by the ready handler
+type ReadyResponse struct {
+	OK      bool   `json:"ok"`
+	Ready   bool   `json:"ready"`
+	Profile string `json:"profile,omitempty"` // the running profile which makes the process not ready
+}
+
+// SetNotReadyWhileProfiling makes the ready handler respond with 503 while one of the profiles is being written,
+// e.g. "trace" or "all", so load balancers drain the host while profiling overhead degrades its latency and route
+// traffic back once profiling stops. No profiles turn it off, which is the default
+func SetNotReadyWhileProfiling(profiles ...string) error {
+	names := make([]profName, 0, len(profiles))
+	for _, profile := range profiles {
+		if err := checkProfileName(profName(profile)); err != nil {
+			return err
+		}
+		names = append(names, profName(profile))
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.notReadyProfiles = names
+	return nil
+}
+
+// notReadyProfile returns the running profile which makes the process not ready, empty if it's ready.
+// Should be called with ourProfilingStateGuard hold
+func notReadyProfile() profName {
+	if ourCurrentProfile == nil {
+		return ""
+	}
+	for _, profile := range ourConfig.notReadyProfiles {
+		if ourCurrentProfile.Prof == profile {
+			return profile
+		}
+	}
+	return ""
+}
+
+// handler for readiness probes, it responds with ReadyResponse JSON, 503 while a profile set with
+// SetNotReadyWhileProfiling is being written and 200 otherwise
+func showReady(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	profile := notReadyProfile()
+	ourProfilingStateGuard.RUnlock()
+	setJSONHeaders(w)
+	if profile != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ReadyResponse{OK: true, Ready: profile == "", Profile: string(profile)})
+}
@@ -0,0 +1,51 @@
+package goprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestReadyWhileProfiling(t *testing.T) {
+	if err := SetNotReadyWhileProfiling("trace", "nosuchprofile"); err == nil {
+		t.Fatalf("Expected unknown profile to be rejected")
+	}
+	if err := SetNotReadyWhileProfiling("trace", "all"); err != nil {
+		t.Fatalf("Failed to set profiles: %v", err)
+	}
+	defer SetNotReadyWhileProfiling()
+	ready := func() (int, ReadyResponse) {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+		var resp ReadyResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return w.Code, resp
+	}
+	if code, resp := ready(); code != http.StatusOK || !resp.Ready {
+		t.Fatalf("Expected ready without profiling, got %v %+v", code, resp)
+	}
+
+	ourProfilingStateGuard.Lock()
+	dir, err := startMockProfiling()
+	// mock profiling stops automatically at once, which must not happen while the lock is released
+	cancelAutoStop()
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	code, resp := ready()
+	ourProfilingStateGuard.Lock()
+	doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	ourProfilingStateGuard.Unlock()
+	if code != http.StatusServiceUnavailable || resp.Ready || resp.Profile != "all" {
+		t.Fatalf("Expected not ready while 'all' is written, got %v %+v", code, resp)
+	}
+	if code, resp := ready(); code != http.StatusOK || !resp.Ready {
+		t.Fatalf("Expected ready once profiling stopped, got %v %+v", code, resp)
+	}
+}
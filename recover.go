@@ -0,0 +1,118 @@
+package goprof
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecoverProfiles finds profiles directories left in baseDir by the previous run of the process, e.g. one which
+// crashed right after profiling, and lists them on the profiling page along with the profiles written by this one.
+// Empty baseDir means os.TempDir(), where profiles are written. Call it at startup, before profiling starts.
+// Only directories with goprof metadata matching their names are recovered, yet recovered profiles are removed
+// by the cleanup policy and the disk space limit like others, so baseDir should be dedicated to goprof rather than
+// shared by several services.
+// Profiles which were being written when the process exited are recovered too, their stop reason is "recovered".
+// It returns how many profiles were recovered
+func RecoverProfiles(baseDir string) (int, error) {
+	if baseDir == "" {
+		baseDir = os.TempDir()
+	}
+	children, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return 0, err
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	prefix := profilesDirPrefix("")
+	var recovered []prof
+	for _, child := range children {
+		if !child.IsDir() || !strings.HasPrefix(child.Name(), prefix) {
+			continue
+		}
+		profilesDir := filepath.Join(baseDir, child.Name())
+		if findWrittenProfile(profilesDir) != nil || ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+			continue
+		}
+		written, ok := readRecoveredProfile(profilesDir, strings.TrimPrefix(child.Name(), prefix))
+		if ok {
+			recovered = append(recovered, written)
+		}
+	}
+	ourWrittenProfiles = append(ourWrittenProfiles, recovered...)
+	sort.SliceStable(ourWrittenProfiles, func(i, j int) bool {
+		return ourWrittenProfiles[i].Start.Before(ourWrittenProfiles[j].Start)
+	})
+	if ourConfig.maxTotalProfileBytes > 0 {
+		evictWrittenProfiles(ourConfig.maxTotalProfileBytes)
+	}
+	return len(recovered), nil
+}
+
+// readRecoveredProfile reads the record of the profile from the metadata in the directory. It returns false
+// unless the directory keeps goprof metadata of the profile type in its name, so directories of other processes
+// which happen to have the same prefix are never adopted. Metadata of profiles which were being written is written
+// when they start, their duration is guessed from the files
+func readRecoveredProfile(profilesDir, name string) (prof, bool) {
+	encoded, err := ioutil.ReadFile(filepath.Join(profilesDir, metadataFileName))
+	if err != nil {
+		return prof{}, false
+	}
+	var written prof
+	if err := json.Unmarshal(encoded, &written); err != nil {
+		logf("Failed to read metadata of '%s': %v", profilesDir, err)
+		return prof{}, false
+	}
+	if profile, ok := recoveredProfileName(name); !ok || profile != written.Prof {
+		return prof{}, false
+	}
+	// the directory might have been moved
+	written.Dir = profilesDir
+	if !written.Prof.OneOff() && written.StopReason == "" {
+		if last := lastModified(profilesDir); last.After(written.Start) {
+			written.Duration = last.Sub(written.Start)
+		}
+		written.StopReason = stopRecovered
+	}
+	return written, true
+}
+
+// lastModified returns the latest modification time of the profile files in the directory, zero if there are none
+func lastModified(profilesDir string) time.Time {
+	var last time.Time
+	children, err := ioutil.ReadDir(profilesDir)
+	if err != nil {
+		logf("Failed to ls '%s': %v", profilesDir, err)
+		return last
+	}
+	for _, child := range children {
+		if _, _, ok := profileFileName(child.Name()); ok && child.Mode().IsRegular() && child.ModTime().After(last) {
+			last = child.ModTime()
+		}
+	}
+	return last
+}
+
+// recoveredProfileName returns the profile type from the name of profiles directory without prefix, which is
+// the type followed by random digits
+func recoveredProfileName(name string) (profName, bool) {
+	var found profName
+	names := []profName{profileFlightTrace, profilePanic}
+	for _, info := range supportedProfiles {
+		names = append(names, info.Name)
+	}
+	for _, profile := range names {
+		suffix := strings.TrimPrefix(name, string(profile))
+		if len(suffix) == len(name) || suffix == "" || strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		if len(profile) > len(found) {
+			found = profile
+		}
+	}
+	return found, found != ""
+}
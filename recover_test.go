@@ -0,0 +1,86 @@
+package goprof
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecoverProfiles(t *testing.T) {
+	base, err := ioutil.TempDir("", "goprof-recover")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(base)
+	files := map[string]string{
+		"prof-cpu123/cpu.pprof":             "",
+		"prof-goroutine456/goroutine.pprof": "",
+		"prof-heap789/heap.pprof":           "",
+		"other-cpu123/cpu.pprof":            "",
+		"prof-mutex1/mutex.pprof":           "",
+	}
+	for name := range files {
+		if err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(base, name), nil, 0644); err != nil {
+			t.Fatalf("Failed to write %v: %v", name, err)
+		}
+	}
+	records := []prof{
+		// a profile written by the previous process
+		{Prof: profileTrace, Dir: filepath.Join(base, "prof-trace1"), Start: time.Now().Add(-time.Hour),
+			Duration: time.Minute, StopReason: stopManual, Variant: "canary"},
+		// the one it was writing when it exited has only the metadata written at start
+		{Prof: profileCPU, Dir: filepath.Join(base, "prof-cpu123"), Start: time.Now().Add(-time.Minute)},
+		{Prof: profileGoroutine, Dir: filepath.Join(base, "prof-goroutine456"), Start: time.Now()},
+		// metadata which doesn't match the directory name, e.g. copied by another tool
+		{Prof: profileCPU, Dir: filepath.Join(base, "prof-heap789"), Start: time.Now()},
+	}
+	for _, written := range records {
+		os.Mkdir(written.Dir, 0755)
+		if err := writeProfileMetadata(written); err != nil {
+			t.Fatalf("Failed to write metadata: %v", err)
+		}
+	}
+	ourProfilingStateGuard.Lock()
+	writtenBefore := ourWrittenProfiles
+	ourWrittenProfiles = nil
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		ourWrittenProfiles = writtenBefore
+	}()
+
+	n, err := RecoverProfiles(base)
+	if err != nil || n != 3 {
+		t.Fatalf("Expected 3 profiles to be recovered, got %v, %v", n, err)
+	}
+	ourProfilingStateGuard.RLock()
+	recovered := append([]prof{}, ourWrittenProfiles...)
+	ourProfilingStateGuard.RUnlock()
+	if len(recovered) != 3 || recovered[0].Prof != profileTrace || recovered[0].Variant != "canary" ||
+		recovered[0].StopReason != stopManual {
+		t.Fatalf("Expected the profile with metadata to go first, got %#v", recovered)
+	}
+	for _, r := range recovered[1:] {
+		switch r.Prof {
+		case profileCPU:
+			if r.StopReason != stopRecovered || r.Duration <= 0 {
+				t.Errorf("Expected interrupted cpu profile to be marked recovered, got %#v", r)
+			}
+		case profileGoroutine:
+			if r.StopReason != "" || r.Duration != 0 {
+				t.Errorf("Expected one-off goroutine profile, got %#v", r)
+			}
+		default:
+			t.Errorf("Unexpected recovered profile %#v", r)
+		}
+	}
+	if n, err := RecoverProfiles(base); err != nil || n != 0 {
+		t.Fatalf("Expected known profiles not to be recovered again, got %v, %v", n, err)
+	}
+}
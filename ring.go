@@ -0,0 +1,84 @@
+package goprof
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// profileRing is a fixed number of profiles directories named slot-0..slot-<slots-1> in baseDir
+type profileRing struct {
+	baseDir string
+	slots   int
+}
+
+// SetProfileRing makes profiling write every profile into one of the given number of directories in baseDir,
+// named "slot-0", "slot-1" and so on, instead of a new directory in the temp dir. An empty slot is taken first,
+// then the one written the longest time ago is overwritten, so disk usage is bounded by the number of slots and
+// a sidecar can collect the latest profiles from the same paths all the time. The base directory is created
+// if it doesn't exist. Zero slots turn the ring off, which is the default
+func SetProfileRing(baseDir string, slots int) error {
+	if slots > 0 {
+		if err := os.MkdirAll(baseDir, 0700); err != nil {
+			return err
+		}
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if slots <= 0 {
+		ourConfig.profileRing = profileRing{}
+		return nil
+	}
+	ourConfig.profileRing = profileRing{baseDir: filepath.Clean(baseDir), slots: slots}
+	return nil
+}
+
+// createProfilesDir creates the directory the profile is written into, a slot of the profile ring if it's set
+// or a new directory in the temp dir. Should be called with ourProfilingStateGuard hold
+func createProfilesDir(profile profName) (string, error) {
+	ring := ourConfig.profileRing
+	if ring.slots == 0 {
+		return ioutil.TempDir("", profilesDirPrefix(profile))
+	}
+	slot, err := nextRingSlot(ring)
+	if err != nil {
+		return "", err
+	}
+	if findWrittenProfile(slot) != nil {
+		if err := removeWrittenProfile(slot); err != nil {
+			return "", fmt.Errorf("failed to overwrite '%s': %v", slot, err)
+		}
+	} else if err := os.RemoveAll(slot); err != nil {
+		return "", fmt.Errorf("failed to overwrite '%s': %v", slot, err)
+	}
+	if err := os.Mkdir(slot, 0700); err != nil {
+		return "", err
+	}
+	return slot, nil
+}
+
+// nextRingSlot returns the first slot of the ring which doesn't exist, or the one modified the longest time ago.
+// The slot of the profile being written is never returned. Should be called with ourProfilingStateGuard hold
+func nextRingSlot(ring profileRing) (string, error) {
+	var oldest string
+	var oldestTime time.Time
+	for i := 0; i < ring.slots; i++ {
+		slot := filepath.Join(ring.baseDir, fmt.Sprintf("slot-%d", i))
+		if ourCurrentProfile != nil && ourCurrentProfile.Dir == slot {
+			continue
+		}
+		info, err := os.Stat(slot)
+		if os.IsNotExist(err) {
+			return slot, nil
+		}
+		if err == nil && (oldest == "" || info.ModTime().Before(oldestTime)) {
+			oldest, oldestTime = slot, info.ModTime()
+		}
+	}
+	if oldest == "" {
+		return "", stateError(fmt.Sprintf("no slot of the profile ring in '%s' can be overwritten", ring.baseDir))
+	}
+	return oldest, nil
+}
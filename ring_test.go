@@ -0,0 +1,63 @@
+package goprof
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfileRing(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "goprof-ring")
+	if err != nil {
+		t.Fatalf("Failed to create base dir: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+	if err := SetProfileRing(filepath.Join(baseDir, "ring"), 3); err != nil {
+		t.Fatalf("Failed to set profile ring: %v", err)
+	}
+	defer SetProfileRing("", 0)
+	ourProfilingStateGuard.Lock()
+	savedProfiles := ourWrittenProfiles
+	ourWrittenProfiles = []prof{}
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		ourWrittenProfiles = savedProfiles
+	}()
+
+	expected := []string{"slot-0", "slot-1", "slot-2", "slot-0"}
+	for i, slot := range expected {
+		ourProfilingStateGuard.Lock()
+		dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+		ourProfilingStateGuard.Unlock()
+		if err != nil {
+			t.Fatalf("Profiling should be started successfully. I got %v", err)
+		}
+		if dir != filepath.Join(baseDir, "ring", slot) {
+			t.Fatalf("Expected profile %v to be written into %v, got %v", i, slot, dir)
+		}
+	}
+	ourProfilingStateGuard.RLock()
+	kept := len(ourWrittenProfiles)
+	ourProfilingStateGuard.RUnlock()
+	if kept != 3 {
+		t.Fatalf("Expected the overwritten profile to be forgotten, got %v written profiles", kept)
+	}
+
+	// the slot removed by somebody is taken first
+	if err := os.RemoveAll(filepath.Join(baseDir, "ring", "slot-2")); err != nil {
+		t.Fatalf("Failed to remove slot: %v", err)
+	}
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, (&mockDumper{}).fxn(nil))
+	ourProfilingStateGuard.Unlock()
+	if err != nil || filepath.Base(dir) != "slot-2" {
+		t.Fatalf("Expected the empty slot to be taken, got %v %v", dir, err)
+	}
+	dir, err = writePanicProfiles("boom")
+	if err != nil || filepath.Dir(dir) != filepath.Join(baseDir, "ring") {
+		t.Fatalf("Expected panic profiles to be written into a slot, got %v %v", dir, err)
+	}
+}
@@ -0,0 +1,80 @@
+package goprof
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+)
+
+// runtimeInfoFileName is written into downloaded archives when SetArchiveRuntimeInfo is enabled
+const runtimeInfoFileName = "runtime.txt"
+
+// schedulerMetrics are recorded as the scheduler snapshot along with profiles
+var schedulerMetrics = []string{
+	"/sched/gomaxprocs:threads",
+	"/sched/threads/total:threads",
+	"/sched/goroutines:goroutines",
+	"/sched/goroutines/running:goroutines",
+	"/sched/goroutines/runnable:goroutines",
+	"/sched/goroutines/waiting:goroutines",
+	"/sched/goroutines/not-in-go:goroutines",
+	"/sched/goroutines-created:goroutines",
+}
+
+// runtimeInfo describes the runtime when profiling started, which helps to read the profiles, especially traces
+type runtimeInfo struct {
+	GoVersion  string `json:"go_version"`
+	NumCPU     int    `json:"num_cpu"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	NumCgoCall int64  `json:"num_cgo_call"`
+	Goroutines int    `json:"goroutines"`
+	// scheduler metrics from runtime/metrics by name, the ones this runtime doesn't support are missing
+	Scheduler map[string]uint64 `json:"scheduler,omitempty"`
+}
+
+// currentRuntimeInfo collects runtimeInfo, which costs almost nothing
+func currentRuntimeInfo() *runtimeInfo {
+	info := &runtimeInfo{
+		GoVersion:  runtime.Version(),
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		NumCgoCall: runtime.NumCgoCall(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	samples := make([]metrics.Sample, len(schedulerMetrics))
+	for i, name := range schedulerMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	for _, sample := range samples {
+		if sample.Value.Kind() != metrics.KindUint64 {
+			continue
+		}
+		if info.Scheduler == nil {
+			info.Scheduler = make(map[string]uint64)
+		}
+		info.Scheduler[sample.Name] = sample.Value.Uint64()
+	}
+	return info
+}
+
+// text formats the info as runtimeInfoFileName, one "name: value" line per field, scheduler metrics sorted by name
+func (info *runtimeInfo) text() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "go_version: %v\n", info.GoVersion)
+	fmt.Fprintf(&buf, "num_cpu: %v\n", info.NumCPU)
+	fmt.Fprintf(&buf, "gomaxprocs: %v\n", info.GOMAXPROCS)
+	fmt.Fprintf(&buf, "num_cgo_call: %v\n", info.NumCgoCall)
+	fmt.Fprintf(&buf, "goroutines: %v\n", info.Goroutines)
+	names := make([]string, 0, len(info.Scheduler))
+	for name := range info.Scheduler {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%v: %v\n", name, info.Scheduler[name])
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,80 @@
+package goprof
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// pageLinkTTL is how long download links shown on the profiling page stay valid when the download secret is set
+const pageLinkTTL = time.Hour
+
+// SignedDownloadURL returns the download link of the written profile which is valid for ttl, e.g. to share it with
+// a colleague who can't access the profiling page. The link is relative to the handler, like the links on the page.
+// It requires the secret set with SetDownloadSecret
+func SignedDownloadURL(path string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("bad ttl %v, it should be positive", ttl)
+	}
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	if len(ourConfig.downloadSecret) == 0 {
+		return "", errors.New("download secret isn't set")
+	}
+	path = filepath.Clean(path)
+	return fmt.Sprintf("download/%s.tgz?path=%s&%s", archiveName(path), url.QueryEscape(path),
+		signDownload(path, time.Now().Add(ttl))), nil
+}
+
+// SignedBinaryURL returns the link to /binary which is valid for ttl. It requires the secret set with SetDownloadSecret
+func SignedBinaryURL(ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("bad ttl %v, it should be positive", ttl)
+	}
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	if len(ourConfig.downloadSecret) == 0 {
+		return "", errors.New("download secret isn't set")
+	}
+	return "binary?" + signDownload(binarySignedName, time.Now().Add(ttl)), nil
+}
+
+// signDownload returns query params with the expiry and the signature of the profiles directory.
+// Should be called with ourProfilingStateGuard hold
+func signDownload(profilesDir string, expires time.Time) string {
+	expiresParam := strconv.FormatInt(expires.Unix(), 10)
+	return fmt.Sprintf("expires=%s&signature=%s", expiresParam, downloadSignature(profilesDir, expiresParam))
+}
+
+func downloadSignature(profilesDir, expires string) string {
+	mac := hmac.New(sha256.New, ourConfig.downloadSecret)
+	mac.Write([]byte(profilesDir + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkDownloadSignature returns an error unless the download request is signed with the download secret
+// and hasn't expired. Requests are always valid when there is no secret.
+// Should be called with ourProfilingStateGuard hold
+func checkDownloadSignature(profilesDir string, query url.Values) error {
+	if len(ourConfig.downloadSecret) == 0 {
+		return nil
+	}
+	expires, signature := query.Get("expires"), query.Get("signature")
+	if expires == "" || signature == "" {
+		return errors.New("the download link isn't signed")
+	}
+	if !hmac.Equal([]byte(signature), []byte(downloadSignature(profilesDir, expires))) {
+		return errors.New("the download link has a bad signature")
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return errors.New("the download link has expired")
+	}
+	return nil
+}
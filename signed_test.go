@@ -0,0 +1,99 @@
+package goprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedDownloadURL(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	if _, err := SignedDownloadURL(profilesDir, time.Minute); err == nil {
+		t.Fatalf("Expected signing to fail without the secret")
+	}
+	defer SetDownloadSecret("")
+	SetDownloadSecret("secret")
+	download := func(link string) int {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+link+"&binary=0&json=1", nil))
+		return w.Code
+	}
+	link, err := SignedDownloadURL(profilesDir, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to sign download link: %v", err)
+	}
+	if code := download(link); code != http.StatusOK {
+		t.Fatalf("Expected signed link to be downloaded, got %v", code)
+	}
+	ourProfilingStateGuard.RLock()
+	pageLink := formatDownloadURL(profilesDir)
+	expired := "download/x.tgz?path=" + url.QueryEscape(profilesDir) + "&" + signDownload(profilesDir, time.Now().Add(-time.Second))
+	ourProfilingStateGuard.RUnlock()
+	if code := download(pageLink); code != http.StatusOK {
+		t.Fatalf("Expected link on the page to be signed, got %v", code)
+	}
+	cases := map[string]string{
+		"unsigned": "download/x.tgz?path=" + url.QueryEscape(profilesDir),
+		"expired":  expired,
+		"tampered": strings.Replace(link, "expires=", "expires=9", 1),
+		"other":    strings.Replace(link, url.QueryEscape(profilesDir), url.QueryEscape(os.TempDir()), 1),
+	}
+	for name, link := range cases {
+		if code := download(link); code != http.StatusForbidden {
+			t.Errorf("Expected %v link to be rejected, got %v", name, code)
+		}
+	}
+}
+
+func TestSignedProfileFile(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	defer SetDownloadSecret("")
+	SetDownloadSecret("secret")
+	get := func(link string) int {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+link, nil))
+		return w.Code
+	}
+	unsigned := "profile-file?path=" + url.QueryEscape(profilesDir)
+	if code := get(unsigned); code != http.StatusForbidden {
+		t.Fatalf("Expected unsigned profile file link to be rejected, got %v", code)
+	}
+	ourProfilingStateGuard.RLock()
+	signed := unsigned + "&" + signDownload(profilesDir, time.Now().Add(time.Minute))
+	flameGraph := formatFlameGraphURL(profilesDir)
+	ourProfilingStateGuard.RUnlock()
+	if code := get(signed); code != http.StatusOK {
+		t.Fatalf("Expected signed profile file link to be served, got %v", code)
+	}
+	if code := get(flameGraph); code != http.StatusOK {
+		t.Fatalf("Expected flame graph link on the page to be signed, got %v", code)
+	}
+}
+
+func TestSignedVerify(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	defer SetDownloadSecret("")
+	SetDownloadSecret("secret")
+	verify := func(link string) int {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+link+"&json=1", nil))
+		return w.Code
+	}
+	unsigned := "verify?path=" + url.QueryEscape(profilesDir)
+	if code := verify(unsigned); code != http.StatusForbidden {
+		t.Fatalf("Expected unsigned verify link to be rejected, got %v", code)
+	}
+	ourProfilingStateGuard.RLock()
+	signed := unsigned + "&" + signDownload(profilesDir, time.Now().Add(time.Minute))
+	ourProfilingStateGuard.RUnlock()
+	if code := verify(signed); code != http.StatusOK {
+		t.Fatalf("Expected signed verify link to be served, got %v", code)
+	}
+}
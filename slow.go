@@ -0,0 +1,63 @@
+package goprof
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// slowRequestProfileDuration is how long profiles which aren't one-off run when a slow request starts them
+	slowRequestProfileDuration = 10 * time.Second
+	// slowRequestCooldown is how long slow requests don't start the profile after it's started,
+	// so a burst of slow requests doesn't keep profiling running
+	slowRequestCooldown = time.Minute
+)
+
+// ProfileSlowRequests wraps the handler, so a request which is handled for longer than the threshold starts
+// the profile while it's still being handled, e.g. "goroutine" shows what the slow request waits for and "cpu"
+// what keeps the process busy meanwhile. Profiles which aren't one-off run for 10 seconds. Slow requests start
+// the profile once a minute at most. If other profiling runs, one-off profile is written into its directory and
+// others aren't started. It panics if the profile isn't supported, as the handler would never profile anything
+func ProfileSlowRequests(next http.Handler, threshold time.Duration, profile string) http.Handler {
+	if err := checkProfileName(profName(profile)); err != nil {
+		panic(err)
+	}
+	trigger := &slowRequestTrigger{profile: profName(profile), cooldown: slowRequestCooldown}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := time.AfterFunc(threshold, func() {
+			trigger.fire(r.Context(), r.URL.Path, threshold)
+		})
+		defer timer.Stop()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// slowRequestTrigger starts the profile for slow requests, skipping them during the cooldown
+type slowRequestTrigger struct {
+	profile  profName
+	cooldown time.Duration
+	// when the profile was started the last time, guarded by ourProfilingStateGuard
+	lastStarted time.Time
+}
+
+// fire starts the profile for the slow request, its span is a child of the request trace carried by ctx.
+// Dumping the profile isn't cut short when the request is done meanwhile
+func (t *slowRequestTrigger) fire(ctx context.Context, path string, threshold time.Duration) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if !t.lastStarted.IsZero() && time.Since(t.lastStarted) < t.cooldown {
+		return
+	}
+	// somebody is profiling already, that's not a failure worth recording
+	if profilingInProgress() && !t.profile.OneOff() {
+		return
+	}
+	profilesDir, err := startProfilingContext(context.WithoutCancel(ctx), t.profile, slowRequestProfileDuration)
+	if err != nil {
+		logf("Failed to start %v profile for slow request %v: %v", t.profile, path, err)
+		return
+	}
+	t.lastStarted = time.Now()
+	logf("Request %v is handled for longer than %v, writing %v profile to '%s'", path, threshold, t.profile, profilesDir)
+}
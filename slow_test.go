@@ -0,0 +1,68 @@
+package goprof
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProfileSlowRequests(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	savedProfiles := ourWrittenProfiles
+	ourWrittenProfiles = []prof{}
+	ourProfilingStateGuard.Unlock()
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		for _, written := range ourWrittenProfiles {
+			os.RemoveAll(written.Dir)
+		}
+		ourWrittenProfiles = savedProfiles
+	}()
+	handler := ProfileSlowRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") == "1" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}), 20*time.Millisecond, "goroutine")
+	written := func() int {
+		ourProfilingStateGuard.RLock()
+		defer ourProfilingStateGuard.RUnlock()
+		return len(ourWrittenProfiles)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if n := written(); n != 0 {
+		t.Fatalf("Expected fast request not to be profiled, got %v profiles", n)
+	}
+	tracer := &recordingTracer{}
+	SetProfilingTracer(tracer)
+	defer SetProfilingTracer(nil)
+	slow := httptest.NewRequest("GET", "/slow?slow=1", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), slow.WithContext(context.WithValue(slow.Context(), traceKey{}, "request")))
+	if n := written(); n != 1 {
+		t.Fatalf("Expected slow request to be profiled once, got %v profiles", n)
+	}
+	ourProfilingStateGuard.RLock()
+	traces := append([]interface{}{}, tracer.traces...)
+	ourProfilingStateGuard.RUnlock()
+	if len(traces) != 1 || traces[0] != "request" {
+		t.Fatalf("Expected the span to be started in the trace of the slow request, got %#v", traces)
+	}
+	// the profile was just started, so the next slow request is skipped
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow?slow=1", nil))
+	if n := written(); n != 1 {
+		t.Fatalf("Expected slow request during cooldown not to be profiled, got %v profiles", n)
+	}
+}
+
+func TestProfileSlowRequestsUnknownProfile(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected unknown profile to panic")
+		}
+	}()
+	ProfileSlowRequests(http.NotFoundHandler(), time.Second, "wallclock")
+}
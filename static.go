@@ -0,0 +1,103 @@
+package goprof
+
+import (
+	"io"
+	"net/http"
+	"path"
+)
+
+// static assets are kept in the code, so the profiling page works without any external resources
+const staticStyle = `body {
+  font-family: sans-serif;
+  margin: 2em;
+  color: #222;
+}
+h1 {
+  font-size: 1.5em;
+}
+a {
+  color: #0b5394;
+}
+.message {
+  padding: 0.5em;
+  background: #fff3cd;
+  border: 1px solid #ffe08a;
+}
+.start-links a {
+  margin-right: 0.5em;
+}
+.written-profiles li {
+  margin: 0.25em 0;
+}
+`
+
+const staticScript = `(function() {
+  var startedAgoElement = document.getElementById("started-ago");
+  if (!startedAgoElement) {
+    return;
+  }
+  var startedAgo = parseInt(startedAgoElement.getAttribute("data-started-ago"), 10) || 0;
+  var profilesDir = startedAgoElement.getAttribute("data-dir");
+  var updateStartedAgoUI = function() {
+    var sec = startedAgo % 60;
+    var min = Math.floor(startedAgo / 60);
+    var durationStr = "";
+    if (min > 0) {durationStr += min + "min";}
+    if (sec > 0) {durationStr += " " + sec + "sec";}
+    if (durationStr === "") {durationStr = "just now";} else {durationStr += " ago";}
+    startedAgoElement.innerHTML = durationStr;
+  };
+  updateStartedAgoUI();
+  var ticker = window.setInterval(function() {
+    startedAgo++;
+    updateStartedAgoUI();
+  }, 1000);
+  // profiling may be stopped by another client or by autostop, so check the server from time to time
+  var warned = false;
+  var poller = window.setInterval(function() {
+    fetch("./?json=1&limit=1", {headers: {"Accept": "application/json"}, cache: "no-store"})
+      .then(function(response) { return response.json(); })
+      .then(function(status) {
+        if (status.current && status.current.dir === profilesDir) {
+          startedAgo = status.current.elapsed_seconds;
+          updateStartedAgoUI();
+          if (status.current.autostop_warning && !warned) {
+            warned = true;
+            var warning = document.createElement("p");
+            warning.className = "message";
+            warning.textContent = "Profiling stops automatically in " + status.current.remaining_seconds + "sec.";
+            startedAgoElement.parentNode.parentNode.insertBefore(warning, startedAgoElement.parentNode.nextSibling);
+          }
+          return;
+        }
+        window.clearInterval(ticker);
+        window.clearInterval(poller);
+        startedAgoElement.innerHTML += ", but profiling is stopped now. <a href=\"./\">Reload</a> the page to see the result";
+      })
+      .catch(function() {
+        // the server may be unavailable for a moment, keep counting locally
+      });
+  }, 5000);
+})();
+`
+
+type staticAsset struct {
+	contentType string
+	content     string
+}
+
+var staticAssets = map[string]staticAsset{
+	"goprof.css": {"text/css; charset=utf-8", staticStyle},
+	"goprof.js":  {"application/javascript; charset=utf-8", staticScript},
+}
+
+// handler for static assets used by the profiling page
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	asset, ok := staticAssets[path.Base(r.URL.Path)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", asset.contentType)
+	io.WriteString(w, asset.content)
+}
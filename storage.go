@@ -0,0 +1,67 @@
+package goprof
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Storage keeps archives of written profiles off the host, e.g. in S3, so they outlive ephemeral hosts
+type Storage interface {
+	// Put stores the archive under the name, e.g. "prof-cpu123.tgz". The archive is packed while it's read,
+	// so nothing but the profiles directory is kept on disk and memory use doesn't depend on the archive size.
+	// Put should read the archive till EOF, an error reading it means the archive is broken and shouldn't be kept
+	Put(ctx context.Context, name string, archive io.Reader) error
+}
+
+// SetStorage sets the storage every written profile is put into as tar.gz archive once it's written, the same
+// archive which is downloaded. Nil disables it, which is the default. Profiles are put in the background,
+// WaitDownloads waits for them along with downloads. Putting takes no longer than the archive timeout
+func SetStorage(storage Storage) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourStorage = storage
+}
+
+var ourStorage Storage
+
+// storeWrittenProfile puts the archive of the written profile into the storage in the background, if it's set.
+// Should be called with ourProfilingStateGuard hold
+func storeWrittenProfile(written prof) {
+	if ourStorage == nil {
+		return
+	}
+	opts := newArchiveOptions(!ourConfig.archiveWithoutBinary)
+	if err := opts.setMetadata(written); err != nil {
+		logf("Failed to encode metadata of '%s': %v", written.Dir, err)
+		return
+	}
+	name := archiveName(written.Dir) + ".tgz"
+	ourDownloads.Add(1)
+	go func(storage Storage, timeout time.Duration) {
+		defer ourDownloads.Done()
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := storeProfile(ctx, storage, name, written.Dir, opts); err != nil {
+			logf("Failed to put '%s' into the storage: %v", written.Dir, err)
+			return
+		}
+		logf("Put '%s' into the storage as %v", written.Dir, name)
+	}(ourStorage, ourConfig.archiveTimeout)
+}
+
+// storeProfile packs the profiles directory straight into the storage through a pipe
+func storeProfile(ctx context.Context, storage Storage, name, profilesDir string, opts archiveOptions) error {
+	archive, archiveWriter := io.Pipe()
+	go func() {
+		archiveWriter.CloseWithError(writeArchive(ctx, archiveWriter, profilesDir, opts))
+	}()
+	err := storage.Put(ctx, name, archive)
+	// unblocks packing if the storage stopped reading earlier
+	archive.Close()
+	return err
+}
@@ -0,0 +1,89 @@
+package goprof
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStorage keeps put archives in memory
+type memoryStorage struct {
+	mu       sync.Mutex
+	archives map[string][]byte
+	err      error
+}
+
+func (s *memoryStorage) Put(ctx context.Context, name string, archive io.Reader) error {
+	if s.err != nil {
+		return s.err
+	}
+	data, err := ioutil.ReadAll(archive)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.archives[name] = data
+	return nil
+}
+
+func TestStoreWrittenProfile(t *testing.T) {
+	storage := &memoryStorage{archives: map[string][]byte{}}
+	SetStorage(storage)
+	defer SetStorage(nil)
+	SetArchiveBinary(false)
+	defer SetArchiveBinary(true)
+
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileHeap, testProfilingDuration, nil, nil, nil, nil, dumpProfile)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(dir)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := WaitDownloads(ctx); err != nil {
+		t.Fatalf("Failed to wait for the profile to be put: %v", err)
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if len(storage.archives) != 1 {
+		t.Fatalf("Expected single archive to be put, got %v", len(storage.archives))
+	}
+	for name, archive := range storage.archives {
+		if !strings.HasPrefix(name, "prof-heap") || !strings.HasSuffix(name, ".tgz") {
+			t.Errorf("Unexpected archive name '%v'", name)
+		}
+		names := archiveFiles(t, bytes.NewReader(archive))
+		sort.Strings(names)
+		expected := []string{indexFileName, "heap.pprof", metadataFileName, "show-web"}
+		sort.Strings(expected)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %v in the archive, got %v", expected, names)
+		}
+	}
+}
+
+func TestStoreProfileFailure(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	storage := &memoryStorage{err: errors.New("bucket is gone")}
+	// packing should be unblocked even though the storage doesn't read the archive
+	err := storeProfile(context.Background(), storage, "prof-heap.tgz", profilesDir, archiveOptions{})
+	if err != storage.err {
+		t.Fatalf("Expected the storage error, got %v", err)
+	}
+}
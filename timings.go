@@ -0,0 +1,78 @@
+package goprof
+
+import (
+	"sync"
+	"time"
+)
+
+// capture steps timed besides dumps, which are timed under the name of the dumped profile, e.g. "heap"
+const (
+	timingTraceStart = "trace_start"
+	timingTraceStop  = "trace_stop"
+	timingCPUStart   = "cpu_start"
+	timingCPUStop    = "cpu_stop" // flushes the rest of cpu profile into the file
+	timingPack       = "pack"     // the latest download archive, it isn't put into the archive metadata
+)
+
+// captureTimings tells how long each step of capturing the profile took, e.g. dumping heap profile of a large heap
+// may take long and hurt latency itself
+type captureTimings map[string]time.Duration
+
+// timed runs the capture step and records its wall time, whether it succeeded or not
+func (t captureTimings) timed(step string, capture func() error) error {
+	start := time.Now()
+	err := capture()
+	t[step] = time.Since(start)
+	return err
+}
+
+// CaptureTime returns how long capturing the profile took in total, without packing its archives
+func (p prof) CaptureTime() time.Duration {
+	var total time.Duration
+	for step, took := range p.Timings {
+		if step != timingPack {
+			total += took
+		}
+	}
+	return total
+}
+
+var (
+	// ourPackTimes keeps how long the latest archive of each directory took to pack. Archives are packed
+	// with ourProfilingStateGuard read-locked, so they have their own lock
+	ourPackTimes      = make(map[string]time.Duration)
+	ourPackTimesGuard sync.Mutex
+)
+
+// recordPackTime remembers how long the archive of the written profile took to pack
+func recordPackTime(profilesDir string, took time.Duration) {
+	ourPackTimesGuard.Lock()
+	defer ourPackTimesGuard.Unlock()
+	ourPackTimes[profilesDir] = took
+}
+
+// forgetPackTime drops the pack time of the directory once its metadata changes or it's removed
+func forgetPackTime(profilesDir string) {
+	ourPackTimesGuard.Lock()
+	defer ourPackTimesGuard.Unlock()
+	delete(ourPackTimes, profilesDir)
+}
+
+// withPackTimes returns copies of the written profiles with the time their latest archives took to pack.
+// Pack time isn't kept in the records themselves, since the archive metadata would change on every download
+func withPackTimes(profiles []prof) []prof {
+	ourPackTimesGuard.Lock()
+	defer ourPackTimesGuard.Unlock()
+	result := make([]prof, len(profiles))
+	for i, written := range profiles {
+		if took, ok := ourPackTimes[written.Dir]; ok {
+			timings := captureTimings{timingPack: took}
+			for step, stepTook := range written.Timings {
+				timings[step] = stepTook
+			}
+			written.Timings = timings
+		}
+		result[i] = written
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+package goprof
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureTimings(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	dir, err := startMockProfiling()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer removeWrittenProfile(dir)
+	doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	written := findWrittenProfile(dir)
+	if written == nil {
+		t.Fatalf("Expected the profile to be written")
+	}
+	for _, step := range []string{timingTraceStart, timingCPUStart, timingCPUStop, timingTraceStop, string(profileHeap)} {
+		if _, ok := written.Timings[step]; !ok {
+			t.Errorf("Expected %v to be timed, got %v", step, written.Timings)
+		}
+	}
+
+	recordPackTime(dir, time.Hour)
+	defer func() {
+		ourPackTimesGuard.Lock()
+		defer ourPackTimesGuard.Unlock()
+		delete(ourPackTimes, dir)
+	}()
+	listed := withPackTimes([]prof{*written})[0]
+	if listed.Timings[timingPack] != time.Hour {
+		t.Fatalf("Expected the pack time to be listed, got %v", listed.Timings)
+	}
+	if _, ok := written.Timings[timingPack]; ok {
+		t.Fatalf("Expected the pack time not to be kept in the record, so the archive metadata doesn't change")
+	}
+	if listed.CaptureTime() != written.CaptureTime() || listed.CaptureTime() >= time.Hour {
+		t.Fatalf("Expected the capture time not to include packing, got %v", listed.CaptureTime())
+	}
+	if err := removeWrittenProfile(dir); err != nil {
+		t.Fatalf("Failed to remove the profile: %v", err)
+	}
+	ourPackTimesGuard.Lock()
+	_, kept := ourPackTimes[dir]
+	ourPackTimesGuard.Unlock()
+	if kept {
+		t.Fatalf("Expected the pack time to be forgotten with the profile")
+	}
+}
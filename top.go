@@ -0,0 +1,127 @@
+package goprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+const defaultTopFunctions = 20
+
+// TopResponse lists functions with the highest cost in the profile
+type TopResponse struct {
+	OK         bool          `json:"ok"`
+	SampleType string        `json:"sample_type"` // e.g. "cpu" or "alloc_space"
+	Unit       string        `json:"unit"`        // e.g. "nanoseconds" or "bytes"
+	Total      int64         `json:"total"`
+	Items      []TopFunction `json:"items"`
+}
+
+// TopFunction is the cost of a function. Flat is spent in the function itself, Cum includes its callees as well
+type TopFunction struct {
+	Name        string  `json:"name"`
+	Flat        int64   `json:"flat"`
+	FlatPercent float64 `json:"flat_percent"`
+	Cum         int64   `json:"cum"`
+	CumPercent  float64 `json:"cum_percent"`
+}
+
+// handler returning top functions of the written profile as JSON. See requestedProfileDir and requestedProfile for the params,
+// 'sample' chooses sample type, 'n' limits number of functions (20 by default) and 'sort' is either 'flat' or 'cum'
+func showTopFunctions(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+
+	query := r.URL.Query()
+	limit := defaultTopFunctions
+	if n := query.Get("n"); n != "" {
+		var err error
+		if limit, err = strconv.Atoi(n); err != nil || limit <= 0 {
+			fatalError(w, r, fmt.Sprintf("Bad value for 'n' param: '%v'. Please, use positive number.", n))
+			return
+		}
+	}
+	sortBy := query.Get("sort")
+	if sortBy != "" && sortBy != "flat" && sortBy != "cum" {
+		fatalError(w, r, fmt.Sprintf("Bad value for 'sort' param: '%v'. Please, use flat or cum.", sortBy))
+		return
+	}
+	profilesDir, ok := requestedProfileDir(w, r)
+	if !ok {
+		return
+	}
+	p, err := requestedProfile(r, profilesDir)
+	if err != nil {
+		requestedProfileError(w, r, err)
+		return
+	}
+	index, err := sampleIndex(p, query.Get("sample"))
+	if err != nil {
+		fatalError(w, r, err.Error())
+		return
+	}
+	resp := topFunctions(p, index, sortBy == "cum")
+	if len(resp.Items) > limit {
+		resp.Items = resp.Items[:limit]
+	}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// topFunctions aggregates samples by function and returns all the functions ordered by flat or cumulative cost
+func topFunctions(p *profile.Profile, index int, byCum bool) TopResponse {
+	resp := TopResponse{
+		OK:         true,
+		SampleType: p.SampleType[index].Type,
+		Unit:       p.SampleType[index].Unit,
+		Items:      []TopFunction{},
+	}
+	functions := make(map[string]*TopFunction)
+	get := func(name string) *TopFunction {
+		if f, ok := functions[name]; ok {
+			return f
+		}
+		f := &TopFunction{Name: name}
+		functions[name] = f
+		return f
+	}
+	for _, sample := range p.Sample {
+		value := sample.Value[index]
+		resp.Total += value
+		stack := sampleStack(sample)
+		if len(stack) == 0 {
+			continue
+		}
+		get(stack[len(stack)-1]).Flat += value
+		// recursive functions appear in the stack several times, but their cumulative cost should be counted once
+		seen := make(map[string]bool, len(stack))
+		for _, name := range stack {
+			if !seen[name] {
+				seen[name] = true
+				get(name).Cum += value
+			}
+		}
+	}
+	for _, f := range functions {
+		if resp.Total != 0 {
+			f.FlatPercent = 100 * float64(f.Flat) / float64(resp.Total)
+			f.CumPercent = 100 * float64(f.Cum) / float64(resp.Total)
+		}
+		resp.Items = append(resp.Items, *f)
+	}
+	sort.Slice(resp.Items, func(i, j int) bool {
+		a, b := resp.Items[i], resp.Items[j]
+		if byCum && a.Cum != b.Cum {
+			return a.Cum > b.Cum
+		}
+		if a.Flat != b.Flat {
+			return a.Flat > b.Flat
+		}
+		return a.Name < b.Name
+	})
+	return resp
+}
@@ -0,0 +1,73 @@
+package goprof
+
+import (
+	"context"
+	"time"
+)
+
+// outcomes of profiling sessions which aren't stop reasons
+const (
+	outcomeWritten = "written" // one-off profile was dumped
+	outcomeFailed  = "failed"  // profiling failed to start or its profiles were lost
+)
+
+// ProfilingSession describes the profiling session its span ends with
+type ProfilingSession struct {
+	Profile  string
+	Dir      string // profiles directory, empty if profiling failed to start
+	Start    time.Time
+	Duration time.Duration
+	// stop reason, e.g. "manual" or "autostop", "written" for one-off profiles or "failed"
+	Outcome string
+	Error   string // why profiling failed
+}
+
+// ProfilingSpan is the span of a profiling session, e.g. OpenTelemetry span
+type ProfilingSpan interface {
+	// End is called once the session is over, the session attributes are set on the span before ending it
+	End(session ProfilingSession)
+}
+
+// ProfilingTracer creates spans of profiling sessions, so profiling shows up on distributed traces next to the
+// incidents it was started for. goprof doesn't depend on a tracing library, wrap yours, e.g. OpenTelemetry tracer,
+// into the interface
+type ProfilingTracer interface {
+	// Start is called when profiling is started. ctx carries the trace context of the request which started it,
+	// if any, so the span should be its child. Start is called with the profiling state locked, so it must be fast
+	Start(ctx context.Context, profile string) ProfilingSpan
+}
+
+// SetProfilingTracer sets the tracer creating a span for every profiling session from start to stop.
+// Nil disables tracing, which is the default
+func SetProfilingTracer(tracer ProfilingTracer) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourProfilingTracer = tracer
+}
+
+var (
+	ourProfilingTracer ProfilingTracer
+	// span of the profiling which is being written
+	ourProfilingSpan ProfilingSpan
+)
+
+// startProfilingSpan starts the span of the profiling session, it returns nil if tracing is disabled.
+// Should be called with ourProfilingStateGuard hold
+func startProfilingSpan(ctx context.Context, profile profName) ProfilingSpan {
+	if ourProfilingTracer == nil {
+		return nil
+	}
+	return ourProfilingTracer.Start(ctx, string(profile))
+}
+
+// endProfilingSpan ends the span of the session which was started at start, unless it's nil
+func endProfilingSpan(span ProfilingSpan, session ProfilingSession, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		session.Outcome = outcomeFailed
+		session.Error = err.Error()
+	}
+	span.End(session)
+}
@@ -0,0 +1,69 @@
+package goprof
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+type traceKey struct{}
+
+// recordingTracer keeps the sessions of ended spans and the trace the spans were started in
+type recordingTracer struct {
+	traces []interface{}
+	ended  []ProfilingSession
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+}
+
+func (t *recordingTracer) Start(ctx context.Context, profile string) ProfilingSpan {
+	t.traces = append(t.traces, ctx.Value(traceKey{}))
+	return recordingSpan{tracer: t}
+}
+
+func (s recordingSpan) End(session ProfilingSession) {
+	s.tracer.ended = append(s.tracer.ended, session)
+}
+
+func TestProfilingSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	SetProfilingTracer(tracer)
+	defer SetProfilingTracer(nil)
+	ctx := context.WithValue(context.Background(), traceKey{}, "request")
+
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	if _, err := startProfilingContext(ctx, "unknown", time.Minute); err == nil {
+		t.Fatalf("Expected unknown profile to fail")
+	}
+	dir, err := startProfilingContext(ctx, profileCPU, time.Minute)
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer removeWrittenProfile(dir)
+	if len(tracer.ended) != 1 {
+		t.Fatalf("Expected the span of running profiling not to end, got %#v", tracer.ended)
+	}
+	stopProfiling(stopManual)
+
+	if len(tracer.traces) != 2 || tracer.traces[0] != "request" || tracer.traces[1] != "request" {
+		t.Fatalf("Expected spans to be started in the trace of the request, got %#v", tracer.traces)
+	}
+	if len(tracer.ended) != 2 {
+		t.Fatalf("Expected 2 spans to end, got %#v", tracer.ended)
+	}
+	if failed := tracer.ended[0]; failed.Outcome != outcomeFailed || failed.Error == "" || failed.Dir != "" {
+		t.Errorf("Expected the span of failed profiling, got %#v", failed)
+	}
+	if stopped := tracer.ended[1]; stopped.Outcome != string(stopManual) || stopped.Dir != dir ||
+		stopped.Profile != string(profileCPU) || stopped.Duration <= 0 {
+		t.Errorf("Expected the span of stopped profiling, got %#v", stopped)
+	}
+	if ourProfilingSpan != nil {
+		t.Errorf("Expected the span to be forgotten once it's ended")
+	}
+}
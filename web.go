@@ -4,15 +4,25 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kardianos/osext"
@@ -22,67 +32,140 @@ const writtenProfilesRawTemplate = `<!doctype html>
 <html lang=en>
 <head>
 	<meta charset=utf-8>
-	<title>Profiling tools</title>
+	<title>Profiling tools{{ if .Title }} — {{ .Title }}{{ end }}</title>
+	<link rel="stylesheet" href="static/goprof.css">
 </head>
 <body>
-	{{ if .Message }}<p>{{ .Message }}</p>{{ end }}
+	<h1>Profiling tools{{ if .Title }} — {{ .Title }}{{ end }}</h1>
+	{{ if .Message }}<p class="message">{{ .Message }}</p>{{ end }}
 	{{ if .CurrentProfile }}
-		<p>Writing {{ .CurrentProfile.Prof }} profile to {{ .CurrentProfile.Dir }} <a href="toggle?enable=0">Stop</a>. Started <span id="started-ago"></span>.</p>
-		<script>
-		startedAgo = {{ .ProfileStartedSecondsAgo }};
-		updateStartedAgoUI = function() {
-		  sec = startedAgo % 60;
-		  min = Math.floor(startedAgo / 60);
-		  durationStr = "";
-		  if (min > 0) {durationStr+=min + "min";}
-		  if (sec > 0) {durationStr+=" " + sec + "sec";}
-		  if (durationStr === "") {durationStr="just now";}else{durationStr+=" ago";}
-		  document.getElementById("started-ago").innerHTML = durationStr;
-		}
-		updateStartedAgoUI();
-		window.setInterval(function(){
-		  updateStartedAgoUI();
-		  startedAgo++;
-		}, 1000);
-		</script>
+		<p>Writing {{ .CurrentProfile.Prof }} profile{{ with .CurrentProfile.Label }} "{{ . }}"{{ end }} to {{ .CurrentProfile.Dir }}{{ if not .ReadOnly }} <a href="toggle?enable=0">Stop</a> or <a href="abort">abort</a> throwing its profiles away{{ end }}. Started <span id="started-ago" data-started-ago="{{ .ProfileStartedSecondsAgo }}" data-dir="{{ .CurrentProfile.Dir }}"></span>.</p>
+		{{ if not .ReadOnly }}
+		<p>Write into this profile right now:
+		  {{ range .Profiles }}{{ if .OneOff }}
+		  <a href="toggle?enable=1&profile={{ .Name }}">{{ .Name }}</a>
+		  {{ end }}{{ end }}
+		  {{ with .CurrentProfile.Dumps }}({{ len . }} written so far){{ end }}
+		</p>
+		{{ end }}
+		{{ if .LiveTrace }}
+		<p><a href="{{ liveTrace .CurrentProfile.Dir }}">Stream the trace</a> as it's written, it can be opened once profiling stops.</p>
+		{{ end }}
+		{{ if .AutostopDisarmed }}
+		<p>Autostop is cancelled, profiling lasts until it's stopped.</p>
+		{{ else if .ReadOnly }}
+		<p>Stops automatically in {{ .AutostopSecondsLeft }}sec.</p>
+		{{ else }}
+		<p>Stops automatically in {{ .AutostopSecondsLeft }}sec.
+		  <a href="extend-autostop?seconds=300">Extend by 5min</a> or
+		  <a href="cancel-autostop">cancel autostop</a> to keep profiling until you stop it.</p>
+		{{ end }}
 	{{ else }}
-		<p>Start profiling:
-		  <a href="toggle?enable=1&profile=all">all</a>
-		  <a href="toggle?enable=1&profile=cpu">cpu</a>
-		  <a href="toggle?enable=1&profile=heap">heap (allocations since last gc)</a>
-		  <a href="toggle?enable=1&profile=trace">trace</a>
-		  <a href="toggle?enable=1&profile=goroutine">goroutine</a>
-		  <a href="toggle?enable=1&profile=threadcreate">threadcreate</a>
-		  <a href="toggle?enable=1&profile=block">block</a>
+		{{ if not .ReadOnly }}
+		<p class="start-links">Start profiling:
+		  {{ range .Profiles }}
+		  <a href="toggle?enable=1&profile={{ .Name }}{{ if .Duration }}&seconds={{ seconds .Duration }}{{ end }}">{{ .Name }} ({{ .Description }}{{ if .Duration }}, {{ .Duration }}{{ end }})</a>{{ if .Overhead.Percent }} ~{{ .Overhead.Percent }}% cpu{{ end }}{{ with .Overhead.Warning }} <b>{{ . }}</b>{{ end }}
+		  {{ end }}
 		</p>
+		{{ end }}
+		<p>Block profile rate: {{ .Rates.BlockProfileRate }}{{ if not .Rates.BlockProfileRate }} (block profile is empty){{ end }},
+		  mutex profile fraction: {{ .Rates.MutexProfileFraction }}{{ if not .Rates.MutexProfileFraction }} (mutex profile is empty){{ end }},
+		  heap profile samples every {{ .Rates.MemProfileRate }} bytes.</p>
+	{{ end }}
+	{{ range .Armed }}
+	<p class="armed">{{ .Profile }} profile is armed with rate {{ .Rate }} since {{ .Since.Format "15:04:05" }}{{ if not $.ReadOnly }}:
+	  <a href="capture?profile={{ .Profile }}&disarm=1">capture and disarm it</a>{{ end }}.</p>
+	{{ end }}
+	{{ if and .FlightRecorder (not .ReadOnly) }}
+	<p>Flight recorder is running: <a href="flight-trace">write the trace of the last moments</a>.</p>
 	{{ end }}
 	<p>
 	Written profiles:
-	<ul>
+	<ul class="written-profiles">
 	{{ range .WrittenProfiles }}
     	<li><a href="{{ download .Dir }}">
-          {{ .Prof }}
+          {{ with .Name }}{{ . }}: {{ end }}{{ .Prof }}{{ with .Label }} "{{ . }}"{{ end }}
           {{ if .Prof.OneOff }}
-            ({{.Start}})
+            ({{.Start}}{{ with .Panic }}, panicked: {{ . }}{{ end }})
           {{ else }}
-            (lasted for {{.Duration}} since {{.Start}})
+            (lasted for {{.Duration}} since {{.Start}}{{ with .Variant }}, variant {{ . }}{{ end }}{{ with .StopReason }}, stopped: {{ . }}{{ end }}{{ with .Dumps }}, {{ len . }} one-off profiles written meanwhile{{ end }})
           {{ end }}
+          {{ with .CaptureTime }}captured in {{ . }}{{ end }}
     	</a>
+    	<a href="{{ downloadTar .Dir }}">uncompressed</a>
+    	{{ if .Prof.HasPprof }}<a href="{{ flamegraph .Dir }}">flame graph</a>{{ end }}
     {{ else }}
       <li>none
 	{{ end }}
 	</ul>
+	{{ if and .WrittenProfiles (not .ReadOnly) }}<form method="post" action="clear"><button type="submit">Remove all written profiles</button></form>{{ end }}
+	{{ if .NextPageURL }}<a href="{{ .NextPageURL }}">more</a> ({{ .TotalProfiles }} in total){{ end }}
+	</p>
+	{{ if .FailedAttempts }}
+	<p>
+	Failed profilings:
+	<ul class="failed-attempts">
+	{{ range .FailedAttempts }}
+		<li>{{ .Prof }} at {{ .Time }}: {{ .Error }}
+	{{ end }}
+	</ul>
 	</p>
+	{{ end }}
+	<script src="static/goprof.js"></script>
 </body>
 </html>`
 
 const showWebScriptTpl = `#!/bin/bash
 cd $(dirname $0)
-go tool pprof -web {{bin}} {{profile}}`
+{{command}}`
+
+// showRemoteScriptTpl uploads the profile to the pprof server set with SetPprofServer and opens the view
+// the server responds with
+const showRemoteScriptTpl = `#!/bin/bash
+cd $(dirname $0)
+url=$(curl -fsS --data-binary @{{profile}} {{server}}) || exit 1
+echo "$url"
+if command -v xdg-open >/dev/null; then xdg-open "$url"; elif command -v open >/dev/null; then open "$url"; fi
+`
+
+// defaultShowWebCommand is used by show-web script unless another command is set with SetShowWebCommand
+const defaultShowWebCommand = "go tool pprof -web {{bin}} {{profile}}"
 
 type ProfileListResponse struct {
-	OK    bool   `json:"ok"`
-	Items []prof `json:"items"`
+	OK      bool                  `json:"ok"`
+	Items   []prof                `json:"items"`
+	Total   int                   `json:"total"` // number of written profiles, items may contain only part of them
+	Current *CurrentProfileStatus `json:"current,omitempty"`
+	Rates   ProfileRates          `json:"rates"`
+	Armed   []ArmedProfile        `json:"armed"` // block and mutex profiles armed with the arm handler
+	// flight recorder is started, so its trace can be written with flight-trace handler
+	FlightRecorder bool `json:"flight_recorder"`
+	// profilings which failed to start or were aborted, the oldest first
+	FailedAttempts []failedAttempt `json:"failed_attempts"`
+}
+
+// ProfileTypesResponse lists profiles which can be started
+type ProfileTypesResponse struct {
+	OK    bool          `json:"ok"`
+	Items []ProfileInfo `json:"items"`
+}
+
+// ClearResponse tells how many written profiles were removed and why others weren't
+type ClearResponse struct {
+	OK      bool     `json:"ok"`
+	Removed int      `json:"removed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// CurrentProfileStatus describes the profile which is being written right now
+type CurrentProfileStatus struct {
+	prof
+	ElapsedSeconds   int  `json:"elapsed_seconds"`
+	Autostop         bool `json:"autostop"`          // false if autostop was cancelled and profiling lasts until it's stopped manually
+	RemainingSeconds int  `json:"remaining_seconds"` // how long is left until profiling is stopped automatically
+	AutostopWarning  bool `json:"autostop_warning"`  // autostop is closer than the warning set with SetAutostopWarning
+	// how much the running profile slows the process down
+	Overhead ProfilingOverhead `json:"overhead"`
 }
 
 type SimpleResponse struct {
@@ -90,18 +173,191 @@ type SimpleResponse struct {
 	ErrorMessage string `json:"error_message,omitempty"`
 }
 
+// ToggleResponse is returned by toggle handler when profiling is started or stopped. Dir is the directory
+// of the profile, DownloadURL is the link to its archive relative to the profiling page.
+// The profile which is being written can't be downloaded until it's stopped
+type ToggleResponse struct {
+	OK          bool   `json:"ok"`
+	Dir         string `json:"dir"`
+	DownloadURL string `json:"download_url"`
+}
+
+const copyBufferSize = 32 * 1024
+
+// metadataFileName is the file in profiles directories and downloaded archives describing the profile,
+// e.g. how the process was run
+const metadataFileName = "metadata.json"
+
 var (
-	writtenProfilesTemplate = template.Must(template.New("profiles").Funcs(template.FuncMap{
-		"download": formatDownloadURL,
-	}).Parse(writtenProfilesRawTemplate))
+	writtenProfilesTemplate = template.Must(template.New("profiles").Funcs(TemplateFuncs()).Parse(writtenProfilesRawTemplate))
+	// downloads usually happen in bursts when the process is already under memory pressure,
+	// so we reuse buffers for archives and for copying files into them instead of allocating new ones every time
+	archiveBufferPool = sync.Pool{
+		New: func() interface{} {
+			return &bytes.Buffer{}
+		},
+	}
+	// in-flight downloads, so shutdown can wait for them
+	ourDownloads   sync.WaitGroup
+	copyBufferPool = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		},
+	}
 )
 
+// PageData is passed to the template rendering profiling page, see SetTemplate
+type PageData struct {
+	Title                    string
+	WrittenProfiles          []prof
+	TotalProfiles            int          // number of all written profiles, WrittenProfiles may contain only part of them
+	NextPageURL              template.URL // link to the next part of written profiles, empty if there are no more
+	CurrentProfile           *prof
+	AutostopDisarmed         bool // current profile won't be stopped automatically
+	AutostopSecondsLeft      int
+	Message                  string
+	ProfileStartedSecondsAgo int
+	Rates                    ProfileRates
+	Armed                    []ArmedProfile  // block and mutex profiles armed with the arm handler
+	Profiles                 []ProfileInfo   // profiles which can be started
+	FlightRecorder           bool            // flight recorder is started, so its trace can be written
+	FailedAttempts           []failedAttempt // profilings which failed to start or were aborted, the oldest first
+	ReadOnly                 bool            // the page is served by NewReadOnlyHandler, so profiling can't be controlled
+	LiveTrace                bool            // current profile writes trace, so it can be streamed while it's written
+}
+
+// pageParams describe which part of written profiles should be shown
+type pageParams struct {
+	offset int
+	limit  int    // zero means no limit
+	sort   string // "asc" or "desc" by start time, empty keeps the order profiles were written in
+}
+
+func parsePageParams(query url.Values) (params pageParams, err error) {
+	if offset := query.Get("offset"); offset != "" {
+		if params.offset, err = strconv.Atoi(offset); err != nil || params.offset < 0 {
+			return pageParams{}, fmt.Errorf("bad value for 'offset' param: '%v'", offset)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if params.limit, err = strconv.Atoi(limit); err != nil || params.limit < 0 {
+			return pageParams{}, fmt.Errorf("bad value for 'limit' param: '%v'", limit)
+		}
+	}
+	switch params.sort = query.Get("sort"); params.sort {
+	case "", "asc", "desc": // ok
+	default:
+		return pageParams{}, fmt.Errorf("bad value for 'sort' param: '%v'. Please, use asc or desc", params.sort)
+	}
+	return params, nil
+}
+
+// page returns a copy of the requested part of profiles
+func (p pageParams) page(profiles []prof) []prof {
+	sorted := make([]prof, len(profiles))
+	copy(sorted, profiles)
+	switch p.sort {
+	case "asc":
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+	case "desc":
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start.After(sorted[j].Start) })
+	}
+	if p.offset >= len(sorted) {
+		return []prof{}
+	}
+	sorted = sorted[p.offset:]
+	if p.limit > 0 && p.limit < len(sorted) {
+		sorted = sorted[:p.limit]
+	}
+	return sorted
+}
+
+// nextPageURL returns empty string if the page contains the last profile
+func (p pageParams) nextPageURL(total int) template.URL {
+	if p.limit == 0 || p.offset+p.limit >= total {
+		return ""
+	}
+	query := url.Values{}
+	query.Set("offset", strconv.Itoa(p.offset+p.limit))
+	query.Set("limit", strconv.Itoa(p.limit))
+	if p.sort != "" {
+		query.Set("sort", p.sort)
+	}
+	return template.URL("?" + query.Encode())
+}
+
+// TemplateFuncs returns functions available in the built-in template. Custom templates should be parsed with them
+//
+//	template.New("profiles").Funcs(goprof.TemplateFuncs()).Parse(src)
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"download":    formatDownloadURL,
+		"downloadTar": formatTarDownloadURL,
+		"flamegraph":  formatFlameGraphURL,
+		"liveTrace":   formatLiveTraceURL,
+		"seconds":     formatSeconds,
+	}
+}
+
+// formatSeconds formats the duration as whole seconds accepted by 'seconds' param of the toggle handler.
+// It rounds up, so profiling started with the link doesn't stop earlier than configured
+func formatSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
 func formatDownloadURL(path string) string {
-	return fmt.Sprintf("download/%s.tgz?path=%s", filepath.Base(path), path)
+	return fmt.Sprintf("download/%s.tgz?path=%s", archiveName(path), path) + pageLinkSignature(path)
+}
+
+// formatTarDownloadURL links to the archive without gzip, traces are compressed already and gzip barely helps them
+func formatTarDownloadURL(path string) string {
+	return fmt.Sprintf("download/%s.tar?path=%s&compression=none", archiveName(path), path) + pageLinkSignature(path)
+}
+
+// formatLiveTraceURL links to the trace of running profiling which is streamed until profiling stops
+func formatLiveTraceURL(path string) string {
+	return "live-trace?follow=1" + pageLinkSignature(path)
+}
+
+// pageLinkSignature returns params signing the download link shown on the page, empty if downloads aren't signed.
+// Should be called with ourProfilingStateGuard hold
+func pageLinkSignature(path string) string {
+	if len(ourConfig.downloadSecret) == 0 {
+		return ""
+	}
+	return "&" + signDownload(path, time.Now().Add(pageLinkTTL))
 }
 
+// archiveName returns the name of the downloaded archive without extension, it starts with the hostname if configured.
+// Should be called with ourProfilingStateGuard hold
+func archiveName(profilesDir string) string {
+	name := filepath.Base(profilesDir)
+	if !ourConfig.hostnameInArchiveNames {
+		return name
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		logf("Failed to get hostname for the archive name: %v", err)
+		return name
+	}
+	return hostname + "-" + name
+}
+
+func formatFlameGraphURL(path string) string {
+	return fmt.Sprintf("flamegraph?path=%s", url.QueryEscape(path)) + pageLinkSignature(path)
+}
+
+// isJsonRequest tells whether the client wants JSON response: it asked with 'json=1' param or Accept header,
+// or all the responses are JSON by default, see SetJSONByDefault. 'json=0' asks for HTML anyway
 func isJsonRequest(r *http.Request) bool {
-	if r.URL.Query().Get("json") == "1" {
+	switch r.URL.Query().Get("json") {
+	case "1":
+		return true
+	case "0":
+		return false
+	}
+	if ourJSONByDefault.Load() {
 		return true
 	}
 
@@ -114,51 +370,77 @@ func isJsonRequest(r *http.Request) bool {
 	return ok
 }
 
+// Handlers respond with the same status codes to JSON and HTML requests:
+// 200 on success, 400 for malformed params, 403 for actions forbidden here, 404 for unknown profiles
+// and missing directories, 409 when the action doesn't fit the profiling state (e.g. starting profiling
+// while it's running or stopping it when it's stopped), 500 when writing or packing profiles fails
+
+// fatalError responds to malformed request with 400
 func fatalError(w http.ResponseWriter, r *http.Request, errorMessage string) {
-	w.WriteHeader(http.StatusBadRequest)
+	writeError(w, r, http.StatusBadRequest, errorMessage)
+}
 
+// internalError responds with 500 when the request is fine, but serving it failed
+func internalError(w http.ResponseWriter, r *http.Request, errorMessage string) {
+	writeError(w, r, http.StatusInternalServerError, errorMessage)
+}
+
+// setJSONHeaders marks the response as JSON, which shows the current state and so mustn't be cached
+func setJSONHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	setNoStore(w)
+}
+
+// setNoStore forbids browsers and proxies to cache the response, otherwise the page may show profiling
+// which is already stopped until it's reloaded bypassing the cache. Pragma and Expires are for HTTP/1.0 caches
+func setNoStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+}
+
+// writeError responds with the error as JSON or plain text, unlike flashError it doesn't render the page
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
 	if isJsonRequest(r) {
-		w.Header().Add("Content-Type", "application/json")
-		encoder := json.NewEncoder(w)
-		res := SimpleResponse{
+		setJSONHeaders(w)
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(SimpleResponse{
 			OK:           false,
 			ErrorMessage: errorMessage,
-		}
-		encoder.Encode(res)
+		})
 	} else {
-		http.Error(w, errorMessage, http.StatusBadRequest)
+		http.Error(w, errorMessage, statusCode)
 	}
 }
 
-func flashError(w http.ResponseWriter, r *http.Request, errorMessage string) {
-	w.WriteHeader(http.StatusBadRequest)
-
+// flashError responds with the error as JSON or renders the page showing the error.
+// Should be called with ourProfilingStateGuard hold
+func flashError(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
 	if isJsonRequest(r) {
-		w.Header().Add("Content-Type", "application/json")
-		encoder := json.NewEncoder(w)
-		encoder.Encode(SimpleResponse{
-			OK: false,
-			ErrorMessage: errorMessage,
-		})
+		writeError(w, r, statusCode, errorMessage)
 	} else {
-		renderPage(w, errorMessage)
+		renderPage(w, r, statusCode, errorMessage)
 	}
 }
 
 func success(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
 	if isJsonRequest(r) {
+		setJSONHeaders(w)
 		encoder := json.NewEncoder(w)
 		encoder.Encode(SimpleResponse{
 			OK: true,
 		})
 	} else {
-		w.Header().Add("Content-Type", "text/html")
-		renderPage(w, "")
+		renderPage(w, r, http.StatusOK, "")
 	}
 }
 
 // handler for toggling profiling. Expects mandatory parameter 'enable' which should be either '0' or '1'
+// Responds with 400 if 'enable' is malformed and with 404 if 'profile' isn't a known profile type
+// With 'validate=1' and 'enable=1' it only checks whether profiling can be started and doesn't start anything
+// Optional 'seconds' sets how long profiling runs until autostop instead of the duration configured for the profile
+// Optional 'variant' labels the profile with the build or deploy it's taken for, so variants can be compared
+// Optional 'dir' is the directory profiles are written into instead of a new temp one, see SetCaptureDirs
 func toggleProfiling(w http.ResponseWriter, r *http.Request) {
 	ourProfilingStateGuard.Lock()
 	defer ourProfilingStateGuard.Unlock()
@@ -171,195 +453,1319 @@ func toggleProfiling(w http.ResponseWriter, r *http.Request) {
 	}
 
 	enableProfiling := enableParam == "1"
+	if enableProfiling && query.Get("validate") == "1" {
+		if err := validateProfiling(profName(query.Get("profile")), query.Get("dir")); err != nil {
+			flashError(w, r, errorStatus(err), fmt.Sprintf("Profiling cannot be started: %v", err))
+			return
+		}
+		success(w, r)
+		return
+	}
 	var dir string
 	var err error
 	if enableProfiling {
 		profile := profName(query.Get("profile"))
-		dir, err = startProfiling(profile)
+		duration := profileDuration(profile)
+		if secondsParam := query.Get("seconds"); secondsParam != "" {
+			seconds, err := strconv.Atoi(secondsParam)
+			if err != nil || seconds <= 0 {
+				fatalError(w, r, fmt.Sprintf("Bad value for 'seconds' param: '%v'. Please, use positive number.", secondsParam))
+				return
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		// one-off profile requested during profiling is written into its directory, don't relabel it
+		labelVariant := !profilingInProgress()
+		dir, err = startProfilingIn(r.Context(), profile, duration, query.Get("dir"))
+		if variant := query.Get("variant"); err == nil && variant != "" && labelVariant {
+			setVariant(dir, variant)
+		}
+		if err == nil && !profile.OneOff() && ourConfig.idleTimeout > 0 {
+			watchIdle(dir, ourConfig.idleTimeout)
+		}
 	} else {
-		dir = stopProfiling()
+		dir = stopProfilingContext(r.Context(), stopManual)
 	}
 	if err != nil {
-		flashError(w, r, fmt.Sprintf("Failed to toggle profiling (enable=%v): %v", enableProfiling, err))
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to toggle profiling (enable=%v): %v", enableProfiling, err))
 		return
 	}
 
 	if enableProfiling {
-		success(w, r)
+		toggled(w, r, dir)
 		return
 	}
 	if dir == "" {
-		flashError(w, r,"Seems profiling already stopped")
+		flashError(w, r, http.StatusConflict, "Seems profiling already stopped")
+		return
+	}
+	toggled(w, r, dir)
+}
+
+// toggled responds to JSON request with the directory of the started or stopped profile, so clients can download
+// it without looking it up in the list of profiles
+func toggled(w http.ResponseWriter, r *http.Request, profilesDir string) {
+	if !isJsonRequest(r) {
+		renderPage(w, r, http.StatusOK, "")
+		return
+	}
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(ToggleResponse{
+		OK:          true,
+		Dir:         profilesDir,
+		DownloadURL: formatDownloadURL(profilesDir),
+	})
+}
+
+// errorStatus returns the status of the response to the failed profiling action: 404 when unknown profile
+// was requested, 409 when the action doesn't fit the profiling state, 403 when the directory isn't allowed,
+// 429 when the capture budget is spent and 500 otherwise
+func errorStatus(err error) int {
+	switch err.(type) {
+	case unknownProfileError:
+		return http.StatusNotFound
+	case stateError:
+		return http.StatusConflict
+	case forbiddenDirError:
+		return http.StatusForbidden
+	case budgetError:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// handler writing the trace kept by flight recorder as a new written profile
+func flightTraceHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	if _, err := writeFlightTrace(); err != nil {
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to write flight recorder trace: %v", err))
+		return
+	}
+	success(w, r)
+}
+
+// handler writing one-off profiles into the directory of the running profiling without stopping it.
+// Optional 'profile' parameter chooses the one-off profile, all of them are written by default.
+// Optional 'label' parameter is kept along with the dump, e.g. to tell which event it correlates to
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	query := r.URL.Query()
+	profile := profName(query.Get("profile"))
+	if profile == "" {
+		profile = profileSnapshot
+	}
+	if err := checkProfileName(profile); err != nil {
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to write snapshot: %v", err))
+		return
+	}
+	if !profile.OneOff() {
+		flashError(w, r, http.StatusBadRequest, fmt.Sprintf("Failed to write snapshot: %v profile isn't one-off", profile))
+		return
+	}
+	if _, err := doAppendProfile(profile, query.Get("label"), dumpProfileTo); err != nil {
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to write snapshot: %v", err))
+		return
+	}
+	success(w, r)
+}
+
+// handler labeling the profile with 'label' param, e.g. once it's clear what the profile taken during an incident
+// shows. It labels the running profile, or the written one if 'path' param is passed. Empty 'label' removes it
+func labelProfile(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	query := r.URL.Query()
+	label := query.Get("label")
+	if len(label) > maxLabelLength {
+		fatalError(w, r, fmt.Sprintf("Label is too long, it should be up to %d bytes", maxLabelLength))
+		return
+	}
+	profilesDir := query.Get("path")
+	if profilesDir != "" {
+		profilesDir = filepath.Clean(profilesDir)
+	}
+	if err := setLabel(profilesDir, label); err != nil {
+		status := errorStatus(err)
+		if _, ok := err.(notWrittenProfileError); ok {
+			status = http.StatusNotFound
+		}
+		flashError(w, r, status, fmt.Sprintf("Failed to label the profile: %v", err))
+		return
+	}
+	success(w, r)
+}
+
+// maxLabelLength keeps labels short enough to be shown in the list of profiles
+const maxLabelLength = 200
+
+// handler naming the written profile in 'path' with 'name' param, e.g. "baseline" or "after-fix", so captures
+// of a long debugging session are easy to tell apart. Empty 'name' removes it
+func renameProfileHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	query := r.URL.Query()
+	name := query.Get("name")
+	if len(name) > maxNameLength {
+		fatalError(w, r, fmt.Sprintf("Name is too long, it should be up to %d bytes", maxNameLength))
+		return
+	}
+	profilesDir := query.Get("path")
+	if profilesDir == "" {
+		fatalError(w, r, "No such profile (param 'path' is mandatory)")
+		return
+	}
+	if err := renameProfile(filepath.Clean(profilesDir), name); err != nil {
+		status := errorStatus(err)
+		if _, ok := err.(notWrittenProfileError); ok {
+			status = http.StatusNotFound
+		}
+		flashError(w, r, status, fmt.Sprintf("Failed to rename the profile: %v", err))
 		return
 	}
 	success(w, r)
 }
 
+// maxNameLength keeps names short enough to organize profiles with
+const maxNameLength = 64
+
+// handler stopping the running profiling and throwing its profiles away, for emergencies when the profiling itself
+// hurts the process, e.g. a runaway trace. Nothing is dumped on stop and the profile isn't listed as written
+func abortProfilingHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	if abortProfiling() == "" {
+		flashError(w, r, http.StatusConflict, "Failed to abort profiling: profiling is not in progress")
+		return
+	}
+	success(w, r)
+}
+
+// handler for cancelling autostop of the running profiling. Profiling keeps running until it's stopped manually
+func cancelAutostopHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	if err := disarmAutostop(); err != nil {
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to cancel autostop: %v", err))
+		return
+	}
+	logf("Autostop of writing profiles to '%s' is cancelled", ourCurrentProfile.Dir)
+	success(w, r)
+}
+
+// handler for moving autostop of the running profiling. Expects mandatory parameter 'seconds'
+// which tells how much longer profiling should last
+func extendAutostopHandler(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	secondsParam := r.URL.Query().Get("seconds")
+	seconds, err := strconv.Atoi(secondsParam)
+	if err != nil || seconds <= 0 {
+		fatalError(w, r, fmt.Sprintf("Bad value for mandatory 'seconds' param: '%v'. Please, use positive number.", secondsParam))
+		return
+	}
+	if err := extendAutostop(time.Duration(seconds) * time.Second); err != nil {
+		flashError(w, r, errorStatus(err), fmt.Sprintf("Failed to extend profiling: %v", err))
+		return
+	}
+	logf("Writing profiles to '%s' is extended until %v", ourCurrentProfile.Dir, ourAutostopDeadline)
+	if isJsonRequest(r) {
+		setJSONHeaders(w)
+		json.NewEncoder(w).Encode(ProfileListResponse{
+			OK:      true,
+			Items:   []prof{},
+			Total:   len(ourWrittenProfiles),
+			Current: currentProfileStatus(),
+		})
+		return
+	}
+	success(w, r)
+}
+
+// handler listing profiles which can be started, so clients don't have to hard-code them
+func showProfileTypes(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	setJSONHeaders(w)
+	json.NewEncoder(w).Encode(ProfileTypesResponse{
+		OK:    true,
+		Items: profileInfos(),
+	})
+}
+
+// handler for removing all the written profiles from disk. The profile which is being written isn't touched.
+// Accepts only POST requests
+func clearProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		flashError(w, r, http.StatusMethodNotAllowed, "Written profiles can be cleared only with POST request")
+		return
+	}
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+
+	removed, errs := clearWrittenProfiles()
+	resp := ClearResponse{OK: len(errs) == 0, Removed: removed}
+	for _, err := range errs {
+		resp.Errors = append(resp.Errors, err.Error())
+	}
+	if isJsonRequest(r) {
+		setJSONHeaders(w)
+		if !resp.OK {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	msg, status := fmt.Sprintf("Removed %d profiles", removed), http.StatusOK
+	if len(errs) > 0 {
+		msg += fmt.Sprintf(", failed to remove %d: %v", len(errs), strings.Join(resp.Errors, "; "))
+		status = http.StatusInternalServerError
+	}
+	renderPage(w, r, status, msg)
+}
 
 // handler for downloading written profile files and binary as a single tar.gz archive
-// Expects 'path' parameter to point to existing directory with profiles
+// Expects 'path' parameter to point to a written profile or to a directory within SetDownloadDirs, otherwise
+// it responds with 403. Optional 'binary' parameter set to '0'
+// excludes the binary if all the profiles have symbols, '1' includes it no matter what SetArchiveBinary says
+// Optional 'compression' parameter set to 'none' serves plain tar instead of tar.gz
 // If any file is not found (binary or any of profiles) it returns an error
+// With CleanupOnDownload policy the profile is removed from disk once the archive is sent, unless it's downloaded
+// with the read-only handler, as viewers can't remove profiles
 func downloadProfile(w http.ResponseWriter, r *http.Request) {
+	ourDownloads.Add(1)
+	defer ourDownloads.Done()
 	// check mandatory param
 	profilesDir := r.URL.Query().Get("path")
 	if profilesDir == "" {
 		fatalError(w, r, "No such profile (param 'path' is mandatory)")
 		return
 	}
+	// the profile is removed with the lock hold exclusively, so it happens after we release the read lock below
+	removeAfterDownload := false
+	defer func() {
+		if removeAfterDownload {
+			ourProfilingStateGuard.Lock()
+			defer ourProfilingStateGuard.Unlock()
+			if err := removeWrittenProfile(profilesDir); err != nil {
+				logf("Failed to remove downloaded profile: %v", err)
+			}
+		}
+	}()
 	// check that we aren't writing the profile at the moment
 	ourProfilingStateGuard.RLock()
 	defer ourProfilingStateGuard.RUnlock()
-	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
-		flashError(w, r, "We write the requested profile at the moment. Stop it first, then you will be able to download it")
+	profilesDir = filepath.Clean(profilesDir)
+	if err := checkDownloadSignature(profilesDir, r.URL.Query()); err != nil {
+		flashError(w, r, http.StatusForbidden, fmt.Sprintf("Cannot download '%v': %v", profilesDir, err))
+		return
+	}
+	if _, ok := checkReadableDir(w, r, profilesDir); !ok {
 		return
+	}
+	// files of written profiles never change, only their metadata does when they are labeled or renamed,
+	// so the client can reuse the archive it has already downloaded until then
+	var modTime time.Time
+	written := findWrittenProfile(profilesDir)
+	if written != nil {
+		modTime = written.Start.Add(written.Duration)
+		if metadataInfo, err := os.Stat(filepath.Join(profilesDir, metadataFileName)); err == nil && metadataInfo.ModTime().After(modTime) {
+			modTime = metadataInfo.ModTime()
+		}
+	}
+	withBinary := !ourConfig.archiveWithoutBinary
+	switch r.URL.Query().Get("binary") {
+	case "0":
+		withBinary = false
+	case "1":
+		withBinary = true
+	}
+	opts := newArchiveOptions(withBinary)
+	switch compression := r.URL.Query().Get("compression"); compression {
+	case "", "gzip":
+	case "none":
+		opts.uncompressed = true
+	default:
+		fatalError(w, r, fmt.Sprintf("Bad value for 'compression' param: '%v'. Please, use gzip or none", compression))
+		return
+	}
+	if written != nil {
+		if err := opts.setMetadata(*written); err != nil {
+			internalError(w, r, fmt.Sprintf("Failed to encode metadata: %v", err))
+			return
+		}
+	}
+	// extra files may change on every download, e.g. recent logs, so such archives are never reused. Neither are
+	// archives of directories goprof didn't write, their files may be rewritten without changing the directory
+	etag := ""
+	if opts.extras == nil && written != nil {
+		etag = profileETag(profilesDir, modTime, opts)
+	}
+	if etag != "" && notModified(r, etag, modTime) {
+		setCacheHeaders(w, etag, modTime)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// pack archive and send it to the client. A huge directory on a slow disk shouldn't hang the handler forever
+	ctx := r.Context()
+	if ourConfig.archiveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ourConfig.archiveTimeout)
+		defer cancel()
+	}
+	packStart := time.Now()
+	archive, err := packProfilesContext(ctx, profilesDir, opts)
+	// directories within the download directories aren't listed, so their pack times would never be forgotten
+	if err == nil && findWrittenProfile(profilesDir) != nil {
+		recordPackTime(profilesDir, time.Since(packStart))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		flashError(w, r, http.StatusGatewayTimeout,
+			fmt.Sprintf("Packing profiles took longer than %v, try again later or download the files directly", ourConfig.archiveTimeout))
+		return
+	}
+	if tooLarge, ok := err.(archiveTooLargeError); ok {
+		flashError(w, r, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("The archive is larger than the limit of %d bytes, try downloading it without the binary or download the files directly", tooLarge.maxBytes))
+		return
+	}
+	if err != nil {
+		internalError(w, r, fmt.Sprintf("Failed to pack profiles: %v", err))
+		return
+	}
+	defer releaseArchiveBuffer(archive)
+	if etag != "" {
+		setCacheHeaders(w, etag, modTime)
+	} else {
+		setNoStore(w)
+	}
+	if ourConfig.closeAfterDownload {
+		w.Header().Set("Connection", "close")
+	}
+	if opts.uncompressed {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName(profilesDir) + ".tar"}))
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archiveName(profilesDir) + ".tgz"}))
+	}
+	// the status is sent already, so the client can only notice the cut archive
+	if _, err = io.Copy(w, archive); err != nil {
+		logf("Failed to serve archive: %v", err)
+		return
+	}
+	removeAfterDownload = ourConfig.cleanupPolicy == CleanupOnDownload && !isReadOnly(r) && findWrittenProfile(profilesDir) != nil
+}
 
+// binarySignedName is signed instead of a profiles directory in links to /binary. It isn't a cleaned absolute path,
+// so its signature can't be used for downloading profiles
+const binarySignedName = "binary"
+
+// handler serving the binary alone, so clients downloading many profiles fetch it once and download archives
+// with binary=0
+func downloadBinary(w http.ResponseWriter, r *http.Request) {
+	ourDownloads.Add(1)
+	defer ourDownloads.Done()
+	// the binary may take long to serve to a slow client, so the lock isn't hold meanwhile
+	ourProfilingStateGuard.RLock()
+	if err := checkDownloadSignature(binarySignedName, r.URL.Query()); err != nil {
+		flashError(w, r, http.StatusForbidden, fmt.Sprintf("Cannot download the binary: %v", err))
+		ourProfilingStateGuard.RUnlock()
+		return
 	}
-	// check that the param is an accessible directory
-	fileInfo, err := os.Stat(profilesDir)
+	binaryPath, closeAfterDownload := ourConfig.binaryPath, ourConfig.closeAfterDownload
+	ourProfilingStateGuard.RUnlock()
+	binary, err := executablePath(binaryPath)
 	if err != nil {
-		fatalError(w, r, fmt.Sprintf("Cannot stat '%v': %v", profilesDir, err))
+		internalError(w, r, fmt.Sprintf("Failed to find the binary: %v", err))
 		return
 	}
-	if !fileInfo.IsDir() {
-		fatalError(w, r,  fmt.Sprintf("Expecting '%v' to be a directory, but it is not", profilesDir))
+	file, err := os.Open(binary)
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("No such binary: '%v'", binary))
 		return
 	}
-	// pack archive and send it to the client
-	archive, err := packProfiles(profilesDir)
 	if err != nil {
-		fatalError(w, r, fmt.Sprintf("Failed to pack profiles: %v", err))
+		internalError(w, r, fmt.Sprintf("Failed to open the binary: %v", err))
 		return
 	}
-	_, err = io.Copy(w, archive)
+	defer file.Close()
+	fileInfo, err := file.Stat()
 	if err != nil {
-		fatalError(w, r, fmt.Sprintf( "Failed serve archive: %v", err))
+		internalError(w, r, fmt.Sprintf("Cannot stat '%v': %v", binary, err))
 		return
 	}
+	if closeAfterDownload {
+		w.Header().Set("Connection", "close")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(binary)}))
+	// ServeContent handles ranges and If-Modified-Since, so interrupted and repeated downloads are cheap
+	http.ServeContent(w, r, filepath.Base(binary), fileInfo.ModTime(), file)
+}
+
+// checkReadableDir responds with an error unless the client may read the cleaned profiles directory, see readableDir.
+// Returns info of the directory and true if it may be read. Should be called with ourProfilingStateGuard hold
+func checkReadableDir(w http.ResponseWriter, r *http.Request, profilesDir string) (os.FileInfo, bool) {
+	fileInfo, err := readableDir(profilesDir)
+	switch err.(type) {
+	case nil:
+		return fileInfo, true
+	case forbiddenDirError:
+		flashError(w, r, http.StatusForbidden, fmt.Sprintf("'%v' isn't a written profile and isn't within the allowed download directories", profilesDir))
+	case stateError:
+		setNoStore(w)
+		flashError(w, r, http.StatusConflict, "We write the requested profile at the moment. Stop it first, then you will be able to download it")
+	case notDirError:
+		fatalError(w, r, fmt.Sprintf("Expecting '%v' to be a directory, but it is not", profilesDir))
+	default:
+		if os.IsNotExist(err) {
+			writeError(w, r, http.StatusNotFound, fmt.Sprintf("No such profile: '%v'", profilesDir))
+		} else {
+			internalError(w, r, fmt.Sprintf("Cannot stat '%v': %v", profilesDir, err))
+		}
+	}
+	return nil, false
+}
+
+// forbiddenDirError is returned by readableDir for directories which aren't written profiles and aren't
+// within the download directories
+type forbiddenDirError string
+
+func (e forbiddenDirError) Error() string {
+	return fmt.Sprintf("'%v' isn't a written profile and isn't within the allowed download directories", string(e))
 }
 
-func packProfiles(profilesDir string) (*bytes.Buffer, error) {
-	archiveBytes := &bytes.Buffer{}
-	gz := gzip.NewWriter(archiveBytes)
-	defer gz.Close()
-	archive := tar.NewWriter(gz)
-	defer archive.Close()
-	binary, err := osext.Executable()
+// notDirError is returned by readableDir when the path isn't a directory
+type notDirError string
+
+func (e notDirError) Error() string {
+	return fmt.Sprintf("'%v' isn't a directory", string(e))
+}
+
+// readableDir returns an error unless the cleaned profiles directory may be read: it should be a written profile
+// or be within the download directories, it shouldn't be written at the moment and it should exist.
+// Should be called with ourProfilingStateGuard hold
+func readableDir(profilesDir string) (os.FileInfo, error) {
+	if !downloadAllowed(profilesDir) {
+		return nil, forbiddenDirError(profilesDir)
+	}
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		return nil, stateError("the profile is being written at the moment, stop it first")
+	}
+	fileInfo, err := os.Stat(profilesDir)
 	if err != nil {
 		return nil, err
 	}
-	if err := writeFile(archive, binary); err != nil {
+	if !fileInfo.IsDir() {
+		return nil, notDirError(profilesDir)
+	}
+	return fileInfo, nil
+}
+
+// downloadAllowed returns true if the cleaned directory is a written profile or is within the allowed download
+// directories. Should be called with ourProfilingStateGuard hold
+func downloadAllowed(profilesDir string) bool {
+	if findWrittenProfile(profilesDir) != nil {
+		return true
+	}
+	if ourCurrentProfile != nil && ourCurrentProfile.Dir == profilesDir {
+		return true
+	}
+	return withinDirs(profilesDir, ourConfig.downloadDirs)
+}
+
+// findWrittenProfile returns the written profile kept in the directory or nil if there is no such profile
+// Should be called with ourProfilingStateGuard hold
+func findWrittenProfile(profilesDir string) *prof {
+	for i := range ourWrittenProfiles {
+		if ourWrittenProfiles[i].Dir == profilesDir {
+			return &ourWrittenProfiles[i]
+		}
+	}
+	return nil
+}
+
+// profileETag identifies the archive of the profiles directory, it changes whenever the archive would.
+// Archives with extra files don't have it, see ArchiveExtrasFxn
+func profileETag(profilesDir string, modTime time.Time, opts archiveOptions) string {
+	hash := sha1.New()
+	// every option which changes the packed bytes, maxBytes only makes packing fail
+	fmt.Fprintf(hash, "%s|%d|%v|%v|%q|%q|%q|%q|", profilesDir, modTime.UnixNano(), opts.withBinary, opts.uncompressed,
+		opts.showWebCommand, opts.pprofServer, opts.binaryPath, opts.noShowWebPrefixes)
+	// metadata changes when the profile is labeled or renamed
+	fmt.Fprintf(hash, "%d|", len(opts.metadata))
+	hash.Write(opts.metadata)
+	hash.Write(opts.runtimeInfo)
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil))
+}
+
+func setCacheHeaders(w http.ResponseWriter, etag string, modTime time.Time) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+}
+
+// notModified checks conditional request headers. If-None-Match takes precedence over If-Modified-Since
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	// http dates have only seconds precision
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// archiveOptions tell how to pack profiles. They are taken while ourProfilingStateGuard is hold,
+// so packing doesn't touch ourConfig and may outlive the handler which started it
+type archiveOptions struct {
+	withBinary     bool
+	showWebCommand string // empty means defaultShowWebCommand
+	pprofServer    string // upload URL of show-remote script, empty means there is no such script
+	// prefixes of directory names of profiles which can't be opened with show-web script
+	noShowWebPrefixes []string
+	uncompressed      bool   // plain tar instead of tar.gz
+	metadata          []byte // written into the archive as metadataFileName, nothing is written if it's empty
+	runtimeInfo       []byte // written into the archive as runtimeInfoFileName, nothing is written if it's empty
+	maxBytes          int64  // packing fails with archiveTooLargeError once the archive exceeds it, 0 means no limit
+	binaryPath        string // empty means the running executable
+	// returns files written into extraFilesDir of the archive, nil means none
+	extras ArchiveExtrasFxn
+}
+
+// archiveTooLargeError is returned by packProfiles when the archive exceeds archiveOptions.maxBytes
+type archiveTooLargeError struct {
+	maxBytes int64
+}
+
+func (e archiveTooLargeError) Error() string {
+	return fmt.Sprintf("archive is larger than %d bytes", e.maxBytes)
+}
+
+// limitedWriter fails writes once more than max bytes are written in total
+type limitedWriter struct {
+	w        io.Writer
+	max      int64
+	written  int64
+	exceeded bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.exceeded || w.written+int64(len(p)) > w.max {
+		w.exceeded = true
+		return 0, archiveTooLargeError{w.max}
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// newArchiveOptions takes the options from config. Should be called with ourProfilingStateGuard hold
+func newArchiveOptions(withBinary bool) archiveOptions {
+	return archiveOptions{
+		withBinary:     withBinary,
+		showWebCommand: ourConfig.showWebCommand,
+		pprofServer:    ourConfig.pprofServer,
+		maxBytes:       ourConfig.maxArchiveBytes,
+		binaryPath:     ourConfig.binaryPath,
+		extras:         ourConfig.archiveExtras,
+		noShowWebPrefixes: []string{
+			profilesDirPrefix(profileAll), profilesDirPrefix(profileTrace), profilesDirPrefix(profileFlightTrace),
+		},
+	}
+}
+
+// setMetadata sets the metadata of the written profile and its runtime details, if SetArchiveRuntimeInfo is enabled
+// Should be called with ourProfilingStateGuard hold
+func (opts *archiveOptions) setMetadata(written prof) error {
+	metadata, err := json.MarshalIndent(written, "", "  ")
+	if err != nil {
+		return err
+	}
+	opts.metadata = metadata
+	if ourConfig.archiveRuntimeInfo && written.Process != nil && written.Process.Runtime != nil {
+		opts.runtimeInfo = written.Process.Runtime.text()
+	}
+	return nil
+}
+
+// withoutShowWeb returns true if profiles in the directory can't be opened with show-web script
+func (opts archiveOptions) withoutShowWeb(dirname string) bool {
+	for _, prefix := range opts.noShowWebPrefixes {
+		if strings.HasPrefix(dirname, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// executablePath returns the configured binary path or the path of the running executable if it's empty
+func executablePath(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	return osext.Executable()
+}
+
+// packProfilesContext works like packProfiles, but gives up as soon as ctx is done even if packing is stuck
+// in a read from the disk. The abandoned packing stops at the next read and releases its buffer itself
+func packProfilesContext(ctx context.Context, profilesDir string, opts archiveOptions) (*bytes.Buffer, error) {
+	type result struct {
+		archive *bytes.Buffer
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		archive, err := packProfiles(ctx, profilesDir, opts)
+		done <- result{archive, err}
+	}()
+	select {
+	case res := <-done:
+		return res.archive, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-done; res.err == nil {
+				releaseArchiveBuffer(res.archive)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// packProfiles writes binary and all the files from profilesDir into tar.gz archive, or into plain tar
+// if opts.uncompressed is set. Without opts.withBinary
+// the binary is written only if some of the profiles lack symbols. Packing stops with ctx error once ctx is done.
+// Packing fails with archiveTooLargeError as soon as the archive exceeds opts.maxBytes.
+// The returned buffer is taken from the pool, give it back with releaseArchiveBuffer when you don't need it anymore
+func packProfiles(ctx context.Context, profilesDir string, opts archiveOptions) (packed *bytes.Buffer, err error) {
+	archiveBytes := archiveBufferPool.Get().(*bytes.Buffer)
+	archiveBytes.Reset()
+	defer func() {
+		if err != nil {
+			releaseArchiveBuffer(archiveBytes)
+		}
+	}()
+	var output io.Writer = archiveBytes
+	if opts.maxBytes > 0 {
+		limited := &limitedWriter{w: archiveBytes, max: opts.maxBytes}
+		// runs after the archive is closed, so the bytes flushed on close are counted too
+		defer func() {
+			if limited.exceeded {
+				packed, err = nil, archiveTooLargeError{opts.maxBytes}
+			}
+		}()
+		output = limited
+	}
+	if err := writeArchive(ctx, output, profilesDir, opts); err != nil {
 		return nil, err
 	}
+	return archiveBytes, nil
+}
+
+// writeArchive writes the archive packed by packProfiles to the output, so it can be streamed anywhere without
+// keeping it in memory. opts.maxBytes isn't checked here, limit the output for it
+func writeArchive(ctx context.Context, output io.Writer, profilesDir string, opts archiveOptions) (err error) {
+	var archive *tar.Writer
+	if opts.uncompressed {
+		archive = tar.NewWriter(output)
+	} else {
+		gz := gzip.NewWriter(output)
+		defer func() {
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		archive = tar.NewWriter(gz)
+	}
+	// the archive is complete only once it's closed, so streaming it fails if the last bytes can't be written
+	defer func() {
+		if closeErr := archive.Close(); err == nil {
+			err = closeErr
+		}
+	}()
 	children, err := ioutil.ReadDir(profilesDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to ls '%v': %v", profilesDir, err)
+		return fmt.Errorf("failed to ls '%v': %v", profilesDir, err)
 	}
+	// files which can't be read are skipped, so one removed file doesn't cost the rest of the profiles
+	var skipped []SkippedFile
+	skip := func(name string, err error) error {
+		if _, ok := err.(unreadableFileError); !ok {
+			return err
+		}
+		logf("Skipped '%s' while packing '%s': %v", name, profilesDir, err)
+		skipped = append(skipped, SkippedFile{Name: filepath.Base(name), Error: err.Error()})
+		return nil
+	}
+	binName := ""
+	// profiles with symbols are usable without the binary, don't ship it if the client doesn't want it
+	if opts.withBinary || !allSymbolized(profilesDir, children) {
+		binary, err := executablePath(opts.binaryPath)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(ctx, archive, binary); err != nil {
+			if err := skip(binary, err); err != nil {
+				return err
+			}
+		} else {
+			binName = filepath.Base(binary)
+		}
+	}
+	packed, diskMetadata := 0, false
 	for _, child := range children {
+		// the metadata kept in the directory is replaced with the one passed in opts
+		if child.Name() == metadataFileName && len(opts.metadata) > 0 {
+			continue
+		}
 		childName := filepath.Join(profilesDir, child.Name())
-		if err := writeFile(archive, childName); err != nil {
-			return nil, fmt.Errorf("failed to write %v: %v", childName, err)
+		if err := writeFile(ctx, archive, childName); err != nil {
+			if err := skip(childName, err); err != nil {
+				return fmt.Errorf("failed to write %v: %v", childName, err)
+			}
+			continue
 		}
+		packed++
+		diskMetadata = diskMetadata || child.Name() == metadataFileName
 	}
-	dirname := filepath.Base(profilesDir)
-	if !strings.HasPrefix("prof-all", dirname) && !strings.HasPrefix("prof-trace", dirname) && len(children) == 1 {
-		binName := filepath.Base(binary)
-		profileName := children[0].Name()
-		withBinary := strings.Replace(showWebScriptTpl, "{{bin}}", binName, -1)
-		scriptSrc := strings.Replace(withBinary, "{{profile}}", profileName, -1)
-		tmpDir, err := ioutil.TempDir("", "")
-		if err != nil {
-			return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	if packed == 0 && len(skipped) > 0 {
+		return fmt.Errorf("failed to pack any file of '%v', e.g. %v: %v", profilesDir, skipped[0].Name, skipped[0].Error)
+	}
+	metadata := opts.metadata
+	if len(skipped) > 0 && !diskMetadata {
+		var err error
+		if metadata, err = withSkippedFiles(metadata, skipped); err != nil {
+			return fmt.Errorf("failed to list skipped files in %v: %v", metadataFileName, err)
 		}
-		tmpFile, err := os.Create(filepath.Join(tmpDir, "show-web"))
-		if err != nil {
-			return nil, fmt.Errorf("failed to create file in temp dir %v: %v", tmpDir, err)
+	}
+	if len(metadata) > 0 {
+		if err := writeBytes(archive, metadataFileName, metadata); err != nil {
+			return fmt.Errorf("failed to write %v: %v", metadataFileName, err)
 		}
-		defer os.RemoveAll(tmpDir)
-		err = tmpFile.Chmod(0777)
-		if err != nil {
-			return nil, fmt.Errorf("failed to chmod temp file %v: %v", tmpFile, err)
+	}
+	if len(opts.runtimeInfo) > 0 {
+		if err := writeBytes(archive, runtimeInfoFileName, opts.runtimeInfo); err != nil {
+			return fmt.Errorf("failed to write %v: %v", runtimeInfoFileName, err)
 		}
-		_, err = tmpFile.WriteString(scriptSrc)
-		if err != nil {
-			return nil, fmt.Errorf("failed to write temp file %v: %v", tmpFile, err)
+	}
+	dirname := filepath.Base(profilesDir)
+	profileNames := []string{}
+	for _, child := range children {
+		if _, _, ok := profileFileName(child.Name()); ok {
+			profileNames = append(profileNames, child.Name())
 		}
-		if err := writeFile(archive, tmpFile.Name()); err != nil {
-			return nil, fmt.Errorf("failed to write %v: %v", tmpFile.Name(), err)
+	}
+	if len(profileNames) == 1 && !opts.withoutShowWeb(dirname) && opts.pprofServer != "" {
+		scriptSrc := strings.Replace(showRemoteScriptTpl, "{{server}}", shellQuote(opts.pprofServer), -1)
+		scriptSrc = strings.Replace(scriptSrc, "{{profile}}", shellQuote(profileNames[0]), -1)
+		if err := writeScript(archive, "show-remote", scriptSrc); err != nil {
+			return fmt.Errorf("failed to write show-remote: %v", err)
 		}
 	}
-	return archiveBytes, nil
+	if len(profileNames) == 1 && !opts.withoutShowWeb(dirname) {
+		profileName := profileNames[0]
+		command := opts.showWebCommand
+		if command == "" {
+			command = defaultShowWebCommand
+		}
+		withCommand := strings.Replace(showWebScriptTpl, "{{command}}", command, -1)
+		withBinary := strings.Replace(withCommand, "{{bin}}", binName, -1)
+		scriptSrc := strings.Replace(withBinary, "{{profile}}", profileName, -1)
+		// the script is written from memory, a temp file would be exposed to other users of the shared temp dir
+		if err := writeScript(archive, "show-web", scriptSrc); err != nil {
+			return fmt.Errorf("failed to write show-web: %v", err)
+		}
+	}
+	if opts.extras != nil {
+		return writeExtraFiles(archive, profilesDir, opts.extras)
+	}
+	return nil
 }
 
-// write a single file into the provided archive
-func writeFile(archive *tar.Writer, filePath string) error {
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
+func releaseArchiveBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	archiveBufferPool.Put(buf)
+}
+
+// write a single file into the provided archive, stop copying once ctx is done. A file which can't be read,
+// e.g. it was removed or shrank while packing, results in unreadableFileError and leaves the archive valid:
+// either nothing is written for it or the missing part is filled with zeros
+func writeFile(ctx context.Context, archive *tar.Writer, filePath string) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return unreadableFileError{err}
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return unreadableFileError{err}
+	}
 	header, err := tar.FileInfoHeader(fileInfo, "")
 	if err != nil {
-		return err
+		return unreadableFileError{err}
 	}
 	if err := archive.WriteHeader(header); err != nil {
 		return err
 	}
-	file, err := os.Open(filePath)
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	source := &readErrorRecorder{r: contextReader{ctx, file}}
+	// the file may grow while it's packed, the size in the header is what is packed then
+	written, err := io.CopyBuffer(archive, io.LimitReader(source, header.Size), *buf)
+	if err != nil && source.err == nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if written == header.Size {
+		return nil
+	}
+	if _, err := io.CopyN(archive, zeroReader{}, header.Size-written); err != nil {
+		return err
+	}
+	if source.err == nil {
+		return unreadableFileError{fmt.Errorf("file shrank from %d to %d bytes while packing", header.Size, written)}
+	}
+	return unreadableFileError{fmt.Errorf("read %d bytes of %d: %v", written, header.Size, source.err)}
+}
+
+// unreadableFileError is returned by writeFile when the file couldn't be read, but the archive is still valid
+type unreadableFileError struct {
+	err error
+}
+
+func (e unreadableFileError) Error() string {
+	return e.err.Error()
+}
+
+// readErrorRecorder remembers the error of the reader, so it's not taken for an error of the writer
+type readErrorRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// zeroReader reads zeros forever
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// SkippedFile is a file left out of the archive or packed partially, since it couldn't be read. Skipped files are
+// listed in metadata.json of the archive
+type SkippedFile struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// withSkippedFiles returns the metadata with 'skipped_files' field listing the files
+func withSkippedFiles(metadata []byte, skipped []SkippedFile) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &fields); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := json.Marshal(skipped)
 	if err != nil {
+		return nil, err
+	}
+	fields["skipped_files"] = encoded
+	return json.MarshalIndent(fields, "", "  ")
+}
+
+// writeBytes writes data into the archive as a file with the given name
+func writeBytes(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+	if err := archive.WriteHeader(header); err != nil {
 		return err
 	}
-	if _, err := io.Copy(archive, file); err != nil {
+	_, err := archive.Write(data)
+	return err
+}
+
+// writeScript writes executable script into the archive
+func writeScript(archive *tar.Writer, name, src string) error {
+	header := &tar.Header{Name: name, Mode: 0755, Size: int64(len(src)), ModTime: time.Now()}
+	if err := archive.WriteHeader(header); err != nil {
 		return err
 	}
-	return nil
+	_, err := io.WriteString(archive, src)
+	return err
+}
+
+// shellQuote quotes the string for bash, so URLs with '&' or '$' stay intact
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// contextReader fails reads with ctx error once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextWriter fails writes with ctx error once ctx is done
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
 }
 
 // showWrittenProfiles renders page with list of all written profiles
 func showWrittenProfiles(w http.ResponseWriter, r *http.Request) {
 	ourProfilingStateGuard.RLock()
 	defer ourProfilingStateGuard.RUnlock()
+	recordActivity()
 
-	if isJsonRequest(r) {
+	params, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		fatalError(w, r, err.Error())
+		return
+	}
+	// CSV is asked for explicitly, so it wins over JSON by default
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		setNoStore(w)
+		if err := writeProfilesCSV(w, params.page(ourWrittenProfiles)); err != nil {
+			logf("Failed to write profiles CSV: %v", err)
+		}
+	} else if isJsonRequest(r) {
 		resp := ProfileListResponse{
-			OK:    true,
-			Items: ourWrittenProfiles,
+			OK:             true,
+			Items:          withPackTimes(params.page(ourWrittenProfiles)),
+			Total:          len(ourWrittenProfiles),
+			Current:        currentProfileStatus(),
+			Rates:          currentProfileRates(),
+			Armed:          armedProfiles(),
+			FlightRecorder: ourFlightRecorder != nil,
+			FailedAttempts: ourFailedAttempts,
 		}
-		w.Header().Add("Content-Type", "application/json")
+		setJSONHeaders(w)
 		encoder := json.NewEncoder(w)
 		encoder.Encode(resp)
 	} else {
-		renderPage(w, "")
+		renderPage(w, r, http.StatusOK, "")
 	}
 }
 
-func renderPage(w http.ResponseWriter, msg string) {
-	templateData := struct {
-		WrittenProfiles          []prof
-		CurrentProfile           *prof
-		Message                  string
-		ProfileStartedSecondsAgo int
-	}{ourWrittenProfiles, ourCurrentProfile, msg, 0}
-	if ourCurrentProfile != nil {
-		templateData.ProfileStartedSecondsAgo = int(time.Since(ourCurrentProfile.Start).Seconds())
+// writeProfilesCSV writes the written profiles as CSV with a header, one profile per row. Duration is
+// in seconds, so spreadsheets can sum it up
+func writeProfilesCSV(w io.Writer, profiles []prof) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"prof_name", "dir", "start", "duration_seconds"})
+	for _, written := range profiles {
+		csvWriter.Write([]string{
+			string(written.Prof),
+			written.Dir,
+			written.Start.Format(time.RFC3339),
+			strconv.FormatFloat(written.Duration.Seconds(), 'f', -1, 64),
+		})
 	}
-	err := writtenProfilesTemplate.Execute(w, templateData)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to render template: %v\n", err)
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// currentProfileStatus returns nil if no profile is being written at the moment
+func currentProfileStatus() *CurrentProfileStatus {
+	if ourCurrentProfile == nil {
+		return nil
+	}
+	status := &CurrentProfileStatus{
+		prof:            *ourCurrentProfile,
+		ElapsedSeconds:  int(time.Since(ourCurrentProfile.Start).Seconds()),
+		Autostop:        autostopArmed(),
+		AutostopWarning: autostopWarned(),
+		Overhead:        estimateOverhead(ourCurrentProfile.Prof),
 	}
+	if remaining := time.Until(ourAutostopDeadline); status.Autostop && remaining > 0 {
+		status.RemainingSeconds = int(remaining.Seconds())
+	}
+	return status
+}
+
+// renderPage responds with the profiling page. The page is rendered into a buffer first,
+// so a template failing in the middle results in a clean 500 instead of a half-written page
+func renderPage(w http.ResponseWriter, r *http.Request, statusCode int, msg string) {
+	// the page is rendered after toggling as well, so don't fail because of the listing params, just show everything
+	params, _ := parsePageParams(r.URL.Query())
+	templateData := PageData{
+		Title:           ourConfig.uiTitle,
+		WrittenProfiles: params.page(ourWrittenProfiles),
+		TotalProfiles:   len(ourWrittenProfiles),
+		NextPageURL:     params.nextPageURL(len(ourWrittenProfiles)),
+		CurrentProfile:  ourCurrentProfile,
+		Message:         msg,
+		Rates:           currentProfileRates(),
+		Armed:           armedProfiles(),
+		Profiles:        profileInfos(),
+		FlightRecorder:  ourFlightRecorder != nil,
+		FailedAttempts:  ourFailedAttempts,
+		ReadOnly:        isReadOnly(r),
+	}
+	templateData.AutostopDisarmed = ourCurrentProfile != nil && !autostopArmed()
+	templateData.LiveTrace = ourCurrentProfile != nil && ourCurrentProfile.Prof.writesTrace()
+	if status := currentProfileStatus(); status != nil {
+		templateData.ProfileStartedSecondsAgo = status.ElapsedSeconds
+		templateData.AutostopSecondsLeft = status.RemainingSeconds
+	}
+	pageTemplate := writtenProfilesTemplate
+	if ourConfig.pageTemplate != nil {
+		pageTemplate = ourConfig.pageTemplate
+	}
+	var page bytes.Buffer
+	if err := pageTemplate.Execute(&page, templateData); err != nil {
+		logf("Failed to render profiling page: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to render template: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setNoStore(w)
+	w.WriteHeader(statusCode)
+	page.WriteTo(w)
 }
 
 // ListenAndServe starts server on provided address for toggling profiling and downloading results
+// There is no auth, so prefer ListenAndServeLocal unless the address is protected some other way
 func ListenAndServe(address string) error {
-	return http.ListenAndServe(address, NewHandler())
+	warnIfExposed(address)
+	return newServer(address).ListenAndServe()
+}
+
+// ListenAndServeTLS works like ListenAndServe, but serves HTTPS with the certificate and the key from the files.
+// HTTP/2 is used by clients supporting it unless it's disabled with SetHTTP2
+func ListenAndServeTLS(address, certFile, keyFile string) error {
+	warnIfExposed(address)
+	return newServer(address).ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeLocal works like ListenAndServe, but listens only on 127.0.0.1, so the profiling tools aren't
+// reachable from the network. Use ssh port forwarding to open them. Port may be given as "8033" or ":8033"
+func ListenAndServeLocal(port string) error {
+	return ListenAndServe(net.JoinHostPort("127.0.0.1", strings.TrimPrefix(port, ":")))
+}
+
+// newServer creates the server for the profiling tools changed by the function set with SetServerOptions,
+// so the function may override HTTP/2 setting as well
+func newServer(address string) *http.Server {
+	server := &http.Server{Addr: address, Handler: NewHandler()}
+	ourProfilingStateGuard.RLock()
+	configure := ourConfig.configureServer
+	if ourConfig.noHTTP2 {
+		// non-nil empty map keeps net/http from configuring HTTP/2
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	ourProfilingStateGuard.RUnlock()
+	if configure != nil {
+		configure(server)
+	}
+	return server
+}
+
+// warnIfExposed logs a warning if the address is reachable from the network, since anyone reaching the profiling
+// tools may download the binary and start profiling
+func warnIfExposed(address string) {
+	if !isLoopbackAddress(address) {
+		logf("Profiling tools listen on '%v', which is reachable from the network without any auth. "+
+			"Consider ListenAndServeLocal", address)
+	}
+}
+
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve works like ListenAndServe, but shuts the server down when ctx is done. Archives can be large and slow
+// to download, so in-flight downloads are allowed to finish within shutdownTimeout. Running profiling is stopped,
+// since nobody can stop it after that. It returns nil if the server was shut down gracefully
+func Serve(ctx context.Context, address string, shutdownTimeout time.Duration) error {
+	warnIfExposed(address)
+	server := newServer(address)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// shutdown stops accepting new requests, so no new downloads are started after it
+	err := server.Shutdown(shutdownCtx)
+	// nobody is able to stop running profiling anymore, so stop it ourselves
+	ourProfilingStateGuard.Lock()
+	stopProfilingContext(shutdownCtx, stopShutdown)
+	ourProfilingStateGuard.Unlock()
+	if waitErr := WaitDownloads(shutdownCtx); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// WaitDownloads blocks until all in-flight downloads are finished or ctx is done.
+// If the handler is mounted to your own server, call it after the server stopped accepting requests
+func WaitDownloads(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		ourDownloads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		logf("Stopped waiting for in-flight downloads: %v", ctx.Err())
+		return ctx.Err()
+	}
 }
 
 // NewHandler creates http handler for the whole profiling tools application
 // If you want to use it aside of other handlers, don't miss http.StripPrefix wrapping like
-//   mux.Handle("/pprof/", http.StripPrefix("/pprof", goprof.NewHandler()))
+//
+//	mux.Handle("/pprof/", http.StripPrefix("/pprof", goprof.NewHandler()))
+//
+// or use RegisterHandlers instead
 func NewHandler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", showWrittenProfiles)
-	mux.HandleFunc("/toggle", toggleProfiling)
-	mux.HandleFunc("/download/", downloadProfile)
+	registerHandlers(mux, "", false)
 	return mux
 }
+
+// NewReadOnlyHandler creates http handler which lists and downloads written profiles, but can't start or stop
+// profiling or remove profiles: such requests get 403. Serve it to viewers, while NewHandler is served to operators
+func NewReadOnlyHandler() http.Handler {
+	mux := http.NewServeMux()
+	registerHandlers(mux, "", true)
+	return mux
+}
+
+// RegisterHandlers registers routes of the profiling tools application onto your mux under the prefix, e.g. "/pprof",
+// so they're served with the rest of your handlers and middleware. The page is served at prefix + "/"
+func RegisterHandlers(mux *http.ServeMux, prefix string) {
+	registerHandlers(mux, prefix, false)
+}
+
+type readOnlyKey struct{}
+
+func registerHandlers(mux *http.ServeMux, prefix string, readOnly bool) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	handle := func(route string, handler http.HandlerFunc) {
+		if readOnly {
+			next := handler
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				next(w, r.WithContext(context.WithValue(r.Context(), readOnlyKey{}, true)))
+			}
+		}
+		mux.HandleFunc(prefix+route, handler)
+	}
+	// control wraps handlers changing the profiling state
+	control := func(handler http.HandlerFunc) http.HandlerFunc {
+		if readOnly {
+			return forbidden
+		}
+		return handler
+	}
+	handle("/", showWrittenProfiles)
+	handle("/toggle", audited("/toggle", control(toggleProfiling)))
+	handle("/download/", audited("/download/", downloadProfile))
+	handle("/binary", audited("/binary", downloadBinary))
+	handle("/live-trace", audited("/live-trace", streamLiveTrace))
+	handle("/profile-file", audited("/profile-file", downloadProfileFile))
+	handle("/clear", audited("/clear", control(clearProfiles)))
+	handle("/profiles", showProfileTypes)
+	handle("/label", audited("/label", control(labelProfile)))
+	handle("/rename", audited("/rename", control(renameProfileHandler)))
+	handle("/cancel-autostop", control(cancelAutostopHandler))
+	handle("/abort", audited("/abort", control(abortProfilingHandler)))
+	handle("/extend-autostop", control(extendAutostopHandler))
+	handle("/flight-trace", control(flightTraceHandler))
+	handle("/arm", audited("/arm", control(armHandler)))
+	handle("/capture", audited("/capture", control(captureHandler)))
+	handle("/snapshot", control(snapshotHandler))
+	handle("/flamegraph", showFlameGraph)
+	handle("/top", showTopFunctions)
+	handle("/verify", verifyProfiles)
+	handle("/compare", compareVariants)
+	handle("/goroutines", showGoroutineGroups)
+	handle("/goroutines-stream", streamGoroutineGroups)
+	handle("/goroutine-delta", showGoroutineDelta)
+	handle("/goroutine-dump", showGoroutineDump)
+	handle("/runtime-metrics", showRuntimeMetrics)
+	handle("/overview", showOverview)
+	handle("/ready", showReady)
+	handle("/log", showLog)
+	changeRates := audited("/config", control(setRates))
+	handle("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			showConfig(w, r)
+			return
+		}
+		changeRates(w, r)
+	})
+	handle("/static/", serveStatic)
+}
+
+// isReadOnly returns true if the request is served by NewReadOnlyHandler
+func isReadOnly(r *http.Request) bool {
+	readOnly, _ := r.Context().Value(readOnlyKey{}).(bool)
+	return readOnly
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	flashError(w, r, http.StatusForbidden, "Profiling can't be controlled here, these profiling tools are read-only")
+}
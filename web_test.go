@@ -0,0 +1,1141 @@
+package goprof
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkConcurrentDownloads packs the same profiles directory from several goroutines at once,
+// which is what happens when a few people download profiles at the same time. Run it with -benchmem to see allocations
+func BenchmarkConcurrentDownloads(b *testing.B) {
+	profilesDir, err := ioutil.TempDir("", "prof-bench")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(profilesDir)
+	for _, name := range []string{cpuProfileFileName, traceFileName, "heap-profile"} {
+		if err := ioutil.WriteFile(filepath.Join(profilesDir, name), make([]byte, 256*1024), 0644); err != nil {
+			b.Fatalf("Failed to write %v: %v", name, err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{withBinary: true})
+			if err != nil {
+				b.Fatalf("Failed to pack profiles: %v", err)
+			}
+			releaseArchiveBuffer(archive)
+		}
+	})
+}
+
+func TestNotModified(t *testing.T) {
+	modTime := time.Date(2017, 4, 11, 12, 28, 11, 423161319, time.UTC)
+	etag := profileETag("/tmp/prof-cpu123", modTime, archiveOptions{withBinary: true})
+	cases := []struct {
+		header, value string
+		expected      bool
+	}{
+		{"If-None-Match", etag, true},
+		{"If-None-Match", `"other", ` + etag, true},
+		{"If-None-Match", `"other"`, false},
+		{"If-Modified-Since", modTime.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modTime.Add(-time.Minute).Format(http.TimeFormat), false},
+		{"If-Modified-Since", "garbage", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/download/prof-cpu123.tgz", nil)
+		r.Header.Set(c.header, c.value)
+		if got := notModified(r, etag, modTime); got != c.expected {
+			t.Errorf("Expected %v for %v: %v, got %v", c.expected, c.header, c.value, got)
+		}
+	}
+	labeled := profileETag("/tmp/prof-cpu123", modTime, archiveOptions{withBinary: true, metadata: []byte(`{"label":"spike"}`)})
+	if labeled == etag {
+		t.Errorf("Expected ETag to change with the metadata")
+	}
+	for name, opts := range map[string]archiveOptions{
+		"show-web command": {withBinary: true, showWebCommand: "go tool pprof -http=:9090"},
+		"pprof server":     {withBinary: true, pprofServer: "http://pprof.local/upload"},
+		"binary path":      {withBinary: true, binaryPath: "/usr/local/bin/service"},
+		"runtime info":     {withBinary: true, runtimeInfo: []byte("go1.21")},
+	} {
+		if profileETag("/tmp/prof-cpu123", modTime, opts) == etag {
+			t.Errorf("Expected ETag to change with the %v", name)
+		}
+	}
+}
+
+func TestStateIsNotCached(t *testing.T) {
+	handler := NewReadOnlyHandler()
+	for _, path := range []string{"/", "/?json=1", "/?format=csv", "/profiles", "/config", "/download/missing"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if path == "/download/missing" {
+			r.Header.Set("Accept", "application/json")
+		}
+		handler.ServeHTTP(w, r)
+		if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Pragma") != "no-cache" {
+			t.Errorf("Expected %v not to be cached, got %v", path, w.Header())
+		}
+	}
+}
+
+func TestSetTemplate(t *testing.T) {
+	defer SetTemplate(nil)
+	broken := template.Must(template.New("broken").Parse(`{{ .NoSuchField }}`))
+	if err := SetTemplate(broken); err == nil {
+		t.Fatalf("Expected template referencing unknown field to be rejected")
+	}
+	custom := template.Must(template.New("custom").Funcs(TemplateFuncs()).Parse(
+		`{{ .Title }}{{ range .WrittenProfiles }}{{ download .Dir }}{{ end }}`))
+	if err := SetTemplate(custom); err != nil {
+		t.Fatalf("Expected custom template to be accepted, got %v", err)
+	}
+	w := httptest.NewRecorder()
+	ourProfilingStateGuard.RLock()
+	renderPage(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "")
+	ourProfilingStateGuard.RUnlock()
+	if strings.Contains(w.Body.String(), "<html") {
+		t.Fatalf("Built-in template was rendered instead of the custom one: %v", w.Body.String())
+	}
+}
+
+func TestRenderPageFailure(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	defer func(tpl *template.Template) { ourConfig.pageTemplate = tpl }(ourConfig.pageTemplate)
+	ourConfig.pageTemplate = template.Must(template.New("failing").Parse(`half-written page{{ template "missing" }}`))
+	w := httptest.NewRecorder()
+	renderPage(w, httptest.NewRequest("GET", "/", nil), http.StatusOK, "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, got %v", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "half-written page") {
+		t.Fatalf("Partially rendered page was sent: %v", w.Body.String())
+	}
+}
+
+func TestWrittenProfilesPage(t *testing.T) {
+	now := time.Now()
+	profiles := []prof{
+		{Prof: profileCPU, Dir: "b", Start: now.Add(time.Minute)},
+		{Prof: profileHeap, Dir: "a", Start: now},
+		{Prof: profileTrace, Dir: "c", Start: now.Add(2 * time.Minute)},
+	}
+	params, err := parsePageParams(url.Values{"offset": {"1"}, "limit": {"1"}, "sort": {"asc"}})
+	if err != nil {
+		t.Fatalf("Failed to parse params: %v", err)
+	}
+	page := params.page(profiles)
+	if len(page) != 1 || page[0].Dir != "b" {
+		t.Fatalf("Expected the second profile by start time, got %#v", page)
+	}
+	if next := params.nextPageURL(len(profiles)); next != "?limit=1&offset=2&sort=asc" {
+		t.Fatalf("Unexpected next page url: %v", next)
+	}
+	if profiles[0].Dir != "b" {
+		t.Fatalf("Written profiles were sorted in place")
+	}
+	if page := (pageParams{offset: 5}).page(profiles); len(page) != 0 {
+		t.Fatalf("Expected empty page after the end, got %#v", page)
+	}
+	for _, bad := range []url.Values{{"offset": {"-1"}}, {"limit": {"x"}}, {"sort": {"name"}}} {
+		if _, err := parsePageParams(bad); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestWriteProfilesCSV(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var csv bytes.Buffer
+	err := writeProfilesCSV(&csv, []prof{
+		{Prof: profileCPU, Dir: "/tmp/prof-cpu,1", Start: start, Duration: 1500 * time.Millisecond},
+		{Prof: profileHeap, Dir: "/tmp/prof-heap2", Start: start},
+	})
+	if err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "prof_name,dir,start,duration_seconds\n" +
+		"cpu,\"/tmp/prof-cpu,1\",2020-01-02T03:04:05Z,1.5\n" +
+		"heap,/tmp/prof-heap2,2020-01-02T03:04:05Z,0\n"
+	if csv.String() != expected {
+		t.Fatalf("Expected CSV:\n%s\ngot:\n%s", expected, csv.String())
+	}
+	w := httptest.NewRecorder()
+	NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/?format=csv", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "prof_name,") {
+		t.Fatalf("Expected CSV listing, got %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestToggleErrorCodes(t *testing.T) {
+	handler := NewHandler()
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"/toggle?enable=yes&json=1", http.StatusBadRequest},
+		{"/toggle?enable=1&profile=nosuchprofile&json=1", http.StatusNotFound},
+		{"/toggle?enable=1&profile=nosuchprofile&validate=1&json=1", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("Expected %v for %v, got %v", c.status, c.url, w.Code)
+		}
+	}
+}
+
+func TestLabelProfile(t *testing.T) {
+	handler := NewHandler()
+	label := func(query string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/label?json=1&"+query, nil))
+		return w.Code
+	}
+	if status := label("label=spike"); status != http.StatusConflict {
+		t.Fatalf("Expected 409 labeling while profiling isn't running, got %v", status)
+	}
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileCPU, time.Minute, nil, nil, (&mockStarter{}).fxn(nil), (&mockStopper{}).fxn(), nil)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(dir)
+	}()
+	if status := label("label=spike"); status != http.StatusOK {
+		t.Fatalf("Expected running profile to be labeled, got %v", status)
+	}
+	ourProfilingStateGuard.Lock()
+	doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	ourProfilingStateGuard.Unlock()
+	if status := label("label=the+spike+at+3:05&path=" + url.QueryEscape(dir+"/")); status != http.StatusOK {
+		t.Fatalf("Expected written profile to be labeled, got %v", status)
+	}
+	ourProfilingStateGuard.RLock()
+	written := findWrittenProfile(dir)
+	ourProfilingStateGuard.RUnlock()
+	if written == nil || written.Label != "the spike at 3:05" {
+		t.Fatalf("Expected the label to be kept, got %#v", written)
+	}
+	if metadata, err := ioutil.ReadFile(filepath.Join(dir, metadataFileName)); err != nil || !strings.Contains(string(metadata), "3:05") {
+		t.Fatalf("Expected the label in the metadata, got %s %v", metadata, err)
+	}
+	if status := label("label=spike&path=/nonexistent"); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for not written profile, got %v", status)
+	}
+	if status := label("label=" + strings.Repeat("x", maxLabelLength+1)); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for too long label, got %v", status)
+	}
+}
+
+func TestRenameProfile(t *testing.T) {
+	handler := NewHandler()
+	rename := func(query string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/rename?json=1&"+query, nil))
+		return w.Code
+	}
+	download := func(dir, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/download/x.tgz?binary=0&path="+url.QueryEscape(dir), nil)
+		r.Header.Set("If-None-Match", etag)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	first, second := writeTestProfile(t), writeTestProfile(t)
+	etag := download(first, "").Header().Get("ETag")
+	if status := rename("name=baseline&path=" + url.QueryEscape(first)); status != http.StatusOK {
+		t.Fatalf("Expected written profile to be renamed, got %v", status)
+	}
+	if w := download(first, etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("Expected the renamed profile to be downloaded again with a new ETag, got %v %v", w.Code, w.Header().Get("ETag"))
+	}
+	ourProfilingStateGuard.RLock()
+	written := findWrittenProfile(first)
+	ourProfilingStateGuard.RUnlock()
+	if written == nil || written.Name != "baseline" {
+		t.Fatalf("Expected the name to be kept, got %#v", written)
+	}
+	if metadata, err := ioutil.ReadFile(filepath.Join(first, metadataFileName)); err != nil || !strings.Contains(string(metadata), "baseline") {
+		t.Fatalf("Expected the name in the metadata, got %s %v", metadata, err)
+	}
+	if status := rename("name=baseline&path=" + url.QueryEscape(second)); status != http.StatusConflict {
+		t.Fatalf("Expected 409 for the name of another profile, got %v", status)
+	}
+	if status := rename("name=baseline&path=/nonexistent"); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for not written profile, got %v", status)
+	}
+	if status := rename("name=" + strings.Repeat("x", maxNameLength+1) + "&path=" + url.QueryEscape(second)); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for too long name, got %v", status)
+	}
+	ourProfilingStateGuard.Lock()
+	dir, err := doStartProfiling(profileCPU, time.Minute, nil, nil, (&mockStarter{}).fxn(nil), (&mockStopper{}).fxn(), nil)
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+		removeWrittenProfile(dir)
+	}()
+	if status := rename("name=running&path=" + url.QueryEscape(dir)); status != http.StatusConflict {
+		t.Fatalf("Expected 409 renaming the profile being written, got %v", status)
+	}
+}
+
+func TestConcurrentStart(t *testing.T) {
+	handler := NewHandler()
+	const clients = 8
+	responses := make(chan *httptest.ResponseRecorder, clients)
+	start := make(chan struct{})
+	for i := 0; i < clients; i++ {
+		go func() {
+			<-start
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=cpu&json=1", nil))
+			responses <- w
+		}()
+	}
+	close(start)
+	started := 0
+	for i := 0; i < clients; i++ {
+		switch w := <-responses; w.Code {
+		case http.StatusOK:
+			started++
+		case http.StatusConflict:
+			if !strings.Contains(w.Body.String(), "already started") {
+				t.Errorf("Expected the conflict to tell profiling is already started, got %v", w.Body.String())
+			}
+		default:
+			t.Errorf("Expected 200 or 409 for concurrent start, got %v", w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=0&json=1", nil))
+	var resp ToggleResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	ourProfilingStateGuard.Lock()
+	removeWrittenProfile(resp.Dir)
+	ourProfilingStateGuard.Unlock()
+	if started != 1 {
+		t.Fatalf("Expected exactly one of %d concurrent starts to succeed, got %d", clients, started)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the started profiling to be stopped, got %v", w.Code)
+	}
+}
+
+func TestJSONByDefault(t *testing.T) {
+	handler := NewHandler()
+	contentType := func(target string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Header().Get("Content-Type")
+	}
+	if ct := contentType("/"); ct == "application/json" {
+		t.Fatalf("Expected HTML by default, got %v", ct)
+	}
+	SetJSONByDefault(true)
+	defer SetJSONByDefault(false)
+	if ct := contentType("/"); ct != "application/json" {
+		t.Fatalf("Expected JSON once it's the default, got %v", ct)
+	}
+	if ct := contentType("/toggle?enable=2"); ct != "application/json" {
+		t.Fatalf("Expected JSON error once it's the default, got %v", ct)
+	}
+	if ct := contentType("/?json=0"); ct == "application/json" {
+		t.Fatalf("Expected HTML for json=0, got %v", ct)
+	}
+	if ct := contentType("/?format=csv"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Expected CSV asked for explicitly, got %v", ct)
+	}
+}
+
+func TestWaitDownloads(t *testing.T) {
+	ourDownloads.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := WaitDownloads(ctx); err == nil {
+		t.Fatalf("Expected waiting to time out while download is in progress")
+	}
+	ourDownloads.Done()
+	if err := WaitDownloads(context.Background()); err != nil {
+		t.Fatalf("Expected waiting to succeed after download finished, got %v", err)
+	}
+}
+
+func TestProfileTypes(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/profiles", nil))
+	var resp ProfileTypesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	oneOff := map[profName]bool{}
+	infos := map[profName]ProfileInfo{}
+	for _, info := range resp.Items {
+		oneOff[info.Name] = info.OneOff
+		infos[info.Name] = info
+	}
+	if isOneOff, ok := oneOff[profileHeap]; !ok || !isOneOff {
+		t.Fatalf("Expected heap to be listed as one-off profile, got %#v", resp.Items)
+	}
+	if isOneOff, ok := oneOff[profileCPU]; !ok || isOneOff {
+		t.Fatalf("Expected cpu to be listed as not one-off profile, got %#v", resp.Items)
+	}
+	if !infos[profileTrace].Heavy || !infos[profileAll].Heavy || infos[profileCPU].Heavy {
+		t.Fatalf("Expected only profiles writing trace to be heavy, got %#v", resp.Items)
+	}
+	if !infos[profileBlock].NeedsRate || !infos[profileSnapshot].NeedsRate || infos[profileHeap].NeedsRate {
+		t.Fatalf("Expected block and snapshot to need rates, got %#v", resp.Items)
+	}
+	if infos[profileCPU].Duration != profileDuration(profileCPU) || infos[profileHeap].Duration != 0 {
+		t.Fatalf("Expected durations of profiles which aren't one-off, got %#v", resp.Items)
+	}
+}
+
+// archiveFiles returns names of the files in tar.gz archive
+func archiveFiles(t *testing.T, archive io.Reader) []string {
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		t.Fatalf("Failed to read gzip: %v", err)
+	}
+	return tarFiles(t, gz)
+}
+
+// tarFiles returns names of the files in tar archive
+func tarFiles(t *testing.T, archive io.Reader) []string {
+	reader := tar.NewReader(archive)
+	names := []string{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+func TestPackWithoutBinary(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	names := archiveFiles(t, archive)
+	for _, name := range names {
+		if name != "heap.pprof" && name != "show-web" {
+			t.Fatalf("Expected archive without binary, got %v", names)
+		}
+	}
+}
+
+func TestPackTimeout(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := packProfilesContext(ctx, profilesDir, archiveOptions{}); err != context.Canceled {
+		t.Fatalf("Expected packing to be canceled, got %v", err)
+	}
+}
+
+func TestIsLoopbackAddress(t *testing.T) {
+	cases := map[string]bool{
+		"127.0.0.1:8033": true,
+		"localhost:8033": true,
+		"[::1]:8033":     true,
+		":8033":          false,
+		"0.0.0.0:8033":   false,
+		"10.0.0.1:8033":  false,
+		"8033":           false,
+	}
+	for address, expected := range cases {
+		if got := isLoopbackAddress(address); got != expected {
+			t.Errorf("Expected %v for '%v', got %v", expected, address, got)
+		}
+	}
+}
+
+func TestShowWebWithTempDirPrefix(t *testing.T) {
+	ourProfilingStateGuard.Lock()
+	defer ourProfilingStateGuard.Unlock()
+	ourConfig.tempDirPrefix = "payments-"
+	defer func() { ourConfig.tempDirPrefix = "" }()
+	opts := newArchiveOptions(true)
+	cases := map[string]bool{
+		"payments-trace123":        true,
+		"payments-all123":          true,
+		"payments-flight-trace123": true,
+		"payments-heap123":         false,
+		"payments-cpu123":          false,
+	}
+	for dirname, expected := range cases {
+		if got := opts.withoutShowWeb(dirname); got != expected {
+			t.Errorf("Expected %v for '%v', got %v", expected, dirname, got)
+		}
+	}
+}
+
+func TestPackUncompressed(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: true})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	names := tarFiles(t, archive)
+	if len(names) == 0 || names[0] != "heap.pprof" {
+		t.Fatalf("Expected plain tar with heap profile, got %v", names)
+	}
+}
+
+func TestShowRemoteScript(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	server := "https://pprof.example.com/upload?team=payments&name=it's"
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: true, pprofServer: server})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Expected show-remote script in the archive: %v", err)
+		}
+		if header.Name != "show-remote" {
+			continue
+		}
+		src, _ := ioutil.ReadAll(reader)
+		if header.Mode != 0755 || !strings.Contains(string(src), `'https://pprof.example.com/upload?team=payments&name=it'\''s'`) ||
+			!strings.Contains(string(src), "@'heap.pprof'") {
+			t.Fatalf("Unexpected show-remote script with mode %o:\n%s", header.Mode, src)
+		}
+		return
+	}
+}
+
+func TestShowWebScript(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: true})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Expected show-web script in the archive: %v", err)
+		}
+		if header.Name != "show-web" {
+			continue
+		}
+		src, _ := ioutil.ReadAll(reader)
+		// nobody but the owner should be able to change the script after it's unpacked
+		if header.Mode != 0755 || !strings.Contains(string(src), "heap.pprof") {
+			t.Fatalf("Unexpected show-web script with mode %o:\n%s", header.Mode, src)
+		}
+		return
+	}
+}
+
+func TestMaxArchiveBytes(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	for _, uncompressed := range []bool{false, true} {
+		archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: uncompressed, maxBytes: 10})
+		if _, ok := err.(archiveTooLargeError); !ok || archive != nil {
+			t.Fatalf("Expected archive to be too large, got %v", err)
+		}
+		archive, err = packProfiles(context.Background(), profilesDir, archiveOptions{uncompressed: uncompressed, maxBytes: 1 << 30})
+		if err != nil {
+			t.Fatalf("Failed to pack profiles under the limit: %v", err)
+		}
+		releaseArchiveBuffer(archive)
+	}
+
+	defer SetMaxArchiveBytes(0)
+	SetMaxArchiveBytes(10)
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+formatDownloadURL(profilesDir)+"&binary=0&json=1", nil))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for too large archive, got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	handler := NewHandler()
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"/snapshot?json=1", http.StatusConflict},
+		{"/snapshot?profile=nosuchprofile&json=1", http.StatusNotFound},
+		{"/snapshot?profile=cpu&json=1", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("Expected %v for %v, got %v", c.status, c.url, w.Code)
+		}
+	}
+
+	ourProfilingStateGuard.Lock()
+	dir, err := startMockProfiling()
+	// mock profiling stops automatically at once, which must not happen while the lock is released
+	cancelAutoStop()
+	ourProfilingStateGuard.Unlock()
+	if err != nil {
+		t.Fatalf("Profiling should be started successfully. I got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		doStopProfiling(stopManual, (&mockDumper{}).fxn(nil), (&mockStopper{}).fxn(), (&mockStopper{}).fxn())
+	}()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/snapshot?profile=goroutine&label=deploy&json=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected snapshot to be written, got %v: %v", w.Code, w.Body.String())
+	}
+	ourProfilingStateGuard.RLock()
+	defer ourProfilingStateGuard.RUnlock()
+	dumps := ourCurrentProfile.Dumps
+	if len(dumps) != 1 || dumps[0].Prof != profileGoroutine || dumps[0].Label != "deploy" {
+		t.Fatalf("Expected labeled goroutine dump, got %#v", dumps)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dumps[0].File)); err != nil {
+		t.Fatalf("Snapshot file wasn't written: %v", err)
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	defer SetServerOptions(nil)
+	SetServerOptions(func(server *http.Server) {
+		server.IdleTimeout = time.Second
+	})
+	if server := newServer("127.0.0.1:0"); server.IdleTimeout != time.Second {
+		t.Fatalf("Expected server to be configured, got idle timeout %v", server.IdleTimeout)
+	}
+
+	defer SetDownloadKeepAlive(true)
+	SetDownloadKeepAlive(false)
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+formatDownloadURL(profilesDir)+"&binary=0", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Connection") != "close" {
+		t.Fatalf("Expected connection to be closed after download, got %v %v", w.Code, w.Header())
+	}
+}
+
+func TestDownloadOverHTTP2(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	// the test server provides the certificate and the client trusting it and speaking HTTP/2
+	certServer := httptest.NewUnstartedServer(nil)
+	certServer.EnableHTTP2 = true
+	certServer.StartTLS()
+	defer certServer.Close()
+	download := func() *http.Response {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		server := newServer("")
+		server.TLSConfig = &tls.Config{Certificates: certServer.TLS.Certificates}
+		go server.ServeTLS(listener, "", "")
+		defer server.Close()
+		ourProfilingStateGuard.RLock()
+		downloadURL := "https://" + listener.Addr().String() + "/" + formatDownloadURL(profilesDir) + "&binary=0"
+		ourProfilingStateGuard.RUnlock()
+		resp, err := certServer.Client().Get(downloadURL)
+		if err != nil {
+			t.Fatalf("Failed to download: %v", err)
+		}
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to download: %v %v", resp.Status, err)
+		}
+		return resp
+	}
+	if resp := download(); resp.ProtoMajor != 2 {
+		t.Fatalf("Expected download over HTTP/2, got %v", resp.Proto)
+	}
+	defer SetHTTP2(true)
+	SetHTTP2(false)
+	if resp := download(); resp.ProtoMajor != 1 {
+		t.Fatalf("Expected download over HTTP/1.1, got %v", resp.Proto)
+	}
+}
+
+func TestReadOnlyHandler(t *testing.T) {
+	handler := NewReadOnlyHandler()
+	for _, url := range []string{"/toggle?enable=1&profile=heap", "/clear", "/snapshot", "/extend-autostop?seconds=1"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", url, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for %v, got %v", url, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "toggle?enable=1") {
+		t.Fatalf("Expected page without start links, got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+func TestReadOnlyDownloadKeepsProfile(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	defer SetCleanupPolicy(CleanupKeep)
+	SetCleanupPolicy(CleanupOnDownload)
+	download := func(handler http.Handler) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/download/x.tgz?binary=0&path="+url.QueryEscape(profilesDir), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to download profile: %v %v", w.Code, w.Body.String())
+		}
+	}
+	download(NewReadOnlyHandler())
+	if _, err := os.Stat(profilesDir); err != nil {
+		t.Fatalf("Expected the profile downloaded by a viewer to be kept, got %v", err)
+	}
+	download(NewHandler())
+	if _, err := os.Stat(profilesDir); !os.IsNotExist(err) {
+		t.Fatalf("Expected the profile to be removed once downloaded, got %v", err)
+	}
+}
+
+func TestPackMetadata(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{metadata: []byte(`{"prof_name":"heap"}`)})
+	if err != nil {
+		t.Fatalf("Failed to pack profiles: %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	names := archiveFiles(t, archive)
+	for _, name := range names {
+		if name == metadataFileName {
+			return
+		}
+	}
+	t.Fatalf("Expected %v in the archive, got %v", metadataFileName, names)
+}
+
+func TestPackRuntimeInfo(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	written := prof{Prof: profileHeap, Dir: profilesDir, Process: &processInfo{Runtime: currentRuntimeInfo()}}
+	for _, include := range []bool{false, true} {
+		SetArchiveRuntimeInfo(include)
+		ourProfilingStateGuard.RLock()
+		opts := newArchiveOptions(false)
+		err := opts.setMetadata(written)
+		ourProfilingStateGuard.RUnlock()
+		if err != nil {
+			t.Fatalf("Failed to set metadata: %v", err)
+		}
+		archive, err := packProfiles(context.Background(), profilesDir, opts)
+		if err != nil {
+			t.Fatalf("Failed to pack profiles: %v", err)
+		}
+		names := strings.Join(archiveFiles(t, archive), " ")
+		releaseArchiveBuffer(archive)
+		if strings.Contains(names, runtimeInfoFileName) != include {
+			t.Fatalf("Expected %v in the archive to be %v, got %v", runtimeInfoFileName, include, names)
+		}
+	}
+	SetArchiveRuntimeInfo(false)
+	text := string(written.Process.Runtime.text())
+	for _, line := range []string{"gomaxprocs: ", "num_cpu: ", "num_cgo_call: ", "/sched/goroutines:goroutines: "} {
+		if !strings.Contains(text, line) {
+			t.Fatalf("Expected %q in %v, got %v", line, runtimeInfoFileName, text)
+		}
+	}
+}
+
+func TestPackSkipsUnreadableFiles(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	// the link points nowhere, so it's listed, but can't be opened
+	if err := os.Symlink(filepath.Join(profilesDir, "removed"), filepath.Join(profilesDir, "goroutine.pprof")); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{metadata: []byte(`{"prof_name":"heap"}`)})
+	if err != nil {
+		t.Fatalf("Expected the rest of files to be packed, got %v", err)
+	}
+	defer releaseArchiveBuffer(archive)
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		t.Fatalf("Failed to read gzip: %v", err)
+	}
+	reader := tar.NewReader(gz)
+	names := []string{}
+	var metadata struct {
+		Prof    string        `json:"prof_name"`
+		Skipped []SkippedFile `json:"skipped_files"`
+	}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		names = append(names, header.Name)
+		if header.Name == metadataFileName {
+			if err := json.NewDecoder(reader).Decode(&metadata); err != nil {
+				t.Fatalf("Failed to decode metadata: %v", err)
+			}
+		}
+	}
+	if joined := strings.Join(names, " "); !strings.Contains(joined, "heap.pprof") || strings.Contains(joined, "goroutine.pprof") {
+		t.Fatalf("Expected only the readable profile in the archive, got %v", joined)
+	}
+	if metadata.Prof != "heap" || len(metadata.Skipped) != 1 || metadata.Skipped[0].Name != "goroutine.pprof" {
+		t.Fatalf("Expected the skipped file in the metadata, got %+v", metadata)
+	}
+
+	if err := os.Remove(filepath.Join(profilesDir, "heap.pprof")); err != nil {
+		t.Fatalf("Failed to remove profile: %v", err)
+	}
+	if archive, err := packProfiles(context.Background(), profilesDir, archiveOptions{}); err == nil {
+		releaseArchiveBuffer(archive)
+		t.Fatalf("Expected packing to fail when no file can be read")
+	}
+}
+
+func TestRegisterHandlers(t *testing.T) {
+	sink := &mockAuditSink{}
+	SetAuditSink(sink)
+	defer SetAuditSink(nil)
+	mux := http.NewServeMux()
+	RegisterHandlers(mux, "/pprof/")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/pprof/profiles", nil))
+	var resp ProfileTypesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Items) == 0 {
+		t.Fatalf("Expected profile types under the prefix, got %v: %v", w.Body.String(), err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/pprof/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `href="toggle?enable=1&profile=`) {
+		t.Fatalf("Expected the page with relative links under the prefix, got %v %v", w.Code, w.Body.String())
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/pprof/toggle?enable=1&profile=nosuchprofile", nil))
+	if len(sink.events) != 1 || sink.events[0].Action != AuditStart {
+		t.Fatalf("Expected start under the prefix to be recorded, got %#v", sink.events)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=nosuchprofile", nil))
+	if w.Code != http.StatusNotFound || len(sink.events) != 1 {
+		t.Fatalf("Expected nothing registered outside of the prefix, got %v", w.Code)
+	}
+}
+
+func TestHostnameInArchiveNames(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skipf("No hostname: %v", err)
+	}
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	defer SetHostnameInArchiveNames(false)
+	SetHostnameInArchiveNames(true)
+	ourProfilingStateGuard.RLock()
+	downloadURL := formatDownloadURL(profilesDir)
+	ourProfilingStateGuard.RUnlock()
+	expectedName := hostname + "-" + filepath.Base(profilesDir) + ".tgz"
+	if !strings.HasPrefix(downloadURL, "download/"+expectedName+"?") {
+		t.Fatalf("Expected hostname in download URL, got %v", downloadURL)
+	}
+	w := httptest.NewRecorder()
+	NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+downloadURL+"&binary=0", nil))
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if w.Code != http.StatusOK || err != nil || params["filename"] != expectedName {
+		t.Fatalf("Expected archive to be named %v, got %v %v", expectedName, w.Code, w.Header())
+	}
+}
+
+func TestProfileDurations(t *testing.T) {
+	if err := SetProfileDuration("heap", time.Second); err == nil {
+		t.Fatalf("Expected one-off profile to have no duration")
+	}
+	if err := SetProfileDuration("nosuchprofile", time.Second); err == nil {
+		t.Fatalf("Expected unknown profile to fail")
+	}
+	if err := SetProfileDuration("cpu", 30*time.Second); err != nil {
+		t.Fatalf("Failed to set duration: %v", err)
+	}
+	defer SetProfileDuration("cpu", 0)
+	handler := NewHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `href="toggle?enable=1&profile=cpu&seconds=30">cpu (where cpu time is spent, 30s)`) {
+		t.Fatalf("Expected the start link with the configured duration, got %v", w.Body.String())
+	}
+	if err := SetProfileDuration("cpu", 1500*time.Millisecond); err != nil {
+		t.Fatalf("Failed to set duration: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `href="toggle?enable=1&profile=cpu&seconds=2">`) {
+		t.Fatalf("Expected the start link with whole seconds, got %v", w.Body.String())
+	}
+	if err := SetProfileDuration("cpu", 30*time.Second); err != nil {
+		t.Fatalf("Failed to set duration: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/profiles", nil))
+	var types ProfileTypesResponse
+	if err := json.NewDecoder(w.Body).Decode(&types); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	for _, info := range types.Items {
+		expected := defautMaxProfilingDuration
+		switch {
+		case info.OneOff:
+			expected = 0
+		case info.Name == profileCPU:
+			expected = 30 * time.Second
+		}
+		if info.Duration != expected {
+			t.Fatalf("Expected %v to run for %v, got %v", info.Name, expected, info.Duration)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=cpu&seconds=0&json=1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad seconds to be rejected, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?enable=1&profile=cpu&seconds=7&json=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to start profiling: %v", w.Body.String())
+	}
+	defer func() {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		os.RemoveAll(stopProfiling(stopManual))
+	}()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/?json=1", nil))
+	var list ProfileListResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if list.Current == nil || list.Current.RemainingSeconds <= 0 || list.Current.RemainingSeconds > 7 {
+		t.Fatalf("Expected profiling to stop in 7 seconds, got %#v", list.Current)
+	}
+}
+
+func TestToggleReturnsDir(t *testing.T) {
+	handler := NewHandler()
+	toggle := func(query string) ToggleResponse {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/toggle?json=1&"+query, nil))
+		var resp ToggleResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Failed to toggle profiling with %v, got %v: %v", query, w.Code, err)
+		}
+		return resp
+	}
+	removeWritten := func(dir string) {
+		ourProfilingStateGuard.Lock()
+		defer ourProfilingStateGuard.Unlock()
+		removeWrittenProfile(dir)
+	}
+
+	heap := toggle("enable=1&profile=heap")
+	defer removeWritten(heap.Dir)
+	if _, err := os.Stat(filepath.Join(heap.Dir, "heap.pprof")); err != nil {
+		t.Fatalf("Expected heap profile in the returned directory: %v", err)
+	}
+	if heap.DownloadURL != formatDownloadURL(heap.Dir) {
+		t.Fatalf("Expected download link of %v, got %v", heap.Dir, heap.DownloadURL)
+	}
+
+	started := toggle("enable=1&profile=cpu")
+	stopped := toggle("enable=0")
+	defer removeWritten(stopped.Dir)
+	if started.Dir == "" || stopped.Dir != started.Dir {
+		t.Fatalf("Expected profile to be stopped in the directory it was started in, got '%v' and '%v'", started.Dir, stopped.Dir)
+	}
+}
+
+func TestDownloadDirs(t *testing.T) {
+	base, err := ioutil.TempDir("", "goprof-external")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(base)
+	for _, dir := range []string{"inside", "../" + filepath.Base(base) + "-sibling"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatalf("Failed to create %v: %v", dir, err)
+		}
+	}
+	defer os.RemoveAll(base + "-sibling")
+	download := func(dir string) int {
+		w := httptest.NewRecorder()
+		NewHandler().ServeHTTP(w, httptest.NewRequest("GET", "/download/x.tgz?binary=0&json=1&path="+url.QueryEscape(dir), nil))
+		return w.Code
+	}
+	inside := filepath.Join(base, "inside")
+	if code := download(inside); code != http.StatusForbidden {
+		t.Fatalf("Expected only written profiles to be downloadable by default, got %v", code)
+	}
+	defer SetDownloadDirs()
+	SetDownloadDirs(base + "/")
+	cases := []struct {
+		dir  string
+		code int
+	}{
+		{inside, http.StatusOK},
+		{base + "/inside/../inside", http.StatusOK},
+		{base + "/inside/../..", http.StatusForbidden},
+		{base + "-sibling", http.StatusForbidden},
+		{"/etc", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if code := download(c.dir); code != c.code {
+			t.Errorf("Expected %v for %v, got %v", c.code, c.dir, code)
+		}
+	}
+	// files of the directory may be rewritten without changing its modification time
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/download/x.tgz?binary=0&path="+url.QueryEscape(inside), nil)
+	r.Header.Set("If-None-Match", "*")
+	NewHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected the directory goprof didn't write to be packed anew without ETag, got %v %v", w.Code, w.Header())
+	}
+}
+
+func TestResponseStatusCodes(t *testing.T) {
+	profilesDir := writeTestProfile(t)
+	defer os.RemoveAll(profilesDir)
+	defer SetDownloadDirs()
+	SetDownloadDirs(os.TempDir())
+	handler := NewHandler()
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"/toggle?enable=2", http.StatusBadRequest},
+		{"/toggle?enable=1&profile=nosuchprofile", http.StatusNotFound},
+		{"/toggle?enable=0", http.StatusConflict},
+		{"/cancel-autostop", http.StatusConflict},
+		{"/abort", http.StatusConflict},
+		{"/extend-autostop?seconds=10", http.StatusConflict},
+		{"/flight-trace", http.StatusConflict},
+		{"/download/x.tgz?path=" + url.QueryEscape(filepath.Join(os.TempDir(), "goprof-nonexistent")), http.StatusNotFound},
+		{"/download/x.tgz?path=" + url.QueryEscape(profilesDir) + "&compression=zip", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		for _, asJSON := range []bool{true, false} {
+			r := httptest.NewRequest("GET", c.url, nil)
+			if asJSON {
+				r.Header.Set("Accept", "application/json")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != c.status {
+				t.Errorf("Expected %v for %v (json: %v), got %v", c.status, c.url, asJSON, w.Code)
+			}
+			if asJSON && w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("Expected JSON error for %v, got %v", c.url, w.Header().Get("Content-Type"))
+			}
+		}
+	}
+}
+
+func TestDownloadBinary(t *testing.T) {
+	binary, err := ioutil.TempFile("", "goprof-binary")
+	if err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+	defer os.Remove(binary.Name())
+	binary.WriteString("ELF")
+	binary.Close()
+	defer SetBinaryPath("")
+	SetBinaryPath(binary.Name())
+
+	download := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		NewReadOnlyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/"+link, nil))
+		return w
+	}
+	w := download("binary")
+	if w.Code != http.StatusOK || w.Body.String() != "ELF" {
+		t.Fatalf("Expected the binary to be served, got %v %q", w.Code, w.Body.String())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, filepath.Base(binary.Name())) {
+		t.Fatalf("Expected the binary name in Content-Disposition, got %q", disposition)
+	}
+
+	defer SetDownloadSecret("")
+	SetDownloadSecret("secret")
+	if w := download("binary"); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected unsigned download to be rejected, got %v", w.Code)
+	}
+	link, err := SignedBinaryURL(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to sign binary link: %v", err)
+	}
+	if w := download(link); w.Code != http.StatusOK {
+		t.Fatalf("Expected signed download to succeed, got %v", w.Code)
+	}
+	SetBinaryPath(binary.Name() + "-nonexistent")
+	if w := download(link); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected missing binary to get 404, got %v", w.Code)
+	}
+}